@@ -0,0 +1,121 @@
+package lvm2
+
+import "sort"
+
+// FreeRange is a range of released address space.
+type FreeRange struct {
+	Start uint64
+	Size  uint64
+}
+
+func (r FreeRange) End() uint64 {
+	return r.Start + r.Size
+}
+
+// FreeList is a list of released address space, sorted by Start.
+// Adjacent ranges are always coalesced.
+type FreeList []FreeRange
+
+// Take removes size bytes from the smallest range that fits (best fit)
+// and returns their start address.
+func (l *FreeList) Take(size uint64) (uint64, bool) {
+	best := -1
+	for i, r := range *l {
+		if r.Size >= size && (best == -1 || r.Size < (*l)[best].Size) {
+			best = i
+			if r.Size == size {
+				break
+			}
+		}
+	}
+	if best == -1 {
+		return 0, false
+	}
+
+	r := &(*l)[best]
+	start := r.Start
+	r.Start += size
+	r.Size -= size
+	if r.Size == 0 {
+		*l = append((*l)[:best], (*l)[best+1:]...)
+	}
+	return start, true
+}
+
+// Put releases [start, start+size) and merges it with its neighbours.
+func (l *FreeList) Put(start, size uint64) {
+	if size == 0 {
+		return
+	}
+
+	i := sort.Search(len(*l), func(i int) bool { return (*l)[i].Start > start })
+	if i > 0 && (*l)[i-1].End() == start {
+		(*l)[i-1].Size += size
+		if i < len(*l) && (*l)[i-1].End() == (*l)[i].Start {
+			(*l)[i-1].Size += (*l)[i].Size
+			*l = append((*l)[:i], (*l)[i+1:]...)
+		}
+		return
+	}
+	if i < len(*l) && start+size == (*l)[i].Start {
+		(*l)[i].Start = start
+		(*l)[i].Size += size
+		return
+	}
+
+	*l = append(*l, FreeRange{})
+	copy((*l)[i+1:], (*l)[i:])
+	(*l)[i] = FreeRange{Start: start, Size: size}
+}
+
+// Contains reports whether address lies in a released range.
+func (l FreeList) Contains(address uint64) bool {
+	i := sort.Search(len(l), func(i int) bool { return l[i].End() > address })
+	return i < len(l) && l[i].Start <= address
+}
+
+// TrimTail removes the range ending at head, if any, and returns its start.
+// Otherwise it returns head.
+func (l *FreeList) TrimTail(head uint64) uint64 {
+	if n := len(*l); n > 0 && (*l)[n-1].End() == head {
+		head = (*l)[n-1].Start
+		*l = (*l)[:n-1]
+	}
+	return head
+}
+
+// Alloc reserves size bytes, reusing released space when possible.
+// Otherwise it bumps *head, starting from a released range that ends at it,
+// and fails if the reservation would pass limit.
+func (l *FreeList) Alloc(head *uint64, size, limit uint64) (uint64, bool) {
+	if start, ok := l.Take(size); ok {
+		return start, true
+	}
+
+	start := alignUp(*head, WORD_SIZE)
+	if start < *head || start+size < start || start+size > limit {
+		return 0, false
+	}
+	start = l.TrimTail(start)
+	*head = start + size
+	return start, true
+}
+
+func alignUp(v, align uint64) uint64 {
+	return (v + align - 1) &^ (align - 1)
+}
+
+// Reserve removes [start, start+size) from the list. It reports false,
+// leaving the list unchanged, unless the range lies in a single released range.
+func (l *FreeList) Reserve(start, size uint64) bool {
+	i := sort.Search(len(*l), func(i int) bool { return (*l)[i].End() > start })
+	if i == len(*l) || (*l)[i].Start > start || (*l)[i].End()-start < size {
+		return false
+	}
+
+	r := (*l)[i]
+	*l = append((*l)[:i], (*l)[i+1:]...)
+	l.Put(r.Start, start-r.Start)
+	l.Put(start+size, r.End()-start-size)
+	return true
+}
@@ -1,6 +1,8 @@
 package asm
 
 import (
+	"encoding/binary"
+	"math"
 	"strconv"
 	"strings"
 
@@ -13,6 +15,7 @@ const (
 	CODE_INST CodeType = iota
 	CODE_DATA
 	CODE_LABEL
+	CODE_TABLE
 )
 
 type Code struct {
@@ -23,6 +26,7 @@ type Code struct {
 
 	Label string
 	Data  []byte
+	Table []Operand
 }
 
 type Operand struct {
@@ -62,6 +66,15 @@ func DATA(b []byte) Code {
 	}
 }
 
+// TABLE emits a jump table for JTAB and CALLT.
+// Entries must be constants or labels.
+func TABLE(entries ...Operand) Code {
+	return Code{
+		Type:  CODE_TABLE,
+		Table: entries,
+	}
+}
+
 func OPCONST(v uint64) Operand {
 	return Operand{
 		Type:  OperandType_ConstantValue,
@@ -69,6 +82,10 @@ func OPCONST(v uint64) Operand {
 	}
 }
 
+func OPFLOAT(f float64) Operand {
+	return OPCONST(math.Float64bits(f))
+}
+
 func OPREG(r uint64) Operand {
 	return Operand{
 		Type:  OperandType_RegisterValue,
@@ -128,6 +145,15 @@ func (v Code) String() string {
 		sb.WriteString("LABEL \"")
 		sb.WriteString(strconv.Quote(v.Label))
 		sb.WriteString("\"")
+	case CODE_TABLE:
+		sb.WriteString("TABLE [")
+		for i, op := range v.Table {
+			if i != 0 {
+				sb.WriteString(", ")
+			}
+			sb.WriteString(op.String())
+		}
+		sb.WriteString("]")
 	}
 	return sb.String()
 }
@@ -136,6 +162,10 @@ type Encoder struct {
 	Dst []byte
 	PC  uint64
 
+	// DATA is encoded into Data, which is loaded at DataAddress
+	Data        []byte
+	DataAddress uint64
+
 	Labels map[string]uint64
 }
 
@@ -153,6 +183,8 @@ func (e *Encoder) Encode(c Code) uint64 {
 		return e.encodeData(c)
 	case CODE_LABEL:
 		return e.encodeLabel(c)
+	case CODE_TABLE:
+		return e.encodeTable(c)
 	}
 	return e.PC
 }
@@ -182,9 +214,25 @@ func (e *Encoder) encodeInstruction(c Code) (out uint64) {
 }
 
 func (e *Encoder) encodeData(c Code) (out uint64) {
+	out = e.DataAddress + uint64(len(e.Data))
+	e.Data = append(e.Data, c.Data...)
+	return
+}
+
+func (e *Encoder) encodeTable(c Code) (out uint64) {
 	out = e.PC
-	e.Dst = append(e.Dst, c.Data...)
-	e.PC += uint64(len(c.Data))
+	var buffer [8]byte
+	binary.LittleEndian.PutUint64(buffer[:], uint64(len(c.Table)))
+	e.Dst = append(e.Dst, buffer[:]...)
+	for _, op := range c.Table {
+		v := op.Value
+		if op.Type == OperandType_Label {
+			v = e.Labels[op.Value_Label]
+		}
+		binary.LittleEndian.PutUint64(buffer[:], v)
+		e.Dst = append(e.Dst, buffer[:]...)
+	}
+	e.PC += uint64(len(buffer) * (len(c.Table) + 1))
 	return
 }
 
@@ -0,0 +1,125 @@
+package lvm2
+
+import "encoding/binary"
+
+// VMMemoryAtomic is implemented by memories supporting atomic instructions
+// on memory shared between goroutines.
+type VMMemoryAtomic interface {
+	// Atomic calls f with the size bytes at address. No other access to
+	// them, from any memory the bytes are mapped into, happens during f.
+	// address is aligned to size, and perm is the access f needs.
+	Atomic(address, size uint64, perm Perm, f func(b []byte)) error
+}
+
+var (
+	_ VMMemoryAtomic = (*Memory)(nil)
+	_ VMMemoryAtomic = (*PagedMemory)(nil)
+)
+
+func (m *Memory) Atomic(address, size uint64, perm Perm, f func(b []byte)) error {
+	block, index, err := m.LoadBlockIndex(address)
+	if err != nil {
+		return err
+	}
+	if block.Perm&perm != perm {
+		return &Fault{Kind: FaultProtection, Address: address, Access: perm}
+	}
+	if block.shared && perm&PermWrite != 0 {
+		block = m.unshare(index)
+	}
+	b := block.slice(address)
+	if uint64(len(b)) < size {
+		return &Fault{Kind: FaultSegmentation, Address: address + uint64(len(b))}
+	}
+
+	block.region.lock(perm)
+	f(b[:size])
+	block.region.unlock(perm)
+	return nil
+}
+
+func (m *PagedMemory) Atomic(address, size uint64, perm Perm, f func(b []byte)) error {
+	page, err := m.pageAt(address)
+	if err != nil {
+		return err
+	}
+	if page.Perm&perm != perm {
+		return &Fault{Kind: FaultProtection, Address: address, Access: perm}
+	}
+
+	// Aligned accesses never cross a page.
+	offset := address % PAGE_SIZE
+	page.region.lock(perm)
+	switch {
+	case perm&PermWrite != 0:
+		f(page.writable()[offset : offset+size])
+	case page.Data == nil:
+		f(zeroPage[offset : offset+size])
+	default:
+		f(page.Data[offset : offset+size])
+	}
+	page.region.unlock(perm)
+	return nil
+}
+
+// atomicAccess calls f with the size bytes at address as one atomic step.
+// address must be aligned to size.
+func atomicAccess(m VMMemory, address, size uint64, perm Perm, f func(b []byte)) error {
+	if address%size != 0 {
+		return &Fault{Kind: FaultAlignment, Address: address}
+	}
+	if a, ok := m.(VMMemoryAtomic); ok {
+		return a.Atomic(address, size, perm, f)
+	}
+	// Other memories are atomic as long as the access is not split.
+	return accessWhole(m, address, size, perm, f)
+}
+
+// accessWhole calls f with the size bytes at address in one piece.
+func accessWhole(m VMMemory, address, size uint64, perm Perm, f func(b []byte)) error {
+	err := checkRange(m, address, size, perm)
+	if err != nil {
+		return err
+	}
+	return m.GetMemoryFunc(address, size, perm, func(addr uint64, b []byte) error {
+		if uint64(len(b)) < size {
+			return &Fault{Kind: FaultAlignment, Address: addr}
+		}
+		f(b)
+		return nil
+	})
+}
+
+// atomicSize returns the access size of an atomic instruction.
+func atomicSize(t InstructionType) uint64 {
+	switch t {
+	case InstructionType_LOADAH, InstructionType_STORELH, InstructionType_XADDH, InstructionType_XCHGH, InstructionType_CASH:
+		return 4
+	case InstructionType_LOADAB, InstructionType_STORELB, InstructionType_XADDB, InstructionType_XCHGB, InstructionType_CASB:
+		return 1
+	}
+	return WORD_SIZE
+}
+
+// getUint reads a little endian integer of len(b) bytes.
+func getUint(b []byte) uint64 {
+	switch len(b) {
+	case 8:
+		return binary.LittleEndian.Uint64(b)
+	case 4:
+		return uint64(binary.LittleEndian.Uint32(b))
+	}
+	return uint64(b[0])
+}
+
+// putUint writes the low len(b) bytes of v in little endian.
+func putUint(b []byte, v uint64) {
+	switch len(b) {
+	case 8:
+		binary.LittleEndian.PutUint64(b, v)
+	case 4:
+		binary.LittleEndian.PutUint32(b, uint32(v))
+	default:
+		b[0] = byte(v)
+	}
+}
@@ -0,0 +1,151 @@
+package lvm2
+
+import (
+	"encoding/binary"
+	"sync"
+	"testing"
+)
+
+func TestInstruction_Atomic(t *testing.T) {
+	mem := []byte{0, 0, 0, 0, 0, 0, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+	runInstructionTests(t, []instructionTest{
+		{"LOADA", inst(InstructionType_LOADA, cnst(REGISTER_R0), cnst(memAddr+6), cnst(0)), nil, append(make([]byte, 6), 1, 2, 3, 4, 5, 6, 7, 8), 0x0807060504030201},
+		{"LOADAH", inst(InstructionType_LOADAH, cnst(REGISTER_R0), cnst(memAddr+6), cnst(0)), nil, mem, 0xFFFFFFFF},
+		{"LOADAB", inst(InstructionType_LOADAB, cnst(REGISTER_R0), reg(REGISTER_R1), cnst(1)), map[uint64]uint64{REGISTER_R1: memAddr + 6}, mem, 0xFF},
+	})
+
+	// Read-modify-write on a heap word of all ones, R0 starts as -1.
+	tests := []struct {
+		name string
+		inst testInstruction
+		r0   uint64
+		want []byte
+	}{
+		{"STOREL", inst(InstructionType_STOREL, cnst(0x0102), reg(REGISTER_R1), cnst(0)), 0, []byte{2, 1, 0, 0, 0, 0, 0, 0}},
+		{"STORELH", inst(InstructionType_STORELH, cnst(0x0102), reg(REGISTER_R1), cnst(0)), 0, []byte{2, 1, 0, 0, 0xFF, 0xFF, 0xFF, 0xFF}},
+		{"STORELB", inst(InstructionType_STORELB, cnst(0x0102), reg(REGISTER_R1), cnst(0)), 0, []byte{2, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}},
+		{"XADD", inst(InstructionType_XADD, cnst(REGISTER_R0), reg(REGISTER_R1), cnst(1)), i64(-1), []byte{0, 0, 0, 0, 0, 0, 0, 0}},
+		{"XADDH", inst(InstructionType_XADDH, cnst(REGISTER_R0), reg(REGISTER_R1), cnst(1)), 0xFFFFFFFF, []byte{0, 0, 0, 0, 0xFF, 0xFF, 0xFF, 0xFF}},
+		{"XADDB", inst(InstructionType_XADDB, cnst(REGISTER_R0), reg(REGISTER_R1), cnst(2)), 0xFF, []byte{1, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}},
+		{"XCHG", inst(InstructionType_XCHG, cnst(REGISTER_R0), reg(REGISTER_R1), cnst(7)), i64(-1), []byte{7, 0, 0, 0, 0, 0, 0, 0}},
+		{"XCHGH", inst(InstructionType_XCHGH, cnst(REGISTER_R0), reg(REGISTER_R1), cnst(7)), 0xFFFFFFFF, []byte{7, 0, 0, 0, 0xFF, 0xFF, 0xFF, 0xFF}},
+		{"XCHGB", inst(InstructionType_XCHGB, cnst(REGISTER_R0), reg(REGISTER_R1), cnst(7)), 0xFF, []byte{7, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}},
+		{"CAS", inst(InstructionType_CAS, cnst(REGISTER_R0), reg(REGISTER_R1), cnst(7)), i64(-1), []byte{7, 0, 0, 0, 0, 0, 0, 0}},
+		{"CAS/fail", inst(InstructionType_CAS, cnst(REGISTER_R2), reg(REGISTER_R1), cnst(7)), i64(-1), []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}},
+		{"CASH", inst(InstructionType_CASH, cnst(REGISTER_R0), reg(REGISTER_R1), cnst(7)), 0xFFFFFFFF, []byte{7, 0, 0, 0, 0xFF, 0xFF, 0xFF, 0xFF}},
+		{"CASB", inst(InstructionType_CASB, cnst(REGISTER_R0), reg(REGISTER_R1), cnst(7)), 0xFF, []byte{7, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm := newTestVM(tt.inst)
+			vm.Registers[REGISTER_R1], _ = vm.Memory.Allocate(WORD_SIZE)
+			vm.Memory.WriteAt(vm.Registers[REGISTER_R1], mem[6:])
+			vm.Registers[REGISTER_R0] = i64(-1)
+			if _, err := vm.Step(); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, WORD_SIZE)
+			vm.Memory.ReadAt(vm.Registers[REGISTER_R1], got)
+			if string(got) != string(tt.want) {
+				t.Errorf("memory = %x, want %x", got, tt.want)
+			}
+			if tt.inst.Type.WritesRegister() && vm.Registers[tt.inst.Ops[0].Value] != tt.r0 {
+				t.Errorf("R0 = %#x, want %#x", vm.Registers[tt.inst.Ops[0].Value], tt.r0)
+			}
+		})
+	}
+}
+
+func TestInstruction_AtomicFault(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		inst testInstruction
+		kind FaultKind
+	}{
+		{"Misaligned", inst(InstructionType_XADD, cnst(REGISTER_R0), reg(REGISTER_R1), cnst(1)), FaultAlignment},
+		{"MisalignedH", inst(InstructionType_LOADAH, cnst(REGISTER_R0), reg(REGISTER_R1), cnst(2)), FaultAlignment},
+		{"Program", inst(InstructionType_STOREL, cnst(0), cnst(0), cnst(0)), FaultProtection},
+		{"Unmapped", inst(InstructionType_CAS, cnst(REGISTER_R0), cnst(1<<32), cnst(0)), FaultSegmentation},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			vm := newTestVM(tt.inst)
+			a, _ := vm.Memory.Allocate(2 * WORD_SIZE)
+			vm.Registers[REGISTER_R1] = a + 4
+			if _, err := vm.Step(); faultKind(err) != tt.kind {
+				t.Fatalf("err = %v, want %v", err, tt.kind)
+			}
+		})
+	}
+}
+
+// TestVM_AtomicShared runs VMs on several goroutines against one shared
+// region. Each increments a counter with XADD and another one under a
+// CAS spinlock with plain loads and stores. Run with -race.
+func TestVM_AtomicShared(t *testing.T) {
+	const (
+		address    = 64 * PAGE_SIZE
+		iterations = 200
+		vms        = 4
+	)
+	lock := uint64(address)
+	counter := uint64(address + 8)
+	locked := uint64(address + 16)
+	prog := []testInstruction{
+		// 0: R5 = iterations
+		inst(InstructionType_MOV, cnst(REGISTER_R5), cnst(iterations)),
+		// 1: loop
+		inst(InstructionType_XADD, cnst(REGISTER_R0), cnst(counter), cnst(1)),
+		// 2: acquire: R1 = 0; CAS(lock, R1, 1); retry while R1 != 0
+		inst(InstructionType_MOV, cnst(REGISTER_R1), cnst(0)),
+		inst(InstructionType_CASB, cnst(REGISTER_R1), cnst(lock), cnst(1)),
+		inst(InstructionType_JNE, reg(REGISTER_R1), cnst(2*InstructionBytecodeSize)),
+		// 5: critical section
+		inst(InstructionType_LOAD, cnst(REGISTER_R2), cnst(locked), cnst(0)),
+		inst(InstructionType_ADD, cnst(REGISTER_R2), reg(REGISTER_R2), cnst(1)),
+		inst(InstructionType_STORE, reg(REGISTER_R2), cnst(locked), cnst(0)),
+		// 8: release
+		inst(InstructionType_STORELB, cnst(0), cnst(lock), cnst(0)),
+		inst(InstructionType_SUB, cnst(REGISTER_R5), reg(REGISTER_R5), cnst(1)),
+		inst(InstructionType_JNE, reg(REGISTER_R5), cnst(1*InstructionBytecodeSize)),
+	}
+	prog = append(prog, exitInst(0)...)
+
+	for name, newMemory := range map[string]func() VMMemory{
+		"Blocks": func() VMMemory { return NewMemoryWithConfig(MemoryConfig{StackSize: PAGE_SIZE}) },
+		"Paged":  func() VMMemory { return NewPagedMemoryWithConfig(MemoryConfig{StackSize: PAGE_SIZE}) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			r, _ := NewSharedRegion("counters", PAGE_SIZE)
+			var wg sync.WaitGroup
+			errs := make([]error, vms)
+			for i := 0; i < vms; i++ {
+				m := newMemory()
+				vm := &VM{Memory: m}
+				vm.SetProgram(assemble(prog...))
+				if err := m.(VMMemoryMapper).MapShared(r, address, PermRW); err != nil {
+					t.Fatal(err)
+				}
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					_, errs[i] = vm.Run()
+				}(i)
+			}
+			wg.Wait()
+			for _, err := range errs {
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			buf := make([]byte, 24)
+			r.ReadAt(0, buf)
+			if got := binary.LittleEndian.Uint64(buf[8:]); got != vms*iterations {
+				t.Errorf("XADD counter = %d, want %d", got, vms*iterations)
+			}
+			if got := binary.LittleEndian.Uint64(buf[16:]); got != vms*iterations {
+				t.Errorf("locked counter = %d, want %d", got, vms*iterations)
+			}
+		})
+	}
+}
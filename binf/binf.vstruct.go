@@ -47,6 +47,76 @@ func (e EncodingType) Match(
 	}
 }
 
+type MemoryKind uint8
+
+const (
+	MemoryKind_BLOCKS MemoryKind = 0
+	MemoryKind_PAGED  MemoryKind = 1
+)
+
+func (e MemoryKind) String() string {
+	switch e {
+	case MemoryKind_BLOCKS:
+		return "BLOCKS"
+	case MemoryKind_PAGED:
+		return "PAGED"
+	}
+	return ""
+}
+
+func (e MemoryKind) Match(
+	onBLOCKS func(),
+	onPAGED func(),
+) {
+	switch e {
+	case MemoryKind_BLOCKS:
+		onBLOCKS()
+	case MemoryKind_PAGED:
+		onPAGED()
+	}
+}
+
+type RegionKind uint8
+
+const (
+	RegionKind_PROGRAM RegionKind = 0
+	RegionKind_HEAP    RegionKind = 1
+	RegionKind_STACK   RegionKind = 2
+	RegionKind_PAGE    RegionKind = 3
+)
+
+func (e RegionKind) String() string {
+	switch e {
+	case RegionKind_PROGRAM:
+		return "PROGRAM"
+	case RegionKind_HEAP:
+		return "HEAP"
+	case RegionKind_STACK:
+		return "STACK"
+	case RegionKind_PAGE:
+		return "PAGE"
+	}
+	return ""
+}
+
+func (e RegionKind) Match(
+	onPROGRAM func(),
+	onHEAP func(),
+	onSTACK func(),
+	onPAGE func(),
+) {
+	switch e {
+	case RegionKind_PROGRAM:
+		onPROGRAM()
+	case RegionKind_HEAP:
+		onHEAP()
+	case RegionKind_STACK:
+		onSTACK()
+	case RegionKind_PAGE:
+		onPAGE()
+	}
+}
+
 type Header []byte
 
 func (s Header) Version() uint8 {
@@ -98,8 +168,8 @@ func (s Program) Header() Header {
 }
 
 func (s Program) Code() []byte {
-	_ = s[17]
-	var __off0 uint64 = 18
+	_ = s[25]
+	var __off0 uint64 = 26
 	var __off1 uint64 = uint64(s[10]) |
 		uint64(s[11])<<8 |
 		uint64(s[12])<<16 |
@@ -111,14 +181,35 @@ func (s Program) Code() []byte {
 	return []byte(s[__off0:__off1])
 }
 
+func (s Program) Data() []byte {
+	_ = s[25]
+	var __off0 uint64 = uint64(s[10]) |
+		uint64(s[11])<<8 |
+		uint64(s[12])<<16 |
+		uint64(s[13])<<24 |
+		uint64(s[14])<<32 |
+		uint64(s[15])<<40 |
+		uint64(s[16])<<48 |
+		uint64(s[17])<<56
+	var __off1 uint64 = uint64(s[18]) |
+		uint64(s[19])<<8 |
+		uint64(s[20])<<16 |
+		uint64(s[21])<<24 |
+		uint64(s[22])<<32 |
+		uint64(s[23])<<40 |
+		uint64(s[24])<<48 |
+		uint64(s[25])<<56
+	return []byte(s[__off0:__off1])
+}
+
 func (s Program) Vstruct_Validate() bool {
-	if len(s) < 18 {
+	if len(s) < 26 {
 		return false
 	}
 
-	_ = s[17]
+	_ = s[25]
 
-	var __off0 uint64 = 18
+	var __off0 uint64 = 26
 	var __off1 uint64 = uint64(s[10]) |
 		uint64(s[11])<<8 |
 		uint64(s[12])<<16 |
@@ -127,8 +218,16 @@ func (s Program) Vstruct_Validate() bool {
 		uint64(s[15])<<40 |
 		uint64(s[16])<<48 |
 		uint64(s[17])<<56
-	var __off2 uint64 = uint64(len(s))
-	return __off0 <= __off1 && __off1 <= __off2
+	var __off2 uint64 = uint64(s[18]) |
+		uint64(s[19])<<8 |
+		uint64(s[20])<<16 |
+		uint64(s[21])<<24 |
+		uint64(s[22])<<32 |
+		uint64(s[23])<<40 |
+		uint64(s[24])<<48 |
+		uint64(s[25])<<56
+	var __off3 uint64 = uint64(len(s))
+	return __off0 <= __off1 && __off1 <= __off2 && __off2 <= __off3
 }
 
 func (s Program) String() string {
@@ -145,6 +244,558 @@ func (s Program) String() string {
 	__b.WriteString(", ")
 	__b.WriteString("Code: ")
 	__b.WriteString(fmt.Sprint(s.Code()))
+	__b.WriteString(", ")
+	__b.WriteString("Data: ")
+	__b.WriteString(fmt.Sprint(s.Data()))
+	__b.WriteString("}")
+	return __b.String()
+}
+
+type CheckpointHeader []byte
+
+func (s CheckpointHeader) Magic() uint64 {
+	_ = s[7]
+	var __v uint64 = uint64(s[0]) |
+		uint64(s[1])<<8 |
+		uint64(s[2])<<16 |
+		uint64(s[3])<<24 |
+		uint64(s[4])<<32 |
+		uint64(s[5])<<40 |
+		uint64(s[6])<<48 |
+		uint64(s[7])<<56
+	return uint64(__v)
+}
+
+func (s CheckpointHeader) Version() uint8 {
+	_ = s[8]
+	var __v uint8 = uint8(s[8])
+	return uint8(__v)
+}
+
+func (s CheckpointHeader) Memory() MemoryKind {
+	return MemoryKind(s[9])
+}
+
+func (s CheckpointHeader) StackSize() uint64 {
+	_ = s[17]
+	var __v uint64 = uint64(s[10]) |
+		uint64(s[11])<<8 |
+		uint64(s[12])<<16 |
+		uint64(s[13])<<24 |
+		uint64(s[14])<<32 |
+		uint64(s[15])<<40 |
+		uint64(s[16])<<48 |
+		uint64(s[17])<<56
+	return uint64(__v)
+}
+
+func (s CheckpointHeader) MaxHeapBytes() uint64 {
+	_ = s[25]
+	var __v uint64 = uint64(s[18]) |
+		uint64(s[19])<<8 |
+		uint64(s[20])<<16 |
+		uint64(s[21])<<24 |
+		uint64(s[22])<<32 |
+		uint64(s[23])<<40 |
+		uint64(s[24])<<48 |
+		uint64(s[25])<<56
+	return uint64(__v)
+}
+
+func (s CheckpointHeader) MaxBlocks() uint64 {
+	_ = s[33]
+	var __v uint64 = uint64(s[26]) |
+		uint64(s[27])<<8 |
+		uint64(s[28])<<16 |
+		uint64(s[29])<<24 |
+		uint64(s[30])<<32 |
+		uint64(s[31])<<40 |
+		uint64(s[32])<<48 |
+		uint64(s[33])<<56
+	return uint64(__v)
+}
+
+func (s CheckpointHeader) MaxAllocation() uint64 {
+	_ = s[41]
+	var __v uint64 = uint64(s[34]) |
+		uint64(s[35])<<8 |
+		uint64(s[36])<<16 |
+		uint64(s[37])<<24 |
+		uint64(s[38])<<32 |
+		uint64(s[39])<<40 |
+		uint64(s[40])<<48 |
+		uint64(s[41])<<56
+	return uint64(__v)
+}
+
+func (s CheckpointHeader) MemoryHead() uint64 {
+	_ = s[49]
+	var __v uint64 = uint64(s[42]) |
+		uint64(s[43])<<8 |
+		uint64(s[44])<<16 |
+		uint64(s[45])<<24 |
+		uint64(s[46])<<32 |
+		uint64(s[47])<<40 |
+		uint64(s[48])<<48 |
+		uint64(s[49])<<56
+	return uint64(__v)
+}
+
+func (s CheckpointHeader) FileCounter() uint64 {
+	_ = s[57]
+	var __v uint64 = uint64(s[50]) |
+		uint64(s[51])<<8 |
+		uint64(s[52])<<16 |
+		uint64(s[53])<<24 |
+		uint64(s[54])<<32 |
+		uint64(s[55])<<40 |
+		uint64(s[56])<<48 |
+		uint64(s[57])<<56
+	return uint64(__v)
+}
+
+func (s CheckpointHeader) TrapHandler() uint64 {
+	_ = s[65]
+	var __v uint64 = uint64(s[58]) |
+		uint64(s[59])<<8 |
+		uint64(s[60])<<16 |
+		uint64(s[61])<<24 |
+		uint64(s[62])<<32 |
+		uint64(s[63])<<40 |
+		uint64(s[64])<<48 |
+		uint64(s[65])<<56
+	return uint64(__v)
+}
+
+func (s CheckpointHeader) CallDepth() uint64 {
+	_ = s[73]
+	var __v uint64 = uint64(s[66]) |
+		uint64(s[67])<<8 |
+		uint64(s[68])<<16 |
+		uint64(s[69])<<24 |
+		uint64(s[70])<<32 |
+		uint64(s[71])<<40 |
+		uint64(s[72])<<48 |
+		uint64(s[73])<<56
+	return uint64(__v)
+}
+
+func (s CheckpointHeader) InstructionCount() uint64 {
+	_ = s[81]
+	var __v uint64 = uint64(s[74]) |
+		uint64(s[75])<<8 |
+		uint64(s[76])<<16 |
+		uint64(s[77])<<24 |
+		uint64(s[78])<<32 |
+		uint64(s[79])<<40 |
+		uint64(s[80])<<48 |
+		uint64(s[81])<<56
+	return uint64(__v)
+}
+
+func (s CheckpointHeader) Vstruct_Validate() bool {
+	return len(s) >= 82
+}
+
+func (s CheckpointHeader) String() string {
+	if !s.Vstruct_Validate() {
+		return "CheckpointHeader (invalid)"
+	}
+	var __b strings.Builder
+	__b.WriteString("CheckpointHeader {")
+	__b.WriteString("Magic: ")
+	__b.WriteString(strconv.FormatUint(uint64(s.Magic()), 10))
+	__b.WriteString(", ")
+	__b.WriteString("Version: ")
+	__b.WriteString(strconv.FormatUint(uint64(s.Version()), 10))
+	__b.WriteString(", ")
+	__b.WriteString("Memory: ")
+	__b.WriteString(s.Memory().String())
+	__b.WriteString(", ")
+	__b.WriteString("StackSize: ")
+	__b.WriteString(strconv.FormatUint(uint64(s.StackSize()), 10))
+	__b.WriteString(", ")
+	__b.WriteString("MaxHeapBytes: ")
+	__b.WriteString(strconv.FormatUint(uint64(s.MaxHeapBytes()), 10))
+	__b.WriteString(", ")
+	__b.WriteString("MaxBlocks: ")
+	__b.WriteString(strconv.FormatUint(uint64(s.MaxBlocks()), 10))
+	__b.WriteString(", ")
+	__b.WriteString("MaxAllocation: ")
+	__b.WriteString(strconv.FormatUint(uint64(s.MaxAllocation()), 10))
+	__b.WriteString(", ")
+	__b.WriteString("MemoryHead: ")
+	__b.WriteString(strconv.FormatUint(uint64(s.MemoryHead()), 10))
+	__b.WriteString(", ")
+	__b.WriteString("FileCounter: ")
+	__b.WriteString(strconv.FormatUint(uint64(s.FileCounter()), 10))
+	__b.WriteString(", ")
+	__b.WriteString("TrapHandler: ")
+	__b.WriteString(strconv.FormatUint(uint64(s.TrapHandler()), 10))
+	__b.WriteString(", ")
+	__b.WriteString("CallDepth: ")
+	__b.WriteString(strconv.FormatUint(uint64(s.CallDepth()), 10))
+	__b.WriteString(", ")
+	__b.WriteString("InstructionCount: ")
+	__b.WriteString(strconv.FormatUint(uint64(s.InstructionCount()), 10))
+	__b.WriteString("}")
+	return __b.String()
+}
+
+type Checkpoint []byte
+
+func (s Checkpoint) Header() CheckpointHeader {
+	return CheckpointHeader(s[0:82])
+}
+
+func (s Checkpoint) Registers() []byte {
+	_ = s[113]
+	var __off0 uint64 = 114
+	var __off1 uint64 = uint64(s[82]) |
+		uint64(s[83])<<8 |
+		uint64(s[84])<<16 |
+		uint64(s[85])<<24 |
+		uint64(s[86])<<32 |
+		uint64(s[87])<<40 |
+		uint64(s[88])<<48 |
+		uint64(s[89])<<56
+	return []byte(s[__off0:__off1])
+}
+
+func (s Checkpoint) Regions() []byte {
+	_ = s[113]
+	var __off0 uint64 = uint64(s[82]) |
+		uint64(s[83])<<8 |
+		uint64(s[84])<<16 |
+		uint64(s[85])<<24 |
+		uint64(s[86])<<32 |
+		uint64(s[87])<<40 |
+		uint64(s[88])<<48 |
+		uint64(s[89])<<56
+	var __off1 uint64 = uint64(s[90]) |
+		uint64(s[91])<<8 |
+		uint64(s[92])<<16 |
+		uint64(s[93])<<24 |
+		uint64(s[94])<<32 |
+		uint64(s[95])<<40 |
+		uint64(s[96])<<48 |
+		uint64(s[97])<<56
+	return []byte(s[__off0:__off1])
+}
+
+func (s Checkpoint) FreeList() []byte {
+	_ = s[113]
+	var __off0 uint64 = uint64(s[90]) |
+		uint64(s[91])<<8 |
+		uint64(s[92])<<16 |
+		uint64(s[93])<<24 |
+		uint64(s[94])<<32 |
+		uint64(s[95])<<40 |
+		uint64(s[96])<<48 |
+		uint64(s[97])<<56
+	var __off1 uint64 = uint64(s[98]) |
+		uint64(s[99])<<8 |
+		uint64(s[100])<<16 |
+		uint64(s[101])<<24 |
+		uint64(s[102])<<32 |
+		uint64(s[103])<<40 |
+		uint64(s[104])<<48 |
+		uint64(s[105])<<56
+	return []byte(s[__off0:__off1])
+}
+
+func (s Checkpoint) Files() []byte {
+	_ = s[113]
+	var __off0 uint64 = uint64(s[98]) |
+		uint64(s[99])<<8 |
+		uint64(s[100])<<16 |
+		uint64(s[101])<<24 |
+		uint64(s[102])<<32 |
+		uint64(s[103])<<40 |
+		uint64(s[104])<<48 |
+		uint64(s[105])<<56
+	var __off1 uint64 = uint64(s[106]) |
+		uint64(s[107])<<8 |
+		uint64(s[108])<<16 |
+		uint64(s[109])<<24 |
+		uint64(s[110])<<32 |
+		uint64(s[111])<<40 |
+		uint64(s[112])<<48 |
+		uint64(s[113])<<56
+	return []byte(s[__off0:__off1])
+}
+
+func (s Checkpoint) Vstruct_Validate() bool {
+	if len(s) < 114 {
+		return false
+	}
+
+	_ = s[113]
+
+	var __off0 uint64 = 114
+	var __off1 uint64 = uint64(s[82]) |
+		uint64(s[83])<<8 |
+		uint64(s[84])<<16 |
+		uint64(s[85])<<24 |
+		uint64(s[86])<<32 |
+		uint64(s[87])<<40 |
+		uint64(s[88])<<48 |
+		uint64(s[89])<<56
+	var __off2 uint64 = uint64(s[90]) |
+		uint64(s[91])<<8 |
+		uint64(s[92])<<16 |
+		uint64(s[93])<<24 |
+		uint64(s[94])<<32 |
+		uint64(s[95])<<40 |
+		uint64(s[96])<<48 |
+		uint64(s[97])<<56
+	var __off3 uint64 = uint64(s[98]) |
+		uint64(s[99])<<8 |
+		uint64(s[100])<<16 |
+		uint64(s[101])<<24 |
+		uint64(s[102])<<32 |
+		uint64(s[103])<<40 |
+		uint64(s[104])<<48 |
+		uint64(s[105])<<56
+	var __off4 uint64 = uint64(s[106]) |
+		uint64(s[107])<<8 |
+		uint64(s[108])<<16 |
+		uint64(s[109])<<24 |
+		uint64(s[110])<<32 |
+		uint64(s[111])<<40 |
+		uint64(s[112])<<48 |
+		uint64(s[113])<<56
+	var __off5 uint64 = uint64(len(s))
+	return __off0 <= __off1 && __off1 <= __off2 && __off2 <= __off3 && __off3 <= __off4 && __off4 <= __off5
+}
+
+func (s Checkpoint) String() string {
+	if !s.Vstruct_Validate() {
+		return "Checkpoint (invalid)"
+	}
+	var __b strings.Builder
+	__b.WriteString("Checkpoint {")
+	__b.WriteString("Header: ")
+	__b.WriteString(s.Header().String())
+	__b.WriteString(", ")
+	__b.WriteString("Registers: ")
+	__b.WriteString(fmt.Sprint(s.Registers()))
+	__b.WriteString(", ")
+	__b.WriteString("Regions: ")
+	__b.WriteString(fmt.Sprint(s.Regions()))
+	__b.WriteString(", ")
+	__b.WriteString("FreeList: ")
+	__b.WriteString(fmt.Sprint(s.FreeList()))
+	__b.WriteString(", ")
+	__b.WriteString("Files: ")
+	__b.WriteString(fmt.Sprint(s.Files()))
+	__b.WriteString("}")
+	return __b.String()
+}
+
+type Region []byte
+
+func (s Region) Start() uint64 {
+	_ = s[7]
+	var __v uint64 = uint64(s[0]) |
+		uint64(s[1])<<8 |
+		uint64(s[2])<<16 |
+		uint64(s[3])<<24 |
+		uint64(s[4])<<32 |
+		uint64(s[5])<<40 |
+		uint64(s[6])<<48 |
+		uint64(s[7])<<56
+	return uint64(__v)
+}
+
+func (s Region) End() uint64 {
+	_ = s[15]
+	var __v uint64 = uint64(s[8]) |
+		uint64(s[9])<<8 |
+		uint64(s[10])<<16 |
+		uint64(s[11])<<24 |
+		uint64(s[12])<<32 |
+		uint64(s[13])<<40 |
+		uint64(s[14])<<48 |
+		uint64(s[15])<<56
+	return uint64(__v)
+}
+
+func (s Region) Perm() uint8 {
+	_ = s[16]
+	var __v uint8 = uint8(s[16])
+	return uint8(__v)
+}
+
+func (s Region) Kind() RegionKind {
+	return RegionKind(s[17])
+}
+
+func (s Region) Data() []byte {
+	_ = s[25]
+	var __off0 uint64 = 26
+	var __off1 uint64 = uint64(s[18]) |
+		uint64(s[19])<<8 |
+		uint64(s[20])<<16 |
+		uint64(s[21])<<24 |
+		uint64(s[22])<<32 |
+		uint64(s[23])<<40 |
+		uint64(s[24])<<48 |
+		uint64(s[25])<<56
+	return []byte(s[__off0:__off1])
+}
+
+func (s Region) Vstruct_Validate() bool {
+	if len(s) < 26 {
+		return false
+	}
+
+	_ = s[25]
+
+	var __off0 uint64 = 26
+	var __off1 uint64 = uint64(s[18]) |
+		uint64(s[19])<<8 |
+		uint64(s[20])<<16 |
+		uint64(s[21])<<24 |
+		uint64(s[22])<<32 |
+		uint64(s[23])<<40 |
+		uint64(s[24])<<48 |
+		uint64(s[25])<<56
+	var __off2 uint64 = uint64(len(s))
+	return __off0 <= __off1 && __off1 <= __off2
+}
+
+func (s Region) String() string {
+	if !s.Vstruct_Validate() {
+		return "Region (invalid)"
+	}
+	var __b strings.Builder
+	__b.WriteString("Region {")
+	__b.WriteString("Start: ")
+	__b.WriteString(strconv.FormatUint(uint64(s.Start()), 10))
+	__b.WriteString(", ")
+	__b.WriteString("End: ")
+	__b.WriteString(strconv.FormatUint(uint64(s.End()), 10))
+	__b.WriteString(", ")
+	__b.WriteString("Perm: ")
+	__b.WriteString(strconv.FormatUint(uint64(s.Perm()), 10))
+	__b.WriteString(", ")
+	__b.WriteString("Kind: ")
+	__b.WriteString(s.Kind().String())
+	__b.WriteString(", ")
+	__b.WriteString("Data: ")
+	__b.WriteString(fmt.Sprint(s.Data()))
+	__b.WriteString("}")
+	return __b.String()
+}
+
+type FreeRange []byte
+
+func (s FreeRange) Start() uint64 {
+	_ = s[7]
+	var __v uint64 = uint64(s[0]) |
+		uint64(s[1])<<8 |
+		uint64(s[2])<<16 |
+		uint64(s[3])<<24 |
+		uint64(s[4])<<32 |
+		uint64(s[5])<<40 |
+		uint64(s[6])<<48 |
+		uint64(s[7])<<56
+	return uint64(__v)
+}
+
+func (s FreeRange) Size() uint64 {
+	_ = s[15]
+	var __v uint64 = uint64(s[8]) |
+		uint64(s[9])<<8 |
+		uint64(s[10])<<16 |
+		uint64(s[11])<<24 |
+		uint64(s[12])<<32 |
+		uint64(s[13])<<40 |
+		uint64(s[14])<<48 |
+		uint64(s[15])<<56
+	return uint64(__v)
+}
+
+func (s FreeRange) Vstruct_Validate() bool {
+	return len(s) >= 16
+}
+
+func (s FreeRange) String() string {
+	if !s.Vstruct_Validate() {
+		return "FreeRange (invalid)"
+	}
+	var __b strings.Builder
+	__b.WriteString("FreeRange {")
+	__b.WriteString("Start: ")
+	__b.WriteString(strconv.FormatUint(uint64(s.Start()), 10))
+	__b.WriteString(", ")
+	__b.WriteString("Size: ")
+	__b.WriteString(strconv.FormatUint(uint64(s.Size()), 10))
+	__b.WriteString("}")
+	return __b.String()
+}
+
+type FileDescriptor []byte
+
+func (s FileDescriptor) FD() uint64 {
+	_ = s[7]
+	var __v uint64 = uint64(s[0]) |
+		uint64(s[1])<<8 |
+		uint64(s[2])<<16 |
+		uint64(s[3])<<24 |
+		uint64(s[4])<<32 |
+		uint64(s[5])<<40 |
+		uint64(s[6])<<48 |
+		uint64(s[7])<<56
+	return uint64(__v)
+}
+
+func (s FileDescriptor) Name() []byte {
+	_ = s[15]
+	var __off0 uint64 = 16
+	var __off1 uint64 = uint64(s[8]) |
+		uint64(s[9])<<8 |
+		uint64(s[10])<<16 |
+		uint64(s[11])<<24 |
+		uint64(s[12])<<32 |
+		uint64(s[13])<<40 |
+		uint64(s[14])<<48 |
+		uint64(s[15])<<56
+	return []byte(s[__off0:__off1])
+}
+
+func (s FileDescriptor) Vstruct_Validate() bool {
+	if len(s) < 16 {
+		return false
+	}
+
+	_ = s[15]
+
+	var __off0 uint64 = 16
+	var __off1 uint64 = uint64(s[8]) |
+		uint64(s[9])<<8 |
+		uint64(s[10])<<16 |
+		uint64(s[11])<<24 |
+		uint64(s[12])<<32 |
+		uint64(s[13])<<40 |
+		uint64(s[14])<<48 |
+		uint64(s[15])<<56
+	var __off2 uint64 = uint64(len(s))
+	return __off0 <= __off1 && __off1 <= __off2
+}
+
+func (s FileDescriptor) String() string {
+	if !s.Vstruct_Validate() {
+		return "FileDescriptor (invalid)"
+	}
+	var __b strings.Builder
+	__b.WriteString("FileDescriptor {")
+	__b.WriteString("FD: ")
+	__b.WriteString(strconv.FormatUint(uint64(s.FD()), 10))
+	__b.WriteString(", ")
+	__b.WriteString("Name: ")
+	__b.WriteString(fmt.Sprint(s.Name()))
 	__b.WriteString("}")
 	return __b.String()
 }
@@ -171,12 +822,12 @@ func New_Header(Version uint8, EntryPoint uint64) Header {
 	return __vstruct__buf
 }
 
-func Serialize_Program(dst Program, Encoding EncodingType, Header Header, Code []byte) Program {
-	_ = dst[17]
+func Serialize_Program(dst Program, Encoding EncodingType, Header Header, Code []byte, Data []byte) Program {
+	_ = dst[25]
 	dst[0] = byte(Encoding)
 	copy(dst[1:10], Header)
 
-	var __index = uint64(18)
+	var __index = uint64(26)
 	__tmp_2 := uint64(len(Code)) + __index
 	dst[10] = byte(__tmp_2)
 	dst[11] = byte(__tmp_2 >> 8)
@@ -187,12 +838,279 @@ func Serialize_Program(dst Program, Encoding EncodingType, Header Header, Code [
 	dst[16] = byte(__tmp_2 >> 48)
 	dst[17] = byte(__tmp_2 >> 56)
 	copy(dst[__index:__tmp_2], Code)
+	__index += uint64(len(Code))
+	__tmp_3 := uint64(len(Data)) + __index
+	dst[18] = byte(__tmp_3)
+	dst[19] = byte(__tmp_3 >> 8)
+	dst[20] = byte(__tmp_3 >> 16)
+	dst[21] = byte(__tmp_3 >> 24)
+	dst[22] = byte(__tmp_3 >> 32)
+	dst[23] = byte(__tmp_3 >> 40)
+	dst[24] = byte(__tmp_3 >> 48)
+	dst[25] = byte(__tmp_3 >> 56)
+	copy(dst[__index:__tmp_3], Data)
 	return dst
 }
 
-func New_Program(Encoding EncodingType, Header Header, Code []byte) Program {
-	var __vstruct__size = 18 + len(Code)
+func New_Program(Encoding EncodingType, Header Header, Code []byte, Data []byte) Program {
+	var __vstruct__size = 26 + len(Code) + len(Data)
 	var __vstruct__buf = make(Program, __vstruct__size)
-	__vstruct__buf = Serialize_Program(__vstruct__buf, Encoding, Header, Code)
+	__vstruct__buf = Serialize_Program(__vstruct__buf, Encoding, Header, Code, Data)
+	return __vstruct__buf
+}
+
+func Serialize_CheckpointHeader(dst CheckpointHeader, Magic uint64, Version uint8, Memory MemoryKind, StackSize uint64, MaxHeapBytes uint64, MaxBlocks uint64, MaxAllocation uint64, MemoryHead uint64, FileCounter uint64, TrapHandler uint64, CallDepth uint64, InstructionCount uint64) CheckpointHeader {
+	_ = dst[81]
+	dst[0] = byte(Magic)
+	dst[1] = byte(Magic >> 8)
+	dst[2] = byte(Magic >> 16)
+	dst[3] = byte(Magic >> 24)
+	dst[4] = byte(Magic >> 32)
+	dst[5] = byte(Magic >> 40)
+	dst[6] = byte(Magic >> 48)
+	dst[7] = byte(Magic >> 56)
+	dst[8] = byte(Version)
+	dst[9] = byte(Memory)
+	dst[10] = byte(StackSize)
+	dst[11] = byte(StackSize >> 8)
+	dst[12] = byte(StackSize >> 16)
+	dst[13] = byte(StackSize >> 24)
+	dst[14] = byte(StackSize >> 32)
+	dst[15] = byte(StackSize >> 40)
+	dst[16] = byte(StackSize >> 48)
+	dst[17] = byte(StackSize >> 56)
+	dst[18] = byte(MaxHeapBytes)
+	dst[19] = byte(MaxHeapBytes >> 8)
+	dst[20] = byte(MaxHeapBytes >> 16)
+	dst[21] = byte(MaxHeapBytes >> 24)
+	dst[22] = byte(MaxHeapBytes >> 32)
+	dst[23] = byte(MaxHeapBytes >> 40)
+	dst[24] = byte(MaxHeapBytes >> 48)
+	dst[25] = byte(MaxHeapBytes >> 56)
+	dst[26] = byte(MaxBlocks)
+	dst[27] = byte(MaxBlocks >> 8)
+	dst[28] = byte(MaxBlocks >> 16)
+	dst[29] = byte(MaxBlocks >> 24)
+	dst[30] = byte(MaxBlocks >> 32)
+	dst[31] = byte(MaxBlocks >> 40)
+	dst[32] = byte(MaxBlocks >> 48)
+	dst[33] = byte(MaxBlocks >> 56)
+	dst[34] = byte(MaxAllocation)
+	dst[35] = byte(MaxAllocation >> 8)
+	dst[36] = byte(MaxAllocation >> 16)
+	dst[37] = byte(MaxAllocation >> 24)
+	dst[38] = byte(MaxAllocation >> 32)
+	dst[39] = byte(MaxAllocation >> 40)
+	dst[40] = byte(MaxAllocation >> 48)
+	dst[41] = byte(MaxAllocation >> 56)
+	dst[42] = byte(MemoryHead)
+	dst[43] = byte(MemoryHead >> 8)
+	dst[44] = byte(MemoryHead >> 16)
+	dst[45] = byte(MemoryHead >> 24)
+	dst[46] = byte(MemoryHead >> 32)
+	dst[47] = byte(MemoryHead >> 40)
+	dst[48] = byte(MemoryHead >> 48)
+	dst[49] = byte(MemoryHead >> 56)
+	dst[50] = byte(FileCounter)
+	dst[51] = byte(FileCounter >> 8)
+	dst[52] = byte(FileCounter >> 16)
+	dst[53] = byte(FileCounter >> 24)
+	dst[54] = byte(FileCounter >> 32)
+	dst[55] = byte(FileCounter >> 40)
+	dst[56] = byte(FileCounter >> 48)
+	dst[57] = byte(FileCounter >> 56)
+	dst[58] = byte(TrapHandler)
+	dst[59] = byte(TrapHandler >> 8)
+	dst[60] = byte(TrapHandler >> 16)
+	dst[61] = byte(TrapHandler >> 24)
+	dst[62] = byte(TrapHandler >> 32)
+	dst[63] = byte(TrapHandler >> 40)
+	dst[64] = byte(TrapHandler >> 48)
+	dst[65] = byte(TrapHandler >> 56)
+	dst[66] = byte(CallDepth)
+	dst[67] = byte(CallDepth >> 8)
+	dst[68] = byte(CallDepth >> 16)
+	dst[69] = byte(CallDepth >> 24)
+	dst[70] = byte(CallDepth >> 32)
+	dst[71] = byte(CallDepth >> 40)
+	dst[72] = byte(CallDepth >> 48)
+	dst[73] = byte(CallDepth >> 56)
+	dst[74] = byte(InstructionCount)
+	dst[75] = byte(InstructionCount >> 8)
+	dst[76] = byte(InstructionCount >> 16)
+	dst[77] = byte(InstructionCount >> 24)
+	dst[78] = byte(InstructionCount >> 32)
+	dst[79] = byte(InstructionCount >> 40)
+	dst[80] = byte(InstructionCount >> 48)
+	dst[81] = byte(InstructionCount >> 56)
+
+	return dst
+}
+
+func New_CheckpointHeader(Magic uint64, Version uint8, Memory MemoryKind, StackSize uint64, MaxHeapBytes uint64, MaxBlocks uint64, MaxAllocation uint64, MemoryHead uint64, FileCounter uint64, TrapHandler uint64, CallDepth uint64, InstructionCount uint64) CheckpointHeader {
+	var __vstruct__size = 82
+	var __vstruct__buf = make(CheckpointHeader, __vstruct__size)
+	__vstruct__buf = Serialize_CheckpointHeader(__vstruct__buf, Magic, Version, Memory, StackSize, MaxHeapBytes, MaxBlocks, MaxAllocation, MemoryHead, FileCounter, TrapHandler, CallDepth, InstructionCount)
+	return __vstruct__buf
+}
+
+func Serialize_Checkpoint(dst Checkpoint, Header CheckpointHeader, Registers []byte, Regions []byte, FreeList []byte, Files []byte) Checkpoint {
+	_ = dst[113]
+	copy(dst[0:82], Header)
+
+	var __index = uint64(114)
+	__tmp_1 := uint64(len(Registers)) + __index
+	dst[82] = byte(__tmp_1)
+	dst[83] = byte(__tmp_1 >> 8)
+	dst[84] = byte(__tmp_1 >> 16)
+	dst[85] = byte(__tmp_1 >> 24)
+	dst[86] = byte(__tmp_1 >> 32)
+	dst[87] = byte(__tmp_1 >> 40)
+	dst[88] = byte(__tmp_1 >> 48)
+	dst[89] = byte(__tmp_1 >> 56)
+	copy(dst[__index:__tmp_1], Registers)
+	__index += uint64(len(Registers))
+	__tmp_2 := uint64(len(Regions)) + __index
+	dst[90] = byte(__tmp_2)
+	dst[91] = byte(__tmp_2 >> 8)
+	dst[92] = byte(__tmp_2 >> 16)
+	dst[93] = byte(__tmp_2 >> 24)
+	dst[94] = byte(__tmp_2 >> 32)
+	dst[95] = byte(__tmp_2 >> 40)
+	dst[96] = byte(__tmp_2 >> 48)
+	dst[97] = byte(__tmp_2 >> 56)
+	copy(dst[__index:__tmp_2], Regions)
+	__index += uint64(len(Regions))
+	__tmp_3 := uint64(len(FreeList)) + __index
+	dst[98] = byte(__tmp_3)
+	dst[99] = byte(__tmp_3 >> 8)
+	dst[100] = byte(__tmp_3 >> 16)
+	dst[101] = byte(__tmp_3 >> 24)
+	dst[102] = byte(__tmp_3 >> 32)
+	dst[103] = byte(__tmp_3 >> 40)
+	dst[104] = byte(__tmp_3 >> 48)
+	dst[105] = byte(__tmp_3 >> 56)
+	copy(dst[__index:__tmp_3], FreeList)
+	__index += uint64(len(FreeList))
+	__tmp_4 := uint64(len(Files)) + __index
+	dst[106] = byte(__tmp_4)
+	dst[107] = byte(__tmp_4 >> 8)
+	dst[108] = byte(__tmp_4 >> 16)
+	dst[109] = byte(__tmp_4 >> 24)
+	dst[110] = byte(__tmp_4 >> 32)
+	dst[111] = byte(__tmp_4 >> 40)
+	dst[112] = byte(__tmp_4 >> 48)
+	dst[113] = byte(__tmp_4 >> 56)
+	copy(dst[__index:__tmp_4], Files)
+	return dst
+}
+
+func New_Checkpoint(Header CheckpointHeader, Registers []byte, Regions []byte, FreeList []byte, Files []byte) Checkpoint {
+	var __vstruct__size = 114 + len(Registers) + len(Regions) + len(FreeList) + len(Files)
+	var __vstruct__buf = make(Checkpoint, __vstruct__size)
+	__vstruct__buf = Serialize_Checkpoint(__vstruct__buf, Header, Registers, Regions, FreeList, Files)
+	return __vstruct__buf
+}
+
+func Serialize_Region(dst Region, Start uint64, End uint64, Perm uint8, Kind RegionKind, Data []byte) Region {
+	_ = dst[25]
+	dst[0] = byte(Start)
+	dst[1] = byte(Start >> 8)
+	dst[2] = byte(Start >> 16)
+	dst[3] = byte(Start >> 24)
+	dst[4] = byte(Start >> 32)
+	dst[5] = byte(Start >> 40)
+	dst[6] = byte(Start >> 48)
+	dst[7] = byte(Start >> 56)
+	dst[8] = byte(End)
+	dst[9] = byte(End >> 8)
+	dst[10] = byte(End >> 16)
+	dst[11] = byte(End >> 24)
+	dst[12] = byte(End >> 32)
+	dst[13] = byte(End >> 40)
+	dst[14] = byte(End >> 48)
+	dst[15] = byte(End >> 56)
+	dst[16] = byte(Perm)
+	dst[17] = byte(Kind)
+
+	var __index = uint64(26)
+	__tmp_4 := uint64(len(Data)) + __index
+	dst[18] = byte(__tmp_4)
+	dst[19] = byte(__tmp_4 >> 8)
+	dst[20] = byte(__tmp_4 >> 16)
+	dst[21] = byte(__tmp_4 >> 24)
+	dst[22] = byte(__tmp_4 >> 32)
+	dst[23] = byte(__tmp_4 >> 40)
+	dst[24] = byte(__tmp_4 >> 48)
+	dst[25] = byte(__tmp_4 >> 56)
+	copy(dst[__index:__tmp_4], Data)
+	return dst
+}
+
+func New_Region(Start uint64, End uint64, Perm uint8, Kind RegionKind, Data []byte) Region {
+	var __vstruct__size = 26 + len(Data)
+	var __vstruct__buf = make(Region, __vstruct__size)
+	__vstruct__buf = Serialize_Region(__vstruct__buf, Start, End, Perm, Kind, Data)
+	return __vstruct__buf
+}
+
+func Serialize_FreeRange(dst FreeRange, Start uint64, Size uint64) FreeRange {
+	_ = dst[15]
+	dst[0] = byte(Start)
+	dst[1] = byte(Start >> 8)
+	dst[2] = byte(Start >> 16)
+	dst[3] = byte(Start >> 24)
+	dst[4] = byte(Start >> 32)
+	dst[5] = byte(Start >> 40)
+	dst[6] = byte(Start >> 48)
+	dst[7] = byte(Start >> 56)
+	dst[8] = byte(Size)
+	dst[9] = byte(Size >> 8)
+	dst[10] = byte(Size >> 16)
+	dst[11] = byte(Size >> 24)
+	dst[12] = byte(Size >> 32)
+	dst[13] = byte(Size >> 40)
+	dst[14] = byte(Size >> 48)
+	dst[15] = byte(Size >> 56)
+
+	return dst
+}
+
+func New_FreeRange(Start uint64, Size uint64) FreeRange {
+	var __vstruct__size = 16
+	var __vstruct__buf = make(FreeRange, __vstruct__size)
+	__vstruct__buf = Serialize_FreeRange(__vstruct__buf, Start, Size)
+	return __vstruct__buf
+}
+
+func Serialize_FileDescriptor(dst FileDescriptor, FD uint64, Name []byte) FileDescriptor {
+	_ = dst[15]
+	dst[0] = byte(FD)
+	dst[1] = byte(FD >> 8)
+	dst[2] = byte(FD >> 16)
+	dst[3] = byte(FD >> 24)
+	dst[4] = byte(FD >> 32)
+	dst[5] = byte(FD >> 40)
+	dst[6] = byte(FD >> 48)
+	dst[7] = byte(FD >> 56)
+
+	var __index = uint64(16)
+	__tmp_1 := uint64(len(Name)) + __index
+	dst[8] = byte(__tmp_1)
+	dst[9] = byte(__tmp_1 >> 8)
+	dst[10] = byte(__tmp_1 >> 16)
+	dst[11] = byte(__tmp_1 >> 24)
+	dst[12] = byte(__tmp_1 >> 32)
+	dst[13] = byte(__tmp_1 >> 40)
+	dst[14] = byte(__tmp_1 >> 48)
+	dst[15] = byte(__tmp_1 >> 56)
+	copy(dst[__index:__tmp_1], Name)
+	return dst
+}
+
+func New_FileDescriptor(FD uint64, Name []byte) FileDescriptor {
+	var __vstruct__size = 16 + len(Name)
+	var __vstruct__buf = make(FileDescriptor, __vstruct__size)
+	__vstruct__buf = Serialize_FileDescriptor(__vstruct__buf, FD, Name)
 	return __vstruct__buf
 }
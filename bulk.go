@@ -0,0 +1,105 @@
+package lvm2
+
+import "bytes"
+
+// BULK_CHUNK_SIZE is the number of bytes MEMCPY and MEMCMP buffer at a time.
+const BULK_CHUNK_SIZE = PAGE_SIZE
+
+// checkRange faults unless all of [address, address+size) is mapped with perm.
+func checkRange(m VMMemory, address, size uint64, perm Perm) error {
+	if address+size < address {
+		return &Fault{Kind: FaultSegmentation, Address: address}
+	}
+	return m.GetMemoryFunc(address, size, perm, func(uint64, []byte) error { return nil })
+}
+
+// readRange reads len(p) bytes at address.
+func readRange(m VMMemory, address uint64, p []byte) error {
+	return m.GetMemoryFunc(address, uint64(len(p)), PermRead, func(_ uint64, b []byte) error {
+		p = p[copy(p, b):]
+		return nil
+	})
+}
+
+// Memmove copies size bytes from src to dst. The ranges may overlap.
+// Both are checked first, so a fault leaves the memory unchanged.
+func Memmove(m VMMemory, dst, src, size uint64) error {
+	if err := checkRange(m, src, size, PermRead); err != nil {
+		return err
+	}
+	if err := checkRange(m, dst, size, PermWrite); err != nil {
+		return err
+	}
+
+	// Copy backwards when dst overlaps the end of src.
+	backward := dst > src && dst-src < size
+	var buffer [BULK_CHUNK_SIZE]byte
+	for done := uint64(0); done < size; {
+		n := size - done
+		if n > BULK_CHUNK_SIZE {
+			n = BULK_CHUNK_SIZE
+		}
+		offset := done
+		if backward {
+			offset = size - done - n
+		}
+
+		chunk := buffer[:n]
+		if err := readRange(m, src+offset, chunk); err != nil {
+			return err
+		}
+		err := m.GetMemoryFunc(dst+offset, n, PermWrite, func(_ uint64, b []byte) error {
+			chunk = chunk[copy(b, chunk):]
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		done += n
+	}
+	return nil
+}
+
+// Memset sets size bytes at dst to c.
+// The range is checked first, so a fault leaves the memory unchanged.
+func Memset(m VMMemory, dst uint64, c byte, size uint64) error {
+	if err := checkRange(m, dst, size, PermWrite); err != nil {
+		return err
+	}
+	return m.GetMemoryFunc(dst, size, PermWrite, func(_ uint64, b []byte) error {
+		for i := range b {
+			b[i] = c
+		}
+		return nil
+	})
+}
+
+// Memcmp compares size bytes at a and b like bytes.Compare.
+// Both ranges must be readable even if they differ early.
+func Memcmp(m VMMemory, a, b, size uint64) (int, error) {
+	if err := checkRange(m, a, size, PermRead); err != nil {
+		return 0, err
+	}
+	if err := checkRange(m, b, size, PermRead); err != nil {
+		return 0, err
+	}
+
+	var bufferA, bufferB [BULK_CHUNK_SIZE]byte
+	for done := uint64(0); done < size; {
+		n := size - done
+		if n > BULK_CHUNK_SIZE {
+			n = BULK_CHUNK_SIZE
+		}
+		if err := readRange(m, a+done, bufferA[:n]); err != nil {
+			return 0, err
+		}
+		if err := readRange(m, b+done, bufferB[:n]); err != nil {
+			return 0, err
+		}
+		if c := bytes.Compare(bufferA[:n], bufferB[:n]); c != 0 {
+			return c, nil
+		}
+		done += n
+	}
+	return 0, nil
+}
@@ -0,0 +1,173 @@
+package lvm2
+
+import (
+	"bytes"
+	"testing"
+)
+
+// testMemories returns fresh memories of both backends with size bytes
+// allocated and filled with 0, 1, 2, ...
+func testMemories(size uint64) map[string]func() (VMMemory, uint64) {
+	fill := func(m VMMemory) (VMMemory, uint64) {
+		a, _ := m.Allocate(size)
+		b := make([]byte, size)
+		for i := range b {
+			b[i] = byte(i)
+		}
+		m.WriteAt(a, b)
+		return m, a
+	}
+	return map[string]func() (VMMemory, uint64){
+		"Blocks": func() (VMMemory, uint64) { return fill(NewMemoryWithConfig(MemoryConfig{StackSize: PAGE_SIZE})) },
+		"Paged":  func() (VMMemory, uint64) { return fill(NewPagedMemoryWithConfig(MemoryConfig{StackSize: PAGE_SIZE})) },
+	}
+}
+
+func TestMemmove(t *testing.T) {
+	const size = 3 * BULK_CHUNK_SIZE
+	tests := []struct {
+		name          string
+		dst, src, len uint64
+	}{
+		{"Disjoint", 2 * BULK_CHUNK_SIZE, 0, BULK_CHUNK_SIZE},
+		{"Forward", 0, 100, 2*BULK_CHUNK_SIZE + 7},
+		{"Backward", 100, 0, 2*BULK_CHUNK_SIZE + 7},
+		{"Same", 5, 5, 10},
+		{"Empty", 0, 1, 0},
+	}
+	for name, newMemory := range testMemories(size) {
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				m, a := newMemory()
+				want := make([]byte, size)
+				m.ReadAt(a, want)
+				copy(want[tt.dst:tt.dst+tt.len], want[tt.src:tt.src+tt.len])
+
+				if err := Memmove(m, a+tt.dst, a+tt.src, tt.len); err != nil {
+					t.Fatal(err)
+				}
+				got := make([]byte, size)
+				m.ReadAt(a, got)
+				if !bytes.Equal(got, want) {
+					t.Fatal("memory differs from copy()")
+				}
+			})
+		}
+	}
+}
+
+func TestMemmove_Fault(t *testing.T) {
+	m := newTestMemory()
+	before := make([]byte, 20)
+	m.ReadAt(0, before)
+
+	// [16, 24) runs into the gap at [20, 32).
+	err := Memmove(m, 0, 16, 8)
+	if addr, ok := segfaultAt(err); !ok || addr != 20 {
+		t.Fatalf("err = %v, want segfault at 20", err)
+	}
+	err = Memset(m, 12, 0xFF, 10)
+	if addr, ok := segfaultAt(err); !ok || addr != 20 {
+		t.Fatalf("err = %v, want segfault at 20", err)
+	}
+	if _, err := Memcmp(m, 0, ^uint64(0)-4, 8); err == nil {
+		t.Fatal("wrapping range: err = nil")
+	}
+
+	// Nothing was written before the fault.
+	after := make([]byte, 20)
+	m.ReadAt(0, after)
+	if !bytes.Equal(before, after) {
+		t.Fatalf("memory changed: %v", after)
+	}
+
+	// Copies across adjacent blocks are fine.
+	if err := Memmove(m, 5, 12, 8); err != nil {
+		t.Fatal(err)
+	}
+	m.ReadAt(0, after)
+	if !bytes.Equal(after[5:13], before[12:20]) {
+		t.Fatalf("memory = %v", after)
+	}
+}
+
+func TestInstruction_Bulk(t *testing.T) {
+	mem := []byte{1, 2, 3, 4, 1, 2, 3, 5}
+	tests := []struct {
+		name       string
+		a, b, size uint64
+		want       uint64
+	}{
+		{"equal", memAddr, memAddr + 4, 3, 0},
+		{"less", memAddr, memAddr + 4, 4, i64(-1)},
+		{"greater", memAddr + 4, memAddr, 4, 1},
+		{"empty", 0, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run("MEMCMP/"+tt.name, func(t *testing.T) {
+			code := inst(InstructionType_MEMCMP, cnst(REGISTER_R0), reg(REGISTER_R1), reg(REGISTER_R2))
+			vm := newTestVM()
+			vm.SetProgram(append(assemble(code), mem...))
+			vm.Registers[REGISTER_R0] = tt.size
+			vm.Registers[REGISTER_R1], vm.Registers[REGISTER_R2] = tt.a, tt.b
+			if _, err := vm.Step(); err != nil {
+				t.Fatal(err)
+			}
+			if got := vm.Registers[REGISTER_R0]; got != tt.want {
+				t.Errorf("R0 = %#x, want %#x", got, tt.want)
+			}
+		})
+	}
+
+	// MEMCPY and MEMSET on the heap.
+	prog := []testInstruction{
+		inst(InstructionType_MOV, cnst(REGISTER_SYS32), cnst(64)),
+		inst(InstructionType_SYSCALL, cnst(REGISTER_R0), cnst(SYS_ALLOCATE), cnst(0)),
+		inst(InstructionType_MOV, cnst(REGISTER_R1), reg(REGISTER_SYS33)),
+		inst(InstructionType_ADD, cnst(REGISTER_R2), reg(REGISTER_R1), cnst(32)),
+		inst(InstructionType_MEMSET, reg(REGISTER_R1), cnst(0x1AB), cnst(32)),
+		inst(InstructionType_MEMCPY, reg(REGISTER_R2), reg(REGISTER_R1), cnst(16)),
+		inst(InstructionType_MOV, cnst(REGISTER_SYS32), cnst(16)),
+		inst(InstructionType_MEMCMP, cnst(REGISTER_SYS32), reg(REGISTER_R1), reg(REGISTER_R2)),
+		inst(InstructionType_SYSCALL, cnst(REGISTER_R0), cnst(SYS_EXIT), cnst(0)),
+	}
+	vm := newTestVM(prog...)
+	if code, err := vm.Run(); err != nil || code != 0 {
+		t.Fatalf("Run() = %d, %v", code, err)
+	}
+	got := make([]byte, 48)
+	vm.Memory.ReadAt(vm.Registers[REGISTER_R1], got)
+	if !bytes.Equal(got, bytes.Repeat([]byte{0xAB}, 48)) {
+		t.Fatalf("memory = %x", got)
+	}
+}
+
+func TestInstruction_BulkBudget(t *testing.T) {
+	// MEMSET of 4 chunks costs 5 instructions.
+	prog := append([]testInstruction{
+		inst(InstructionType_MOV, cnst(REGISTER_SYS32), cnst(4*BULK_CHUNK_SIZE)),
+		inst(InstructionType_SYSCALL, cnst(REGISTER_R0), cnst(SYS_ALLOCATE), cnst(0)),
+		inst(InstructionType_MEMSET, reg(REGISTER_SYS33), cnst(1), cnst(4*BULK_CHUNK_SIZE)),
+	}, exitInst(0)...)
+	vm := newTestVM(prog...)
+	vm.InstructionLimit = 6
+	if _, err := vm.Run(); err != ErrBudgetExhausted {
+		t.Fatalf("Run() err = %v, want %v", err, ErrBudgetExhausted)
+	}
+	if vm.Registers[REGISTER_PC] != at(2) || vm.InstructionCount != 2 {
+		t.Fatalf("PC = %#x, count = %d, want MEMSET not executed", vm.Registers[REGISTER_PC], vm.InstructionCount)
+	}
+	b := make([]byte, 1)
+	vm.Memory.ReadAt(vm.Registers[REGISTER_SYS33], b)
+	if b[0] != 0 {
+		t.Fatal("memory written before the budget check")
+	}
+
+	vm.InstructionLimit = 7
+	if _, err := vm.Run(); err != ErrBudgetExhausted {
+		t.Fatalf("Run() err = %v, want %v", err, ErrBudgetExhausted)
+	}
+	if vm.Registers[REGISTER_PC] != at(3) || vm.InstructionCount != 7 {
+		t.Fatalf("PC = %#x, count = %d after MEMSET", vm.Registers[REGISTER_PC], vm.InstructionCount)
+	}
+}
@@ -0,0 +1,497 @@
+package lvm2
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+	"sync/atomic"
+
+	"github.com/lemon-mint/lvm2/binf"
+)
+
+// CHECKPOINT_MAGIC is "LVM2CKPT" in little-endian byte order.
+const CHECKPOINT_MAGIC = 0x54504B43324D564C
+
+// CHECKPOINT_VERSION is the checkpoint format version written by
+// WriteCheckpoint. ReadCheckpoint refuses other versions.
+const CHECKPOINT_VERSION = 1
+
+// MAX_CHECKPOINT_STACK_SIZE is the largest stack ReadCheckpoint accepts.
+const MAX_CHECKPOINT_STACK_SIZE = 1 << 30 // 1GB
+
+var (
+	ErrCheckpointNotSupported = errors.New("Checkpoint Not Supported")
+	ErrInvalidCheckpoint      = errors.New("Invalid Checkpoint")
+	ErrCheckpointVersion      = errors.New("Incompatible Checkpoint Version")
+)
+
+// MemoryRegion is a mapped range of a memory in a checkpoint.
+type MemoryRegion struct {
+	Kind  binf.RegionKind
+	Start uint64
+	End   uint64
+	Perm  Perm
+
+	// Contents from Start, the rest of the region is zero
+	Data []byte
+
+	// Size of the unmapped guard below a HEAP region allocated with
+	// AllocateStack. The checkpoint format does not store guards.
+	Guard uint64
+}
+
+// MemoryState is the contents and allocator metadata of a memory.
+type MemoryState struct {
+	Config     MemoryConfig
+	MemoryHead uint64
+	FreeList   FreeList
+	Regions    []MemoryRegion
+}
+
+// VMMemoryCheckpointer is implemented by memories supporting
+// VM.WriteCheckpoint.
+type VMMemoryCheckpointer interface {
+	MemoryKind() binf.MemoryKind
+	State() MemoryState
+}
+
+var (
+	_ VMMemoryCheckpointer = (*Memory)(nil)
+	_ VMMemoryCheckpointer = (*PagedMemory)(nil)
+)
+
+func (m *Memory) MemoryKind() binf.MemoryKind {
+	return binf.MemoryKind_BLOCKS
+}
+
+// State returns the state of m. Regions share their Data with m.
+// Leading zero bytes of the stack are omitted.
+func (m *Memory) State() MemoryState {
+	s := MemoryState{
+		Config:     m.Config,
+		MemoryHead: m.MemoryHead,
+		FreeList:   append(FreeList(nil), m.FreeList...),
+	}
+	for i := range m.Blocks {
+		b := &m.Blocks[i]
+		kind := binf.RegionKind_PROGRAM
+		if b.Heap {
+			kind = binf.RegionKind_HEAP
+		}
+		s.Regions = append(s.Regions, MemoryRegion{
+			Kind:  kind,
+			Start: b.Start,
+			End:   b.End,
+			Perm:  b.Perm,
+			Data:  b.slice(b.Start),
+			Guard: b.Guard,
+		})
+	}
+
+	stack := m.Stack.Block
+	i := 0
+	for i < len(stack) && stack[i] == 0 {
+		i++
+	}
+	s.Regions = append(s.Regions, MemoryRegion{
+		Kind:  binf.RegionKind_STACK,
+		Start: m.Stack.Start + uint64(i),
+		End:   m.Stack.End,
+		Perm:  m.Stack.Perm,
+		Data:  stack[i:],
+	})
+	return s
+}
+
+// NewMemoryFromState returns a Memory with the state s.
+func NewMemoryFromState(s MemoryState) (*Memory, error) {
+	m := NewMemoryWithConfig(s.Config)
+	for _, r := range s.Regions {
+		if r.End < r.Start || uint64(len(r.Data)) > r.End-r.Start {
+			return nil, ErrInvalidCheckpoint
+		}
+		if r.Guard != 0 && (r.Kind != binf.RegionKind_HEAP || r.Guard > r.Start) {
+			return nil, ErrInvalidCheckpoint
+		}
+		switch r.Kind {
+		case binf.RegionKind_PROGRAM, binf.RegionKind_HEAP:
+			// Blocks are stored in full.
+			if r.End > m.StackGuard() || uint64(len(r.Data)) != r.End-r.Start {
+				return nil, ErrInvalidCheckpoint
+			}
+			block := MemoryBlock{
+				Start: r.Start,
+				End:   r.End,
+				Block: make([]byte, r.End-r.Start),
+				Perm:  r.Perm,
+				Heap:  r.Kind == binf.RegionKind_HEAP,
+				Guard: r.Guard,
+			}
+			copy(block.Block, r.Data)
+			m.insertBlock(block)
+			if block.Heap {
+				m.HeapBytes += r.End - r.Start
+				m.HeapBlocks++
+			}
+		case binf.RegionKind_STACK:
+			if r.Start < m.Stack.Start || r.End != m.Stack.End {
+				return nil, ErrInvalidCheckpoint
+			}
+			copy(m.Stack.Block[r.Start-m.Stack.Start:], r.Data)
+			m.Stack.Perm = r.Perm
+		default:
+			return nil, ErrInvalidCheckpoint
+		}
+	}
+	for i := 1; i < len(m.Blocks); i++ {
+		if m.Blocks[i].Start-m.Blocks[i].Guard < m.Blocks[i-1].End {
+			return nil, ErrInvalidCheckpoint
+		}
+	}
+
+	m.MemoryHead = s.MemoryHead
+	m.FreeList = append(m.FreeList[:0], s.FreeList...)
+	return m, nil
+}
+
+func (m *PagedMemory) MemoryKind() binf.MemoryKind {
+	return binf.MemoryKind_PAGED
+}
+
+// State returns the state of m. Regions share their Data with m.
+// Trailing zero bytes of pages are omitted.
+func (m *PagedMemory) State() MemoryState {
+	s := MemoryState{
+		Config:     m.Config,
+		MemoryHead: m.MemoryHead,
+		FreeList:   append(FreeList(nil), m.FreeList...),
+	}
+	if m.ProgramBytes != 0 {
+		s.Regions = append(s.Regions, MemoryRegion{
+			Kind: binf.RegionKind_PROGRAM,
+			End:  m.ProgramBytes,
+		})
+	}
+
+	numbers := make([]uint64, 0, len(m.Pages))
+	for n := range m.Pages {
+		numbers = append(numbers, n)
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+	for _, n := range numbers {
+		p := m.Pages[n]
+		var data []byte
+		if p.Data != nil {
+			data = p.Data[:]
+			for len(data) > 0 && data[len(data)-1] == 0 {
+				data = data[:len(data)-1]
+			}
+		}
+		s.Regions = append(s.Regions, MemoryRegion{
+			Kind:  binf.RegionKind_PAGE,
+			Start: n * PAGE_SIZE,
+			End:   n*PAGE_SIZE + PAGE_SIZE,
+			Perm:  p.Perm,
+			Data:  data,
+		})
+	}
+
+	for _, a := range m.starts {
+		s.Regions = append(s.Regions, MemoryRegion{
+			Kind:  binf.RegionKind_HEAP,
+			Start: a,
+			End:   a + m.Allocations[a],
+			Guard: m.guards[a],
+		})
+	}
+	return s
+}
+
+// NewPagedMemoryFromState returns a PagedMemory with the state s.
+func NewPagedMemoryFromState(s MemoryState) (*PagedMemory, error) {
+	m := NewPagedMemoryWithConfig(s.Config)
+	for _, r := range s.Regions {
+		if r.End < r.Start || uint64(len(r.Data)) > r.End-r.Start {
+			return nil, ErrInvalidCheckpoint
+		}
+		if r.Guard != 0 && (r.Kind != binf.RegionKind_HEAP || r.Guard > r.Start) {
+			return nil, ErrInvalidCheckpoint
+		}
+		switch r.Kind {
+		case binf.RegionKind_PROGRAM:
+			m.ProgramBytes = r.End
+		case binf.RegionKind_PAGE:
+			if r.Start%PAGE_SIZE != 0 || r.End-r.Start != PAGE_SIZE {
+				return nil, ErrInvalidCheckpoint
+			}
+			if r.End > m.StackGuard() && (r.Start < m.StackStart || r.End > m.StackEnd) {
+				return nil, ErrInvalidCheckpoint
+			}
+			p := &Page{Perm: r.Perm}
+			if len(r.Data) > 0 {
+				copy(p.writable()[:], r.Data)
+			}
+			m.Pages[r.Start/PAGE_SIZE] = p
+		case binf.RegionKind_HEAP:
+		default:
+			return nil, ErrInvalidCheckpoint
+		}
+	}
+
+	for _, r := range s.Regions {
+		if r.Kind != binf.RegionKind_HEAP {
+			continue
+		}
+		if r.End == r.Start || r.End > m.StackGuard() {
+			return nil, ErrInvalidCheckpoint
+		}
+		if _, ok := m.Allocations[r.Start]; ok {
+			return nil, ErrInvalidCheckpoint
+		}
+		m.Allocations[r.Start] = r.End - r.Start
+		m.starts = append(m.starts, r.Start)
+		if r.Guard != 0 {
+			if m.guards == nil {
+				m.guards = make(map[uint64]uint64)
+			}
+			m.guards[r.Start] = r.Guard
+		}
+		m.HeapBytes += r.End - r.Start
+		m.HeapBlocks++
+	}
+	sort.Slice(m.starts, func(i, j int) bool { return m.starts[i] < m.starts[j] })
+	for i := 1; i < len(m.starts); i++ {
+		if prev := m.starts[i-1]; prev+m.Allocations[prev] > m.starts[i]-m.guards[m.starts[i]] {
+			return nil, ErrInvalidCheckpoint
+		}
+	}
+
+	m.MemoryHead = s.MemoryHead
+	m.FreeList = append(m.FreeList[:0], s.FreeList...)
+	return m, nil
+}
+
+// appendRecord appends rec prefixed by its uint64 size.
+func appendRecord(b []byte, rec []byte) []byte {
+	var size [8]byte
+	binary.LittleEndian.PutUint64(size[:], uint64(len(rec)))
+	b = append(b, size[:]...)
+	return append(b, rec...)
+}
+
+// records splits b into size-prefixed records.
+func records(b []byte) ([][]byte, error) {
+	var recs [][]byte
+	for len(b) > 0 {
+		if len(b) < 8 {
+			return nil, ErrInvalidCheckpoint
+		}
+		size := binary.LittleEndian.Uint64(b)
+		b = b[8:]
+		if size > uint64(len(b)) {
+			return nil, ErrInvalidCheckpoint
+		}
+		recs = append(recs, b[:size])
+		b = b[size:]
+	}
+	return recs, nil
+}
+
+// WriteCheckpoint writes the state of v to w: registers, memory regions
+// with their permissions, allocator metadata and a description of the
+// open file descriptors. v must not be running.
+func (v *VM) WriteCheckpoint(w io.Writer) error {
+	if v.multithreaded() {
+		return ErrThreadsNotSupported
+	}
+	cp, ok := v.Memory.(VMMemoryCheckpointer)
+	if !ok {
+		return ErrCheckpointNotSupported
+	}
+	if sm, ok := v.Memory.(VMMemoryMapper); ok && len(sm.SharedMappings()) > 0 {
+		// Shared regions belong to the host, not to v.
+		return ErrCheckpointNotSupported
+	}
+	if v.fibers != nil && len(v.fibers.Fibers) > 1 {
+		// Suspended fibers are not part of the format.
+		return ErrCheckpointNotSupported
+	}
+	if v.InterruptTable != 0 || v.InterruptsDisabled {
+		// Neither is the interrupt state.
+		return ErrCheckpointNotSupported
+	}
+	s := cp.State()
+	for _, r := range s.Regions {
+		if r.Guard != 0 {
+			// The format has no stack guards either.
+			return ErrCheckpointNotSupported
+		}
+	}
+
+	header := binf.New_CheckpointHeader(
+		CHECKPOINT_MAGIC, CHECKPOINT_VERSION, cp.MemoryKind(),
+		s.Config.StackSize, s.Config.MaxHeapBytes, uint64(s.Config.MaxBlocks), s.Config.MaxAllocation,
+		s.MemoryHead,
+		v.FileCounter, v.TrapHandler, v.CallDepth, v.InstructionCount,
+	)
+
+	registers := make([]byte, len(v.Registers)*WORD_SIZE)
+	for i, r := range v.Registers {
+		binary.LittleEndian.PutUint64(registers[i*WORD_SIZE:], r)
+	}
+
+	var regions []byte
+	for _, r := range s.Regions {
+		regions = appendRecord(regions, binf.New_Region(r.Start, r.End, uint8(r.Perm), r.Kind, r.Data))
+	}
+
+	var freeList []byte
+	for _, r := range s.FreeList {
+		freeList = append(freeList, binf.New_FreeRange(r.Start, r.Size)...)
+	}
+
+	fds := make([]uint64, 0, len(v.Files))
+	for fd := range v.Files {
+		fds = append(fds, fd)
+	}
+	sort.Slice(fds, func(i, j int) bool { return fds[i] < fds[j] })
+	var files []byte
+	for _, fd := range fds {
+		var name string
+		if f, ok := v.Files[fd].(interface{ Name() string }); ok {
+			name = f.Name()
+		}
+		files = appendRecord(files, binf.New_FileDescriptor(fd, []byte(name)))
+	}
+
+	_, err := w.Write(binf.New_Checkpoint(header, registers, regions, freeList, files))
+	return err
+}
+
+// ReadCheckpoint sets the state of v to a checkpoint written by
+// WriteCheckpoint, replacing v.Memory with a memory of the checkpointed kind.
+//
+// open is called to reopen each file descriptor recorded in the checkpoint,
+// with the file name if the file had one. If open is nil, v has no files.
+// Like Restore, it drops the fibers, threads, interrupt state, timers and
+// pending IRQs of v, none of which a checkpoint holds.
+// v is unchanged on error.
+func (v *VM) ReadCheckpoint(r io.Reader, open func(fd uint64, name string) (VMFile, error)) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	c := binf.Checkpoint(b)
+	if !c.Vstruct_Validate() {
+		return ErrInvalidCheckpoint
+	}
+	header := c.Header()
+	if header.Magic() != CHECKPOINT_MAGIC {
+		return ErrInvalidCheckpoint
+	}
+	if header.Version() != CHECKPOINT_VERSION {
+		return ErrCheckpointVersion
+	}
+
+	s := MemoryState{
+		Config: MemoryConfig{
+			StackSize:     header.StackSize(),
+			MaxHeapBytes:  header.MaxHeapBytes(),
+			MaxBlocks:     int(header.MaxBlocks()),
+			MaxAllocation: header.MaxAllocation(),
+		},
+		MemoryHead: header.MemoryHead(),
+	}
+	if s.Config.StackSize > MAX_CHECKPOINT_STACK_SIZE {
+		return ErrInvalidCheckpoint
+	}
+
+	regions, err := records(c.Regions())
+	if err != nil {
+		return err
+	}
+	for _, rec := range regions {
+		r := binf.Region(rec)
+		if !r.Vstruct_Validate() || Perm(r.Perm())&^PermRWX != 0 {
+			return ErrInvalidCheckpoint
+		}
+		s.Regions = append(s.Regions, MemoryRegion{
+			Kind:  r.Kind(),
+			Start: r.Start(),
+			End:   r.End(),
+			Perm:  Perm(r.Perm()),
+			Data:  r.Data(),
+		})
+	}
+
+	freeList := c.FreeList()
+	if len(freeList)%16 != 0 {
+		return ErrInvalidCheckpoint
+	}
+	for ; len(freeList) > 0; freeList = freeList[16:] {
+		r := binf.FreeRange(freeList[:16])
+		s.FreeList = append(s.FreeList, FreeRange{Start: r.Start(), Size: r.Size()})
+	}
+
+	var memory VMMemory
+	switch header.Memory() {
+	case binf.MemoryKind_BLOCKS:
+		memory, err = NewMemoryFromState(s)
+	case binf.MemoryKind_PAGED:
+		memory, err = NewPagedMemoryFromState(s)
+	default:
+		err = ErrInvalidCheckpoint
+	}
+	if err != nil {
+		return err
+	}
+
+	registers := c.Registers()
+	if len(registers) != len(v.Registers)*WORD_SIZE {
+		return ErrInvalidCheckpoint
+	}
+
+	fds, err := records(c.Files())
+	if err != nil {
+		return err
+	}
+	for _, rec := range fds {
+		if !binf.FileDescriptor(rec).Vstruct_Validate() {
+			return ErrInvalidCheckpoint
+		}
+	}
+	files := make(map[uint64]VMFile, len(fds))
+	for _, rec := range fds {
+		fd := binf.FileDescriptor(rec)
+		if open == nil {
+			continue
+		}
+		f, err := open(fd.FD(), string(fd.Name()))
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return err
+		}
+		files[fd.FD()] = f
+	}
+
+	for i := range v.Registers {
+		v.Registers[i] = binary.LittleEndian.Uint64(registers[i*WORD_SIZE:])
+	}
+	v.Memory = memory
+	v.Files = files
+	v.FileCounter = header.FileCounter()
+	v.TrapHandler = header.TrapHandler()
+	v.CallDepth = header.CallDepth()
+	v.InstructionCount = header.InstructionCount()
+	v.InterruptTable = 0
+	v.InterruptsDisabled = false
+	v.threads = nil
+	v.thread = nil
+	v.fibers = nil
+	v.stopTimers()
+	atomic.StoreUint64(&v.pendingInterrupts, 0)
+	return nil
+}
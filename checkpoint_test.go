@@ -0,0 +1,220 @@
+package lvm2
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lemon-mint/lvm2/binf"
+)
+
+func TestVM_Checkpoint(t *testing.T) {
+	for _, m := range []VMMemory{
+		NewMemoryWithConfig(MemoryConfig{StackSize: PAGE_SIZE, MaxHeapBytes: 1 << 20}),
+		NewPagedMemoryWithConfig(MemoryConfig{StackSize: PAGE_SIZE, MaxHeapBytes: 1 << 20}),
+	} {
+		vm := newSnapshotVM(m)
+		vm.TrapHandler = 0x1234
+		m.Allocate(3 * PAGE_SIZE)
+		freed, _ := m.Allocate(16)
+		m.Free(freed)
+		runSnapshotVM(t, vm)
+
+		var buf bytes.Buffer
+		if err := vm.WriteCheckpoint(&buf); err != nil {
+			t.Fatal(err)
+		}
+
+		restored := &VM{}
+		if err := restored.ReadCheckpoint(bytes.NewReader(buf.Bytes()), nil); err != nil {
+			t.Fatalf("%T: %v", m, err)
+		}
+		if restored.Registers != vm.Registers || restored.TrapHandler != 0x1234 || restored.InstructionCount != vm.InstructionCount {
+			t.Fatalf("%T: registers not restored", m)
+		}
+		if restored.Memory.(VMMemoryCheckpointer).MemoryKind() != m.(VMMemoryCheckpointer).MemoryKind() {
+			t.Fatalf("%T: restored as %T", m, restored.Memory)
+		}
+
+		// Both continue identically.
+		want := runSnapshotVM(t, vm)
+		if code := runSnapshotVM(t, restored); code != want || code != 7 {
+			t.Fatalf("%T: restored exit code = %d, want %d", m, code, want)
+		}
+		if restored.Registers[REGISTER_SP] != vm.Registers[REGISTER_SP] {
+			t.Fatalf("%T: SP = %#x, want %#x", m, restored.Registers[REGISTER_SP], vm.Registers[REGISTER_SP])
+		}
+		var got, wantStack [16]byte
+		restored.Memory.ReadAt(restored.Registers[REGISTER_SP], got[:])
+		vm.Memory.ReadAt(vm.Registers[REGISTER_SP], wantStack[:])
+		if got != wantStack {
+			t.Fatalf("%T: stack = %v, want %v", m, got, wantStack)
+		}
+
+		// Allocator metadata and permissions survive.
+		a, _ := vm.Memory.Allocate(16)
+		b, _ := restored.Memory.Allocate(16)
+		if a != b || a != freed {
+			t.Fatalf("%T: allocations = %d, %d, want %d", m, a, b, freed)
+		}
+		if _, err := restored.Memory.WriteAt(0, []byte{1}); faultKind(err) != FaultProtection {
+			t.Fatalf("%T: write to program: err = %v", m, err)
+		}
+	}
+}
+
+func TestVM_CheckpointFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	vm := newTestVM(exitInst(0)...)
+	vm.Files[3] = f
+	vm.FileCounter = 4
+	var buf bytes.Buffer
+	if err := vm.WriteCheckpoint(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	opened := map[uint64]string{}
+	restored := &VM{}
+	err = restored.ReadCheckpoint(&buf, func(fd uint64, name string) (VMFile, error) {
+		opened[fd] = name
+		return os.Open(name)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Files[3].Close()
+	if len(opened) != 1 || opened[3] != path || restored.FileCounter != 4 {
+		t.Fatalf("opened = %v, file counter = %d", opened, restored.FileCounter)
+	}
+}
+
+func TestVM_CheckpointInvalid(t *testing.T) {
+	for _, m := range []VMMemory{
+		NewMemoryWithConfig(MemoryConfig{StackSize: PAGE_SIZE}),
+		NewPagedMemory(),
+	} {
+		vm := newSnapshotVM(m)
+		runSnapshotVM(t, vm)
+		var buf bytes.Buffer
+		if err := vm.WriteCheckpoint(&buf); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+
+		// Refuse other versions.
+		c := append([]byte(nil), data...)
+		binf.Checkpoint(c).Header()[8] = CHECKPOINT_VERSION + 1
+		restored := &VM{}
+		if err := restored.ReadCheckpoint(bytes.NewReader(c), nil); err != ErrCheckpointVersion {
+			t.Fatalf("%T: err = %v, want ErrCheckpointVersion", m, err)
+		}
+
+		// Truncated checkpoints fail without touching the VM.
+		for i := 0; i < len(data); i += 7 {
+			if err := restored.ReadCheckpoint(bytes.NewReader(data[:i]), nil); err == nil {
+				t.Fatalf("%T: truncated to %d bytes: no error", m, i)
+			}
+		}
+		if restored.Memory != nil {
+			t.Fatalf("%T: failed ReadCheckpoint changed the VM", m)
+		}
+
+		// Corrupted checkpoints load or fail, but never panic.
+		for i := range data {
+			c := append([]byte(nil), data...)
+			c[i] ^= 0xFF
+			restored.ReadCheckpoint(bytes.NewReader(c), nil)
+		}
+	}
+
+	vm := &VM{Memory: &countingMemory{VMMemory: NewMemory()}}
+	if err := vm.WriteCheckpoint(&bytes.Buffer{}); err != ErrCheckpointNotSupported {
+		t.Fatalf("err = %v, want ErrCheckpointNotSupported", err)
+	}
+}
+
+func TestVM_CheckpointResets(t *testing.T) {
+	vm := newSnapshotVM(NewMemory())
+	runSnapshotVM(t, vm)
+	var buf bytes.Buffer
+	if err := vm.WriteCheckpoint(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// The guest starts an hour long timer for IRQ 5 and exits.
+	restored := newTestVM(append([]testInstruction{
+		inst(InstructionType_MOV, cnst(REGISTER_SYS32), cnst(5)),
+		inst(InstructionType_MOV, cnst(REGISTER_SYS33), cnst(uint64(time.Hour/time.Microsecond))),
+		sys(SYS_INTERRUPT_TIMER),
+	}, exitInst(0)...)...)
+	if _, err := restored.Run(); err != nil {
+		t.Fatal(err)
+	}
+	restored.Raise(1)
+	restored.InterruptTable = 0x1000
+	restored.InterruptsDisabled = true
+	restored.fibers = &fiberTable{}
+
+	if err := restored.ReadCheckpoint(bytes.NewReader(buf.Bytes()), nil); err != nil {
+		t.Fatal(err)
+	}
+	if restored.InterruptTable != 0 || restored.InterruptsDisabled || restored.fibers != nil {
+		t.Fatal("interrupt or fiber state survived ReadCheckpoint")
+	}
+	if len(restored.timers) != 0 || restored.PendingInterrupts() != 0 {
+		t.Fatalf("timers = %d, pending %b after ReadCheckpoint", len(restored.timers), restored.PendingInterrupts())
+	}
+	if code := runSnapshotVM(t, restored); code != 7 {
+		t.Fatalf("exit code = %d, want 7", code)
+	}
+}
+
+func TestMemory_StateGuard(t *testing.T) {
+	for _, m := range []VMMemory{
+		NewMemoryWithConfig(MemoryConfig{StackSize: PAGE_SIZE}),
+		NewPagedMemoryWithConfig(MemoryConfig{StackSize: PAGE_SIZE}),
+	} {
+		vm := newSnapshotVM(m)
+		stack, err := m.(VMMemoryStackAllocator).AllocateStack(64)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The state keeps the guard, the checkpoint format cannot.
+		var restored VMMemory
+		switch m := m.(type) {
+		case *Memory:
+			restored, err = NewMemoryFromState(m.State())
+		case *PagedMemory:
+			restored, err = NewPagedMemoryFromState(m.State())
+		}
+		if err != nil {
+			t.Fatalf("%T: %v", m, err)
+		}
+		if _, err := restored.WriteAt(stack-STACK_GUARD_SIZE/2, []byte{1}); faultKind(err) != FaultSegmentation {
+			t.Fatalf("%T: write to the guard: err = %v", m, err)
+		}
+		if err := restored.Free(stack); err != nil {
+			t.Fatalf("%T: Free() = %v", m, err)
+		}
+		if a, err := restored.Allocate(STACK_GUARD_SIZE + 64); err != nil || a != stack-STACK_GUARD_SIZE {
+			t.Fatalf("%T: Allocate() = %#x, %v, want the guard reused", m, a, err)
+		}
+
+		if err := vm.WriteCheckpoint(&bytes.Buffer{}); err != ErrCheckpointNotSupported {
+			t.Fatalf("%T: err = %v, want ErrCheckpointNotSupported", m, err)
+		}
+		m.Free(stack)
+		if err := vm.WriteCheckpoint(&bytes.Buffer{}); err != nil {
+			t.Fatalf("%T: after Free: %v", m, err)
+		}
+	}
+}
@@ -56,8 +56,9 @@ func main() {
 		}
 	}
 
+	memory := lvm2.NewMemory()
 	vm := lvm2.VM{
-		Memory: lvm2.NewMemory(),
+		Memory: memory,
 		Files: map[uint64]lvm2.VMFile{
 			0: os.Stdin,
 			1: os.Stdout,
@@ -65,11 +66,15 @@ func main() {
 		},
 		FileCounter: 3,
 	}
-	vm.Registers[lvm2.REGISTER_SP] = vm.Memory.MaxAddress
-	vm.Registers[lvm2.REGISTER_SB] = vm.Memory.MaxAddress
+	vm.Registers[lvm2.REGISTER_SP] = memory.StackTop()
+	vm.Registers[lvm2.REGISTER_SB] = memory.StackTop()
+
+	if lvm2p.Header().Version() != 0x02 {
+		panic("Unsupported lvm2 file version")
+	}
 
 	if lvm2p.Encoding() == binf.EncodingType_RAW {
-		vm.Memory.SetProgram(lvm2p.Code())
+		vm.SetProgramData(lvm2p.Code(), lvm2p.Data())
 	} else {
 		panic("Unsupported encoding")
 	}
@@ -22,6 +22,16 @@ type Register struct {
 	Name string `parser:"\"%\" @Ident"`
 }
 
+// registerOperand encodes the i-th operand of instruction name, which
+// names register id. The destination of an instruction writing a register
+// (op0) is encoded as the register ID, any other operand reads the register.
+func registerOperand(name string, i int, id uint64) asm.Operand {
+	if i == 0 && lvm2.Instructions[name].WritesRegister() {
+		return asm.OPCONST(id)
+	}
+	return asm.OPREG(id)
+}
+
 type Sign bool
 
 func (b *Sign) Capture(values []string) error {
@@ -32,7 +42,8 @@ func (b *Sign) Capture(values []string) error {
 type Operand struct {
 	Register *Register `parser:"  @@ |"`
 	Sign     Sign      `parser:" @('-' | '+')?"`
-	Int      *int64    `parser:" @Int"`
+	Float    *float64  `parser:" ( @Float"`
+	Int      *int64    `parser:" | @Int )"`
 	String   *string   `parser:"| @String"`
 	Variable *string   `parser:"| \"@\"@Ident"`
 }
@@ -90,13 +101,12 @@ func main() {
 	}
 	defer f.Close()
 
-	parser, err := participle.Build(&File{})
+	parser, err := participle.Build[File]()
 	if err != nil {
 		log.Fatalln("Failed to build parser:", err)
 	}
 
-	var file File
-	err = parser.Parse(flags["__INPUT__"], f, &file)
+	file, err := parser.Parse(flags["__INPUT__"], f)
 	if err != nil {
 		log.Fatalln("Failed to parse input file:", err)
 	}
@@ -104,6 +114,7 @@ func main() {
 	e := asm.NewEncoder()
 
 	var variables = map[string]uint64{}
+	var dataVariables = map[string]bool{}
 
 	//repr.Println(file)
 
@@ -118,20 +129,23 @@ func main() {
 			if operand.Register != nil {
 				//fmt.Printf(" %%%s", operand.Register.Name)
 				if id, ok := lvm2.Registers[operand.Register.Name]; ok {
-					if i > 0 {
-						ops = append(ops, asm.OPREG(id))
-					} else {
-						ops = append(ops, asm.OPCONST(id))
-					}
+					ops = append(ops, registerOperand(instr.Name, i, id))
 				} else {
 					log.Fatalln("Unknown register:", operand.Register.Name)
 				}
 			} else if operand.Int != nil {
+				v := *operand.Int
 				if operand.Sign {
-					*operand.Int = -*operand.Int
+					v = -v
 				}
-				//fmt.Printf(" %d", *operand.Int)
-				ops = append(ops, asm.OPCONST(uint64(*operand.Int)))
+				//fmt.Printf(" %d", v)
+				ops = append(ops, asm.OPCONST(uint64(v)))
+			} else if operand.Float != nil {
+				v := *operand.Float
+				if operand.Sign {
+					v = -v
+				}
+				ops = append(ops, asm.OPFLOAT(v))
 			} else if operand.String != nil {
 				*operand.String, err = strconv.Unquote(*operand.String)
 				if err != nil {
@@ -144,7 +158,7 @@ func main() {
 				}
 			} else if operand.Variable != nil {
 				//fmt.Printf(" @%s", *operand.Variable)
-				if instr.Name == "DATA" || instr.Name == "LABEL" {
+				if instr.Name == "DATA" || instr.Name == "LABEL" || (instr.Name == "TABLE" && i == 0) {
 					continue
 				}
 				offset := variables[*operand.Variable]
@@ -169,6 +183,7 @@ func main() {
 			data := []byte(*instr.Operands[1].String)
 			offset := e.Encode(asm.DATA(data))
 			variables[varName] = offset
+			dataVariables[varName] = true
 		case "LABEL":
 			if len(instr.Operands) != 1 {
 				log.Fatalln("LABEL instruction must have exactly one operand")
@@ -180,6 +195,22 @@ func main() {
 			varName := *instr.Operands[0].Variable
 			offset := e.Encode(asm.LABEL(varName))
 			variables[varName] = offset
+		case "TABLE":
+			if len(instr.Operands) < 1 {
+				log.Fatalln("TABLE instruction must have at least one operand")
+			}
+			if instr.Operands[0].Variable == nil {
+				log.Fatalln("TABLE instruction's first operand must be a variable")
+			}
+			for _, operand := range instr.Operands[1:] {
+				if operand.Variable == nil && operand.Int == nil {
+					log.Fatalln("TABLE instruction's entries must be variables or integers")
+				}
+			}
+
+			varName := *instr.Operands[0].Variable
+			offset := e.Encode(asm.TABLE(ops...))
+			variables[varName] = offset
 		default:
 			opcode, ok := lvm2.Instructions[instr.Name]
 			if !ok {
@@ -192,7 +223,14 @@ func main() {
 		}
 	}
 
+	// Data is mapped after the text, whose size is only known now.
+	dataAddress := lvm2.DataAddress(e.PC)
+	for varName := range dataVariables {
+		variables[varName] += dataAddress
+	}
+
 	e = asm.NewEncoder()
+	e.DataAddress = dataAddress
 
 	//repr.Println(file)
 
@@ -206,23 +244,26 @@ func main() {
 			if operand.Register != nil {
 				//fmt.Printf(" %%%s", operand.Register.Name)
 				if id, ok := lvm2.Registers[operand.Register.Name]; ok {
-					if i > 0 {
-						ops = append(ops, asm.OPREG(id))
-					} else {
-						ops = append(ops, asm.OPCONST(id))
-					}
+					ops = append(ops, registerOperand(instr.Name, i, id))
 				} else {
 					log.Fatalln("Unknown register:", operand.Register.Name)
 				}
 			} else if operand.Int != nil {
+				v := *operand.Int
+				if operand.Sign {
+					v = -v
+				}
+				//fmt.Printf(" %d", v)
+				ops = append(ops, asm.OPCONST(uint64(v)))
+			} else if operand.Float != nil {
+				v := *operand.Float
 				if operand.Sign {
-					*operand.Int = -*operand.Int
+					v = -v
 				}
-				//fmt.Printf(" %d", *operand.Int)
-				ops = append(ops, asm.OPCONST(uint64(*operand.Int)))
+				ops = append(ops, asm.OPFLOAT(v))
 			} else if operand.Variable != nil {
 				//fmt.Printf(" @%s", *operand.Variable)
-				if instr.Name == "DATA" || instr.Name == "LABEL" {
+				if instr.Name == "DATA" || instr.Name == "LABEL" || (instr.Name == "TABLE" && i == 0) {
 					continue
 				}
 				if offset, ok := variables[*operand.Variable]; ok {
@@ -261,6 +302,22 @@ func main() {
 			varName := *instr.Operands[0].Variable
 			offset := e.Encode(asm.LABEL(varName))
 			variables[varName] = offset
+		case "TABLE":
+			if len(instr.Operands) < 1 {
+				log.Fatalln("TABLE instruction must have at least one operand")
+			}
+			if instr.Operands[0].Variable == nil {
+				log.Fatalln("TABLE instruction's first operand must be a variable")
+			}
+			for _, operand := range instr.Operands[1:] {
+				if operand.Variable == nil && operand.Int == nil {
+					log.Fatalln("TABLE instruction's entries must be variables or integers")
+				}
+			}
+
+			varName := *instr.Operands[0].Variable
+			offset := e.Encode(asm.TABLE(ops...))
+			variables[varName] = offset
 		default:
 			opcode, ok := lvm2.Instructions[instr.Name]
 			if !ok {
@@ -288,7 +345,7 @@ func main() {
 	// 	},
 	// 	FileCounter: 3,
 	// }
-	// vm.Memory.SetProgram(e.Bytes())
+	// vm.SetProgramData(e.Bytes(), e.Data)
 
 	// // Set Initial Stack Pointer
 	// vm.Registers[lvm2.REGISTER_SP] = vm.Memory.MaxAddress
@@ -302,7 +359,7 @@ func main() {
 	// }
 	// os.Exit(int(ret))
 
-	prog := binf.New_Program(binf.EncodingType_RAW, binf.New_Header(0x01, entryPoint), e.Bytes())
+	prog := binf.New_Program(binf.EncodingType_RAW, binf.New_Header(0x02, entryPoint), e.Bytes(), e.Data)
 
 	of, err := os.Create(flags["o"])
 	if err != nil {
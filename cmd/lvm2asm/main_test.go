@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lemon-mint/lvm2"
+	"github.com/lemon-mint/lvm2/asm"
+	"github.com/lemon-mint/lvm2/binf"
+)
+
+func TestRegisterOperand(t *testing.T) {
+	tests := []struct {
+		name string
+		i    int
+		want asm.OperandType
+	}{
+		// Destinations are register IDs.
+		{"MOV", 0, asm.OperandType_ConstantValue},
+		{"ADD", 0, asm.OperandType_ConstantValue},
+		{"POP", 0, asm.OperandType_ConstantValue},
+		{"SYSCALL", 0, asm.OperandType_ConstantValue},
+		// Everything else reads the register.
+		{"MOV", 1, asm.OperandType_RegisterValue},
+		{"ADD", 2, asm.OperandType_RegisterValue},
+		{"JMP", 0, asm.OperandType_RegisterValue},
+		{"JE", 0, asm.OperandType_RegisterValue},
+		{"PUSH", 0, asm.OperandType_RegisterValue},
+		{"STORE", 0, asm.OperandType_RegisterValue},
+		{"CALL", 0, asm.OperandType_RegisterValue},
+		{"MEMCMP", 0, asm.OperandType_ConstantValue},
+	}
+	for _, tt := range tests {
+		got := registerOperand(tt.name, tt.i, lvm2.REGISTER_R2)
+		if got.Type != tt.want || got.Value != lvm2.REGISTER_R2 {
+			t.Errorf("registerOperand(%s, %d) = %+v, want type %d", tt.name, tt.i, got, tt.want)
+		}
+	}
+}
+
+func TestDataLabel(t *testing.T) {
+	// @buf is used before it is defined, and its DATA is stored into.
+	const src = `LABEL @ENTRYPOINT
+MOV %R1, @buf
+STOREB 33, %R1, 1
+LOADB %SYS32, %R1, 1
+SYSCALL %R0, 60, 0
+DATA @buf, "abc"
+`
+	dir := t.TempDir()
+	in, out := filepath.Join(dir, "data.lvm2"), filepath.Join(dir, "data.clvm2")
+	if err := os.WriteFile(in, []byte(src), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	args := os.Args
+	defer func() { os.Args = args }()
+	os.Args = []string{"lvm2asm", in, "-o", out}
+	main()
+
+	b, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prog := binf.Program(b)
+	if !prog.Vstruct_Validate() || string(prog.Data()) != "abc" {
+		t.Fatalf("program = %v", prog)
+	}
+
+	memory := lvm2.NewMemory()
+	vm := lvm2.VM{Memory: memory}
+	vm.Registers[lvm2.REGISTER_SP] = memory.StackTop()
+	vm.Registers[lvm2.REGISTER_SB] = memory.StackTop()
+	vm.SetProgramData(prog.Code(), prog.Data())
+	vm.SetProgramCounter(prog.Header().EntryPoint())
+	code, err := vm.Run()
+	if err != nil || code != 33 {
+		t.Fatalf("Run() = %d, %v, want 33", code, err)
+	}
+	if vm.Registers[lvm2.REGISTER_R1] != lvm2.DataAddress(uint64(len(prog.Code()))) {
+		t.Fatalf("@buf = %#x", vm.Registers[lvm2.REGISTER_R1])
+	}
+}
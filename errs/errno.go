@@ -8,6 +8,16 @@ const (
 	EINVALIDFD Errno = iota + 1
 	EFILEWRITE
 	EFILEREAD
+	EINVALIDADDRESS
+	EINVALIDPERM
+	ENOMEM
+	EINVALIDSIZE
+	EINVALIDFREE
+	EDOUBLEFREE
+	ENOSYS
+	EINVALIDTHREAD
+	EINVALIDFIBER
+	EINVALIDIRQ
 )
 
 func (e Errno) Error() string {
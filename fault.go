@@ -0,0 +1,122 @@
+package lvm2
+
+import (
+	"strconv"
+	"strings"
+)
+
+type FaultKind uint8
+
+const (
+	FaultSegmentation FaultKind = iota + 1
+	FaultInvalidOpcode
+	FaultInvalidRegister
+	FaultDivideByZero
+	FaultUnknownSyscall
+	FaultStackOverflow
+	FaultTableIndex
+	FaultProtection
+	FaultStackUnderflow
+	FaultAlignment
+)
+
+func (k FaultKind) String() string {
+	switch k {
+	case FaultSegmentation:
+		return "segmentation fault"
+	case FaultInvalidOpcode:
+		return "invalid opcode"
+	case FaultInvalidRegister:
+		return "invalid register"
+	case FaultDivideByZero:
+		return "divide by zero"
+	case FaultUnknownSyscall:
+		return "unknown syscall"
+	case FaultStackOverflow:
+		return "stack overflow"
+	case FaultTableIndex:
+		return "table index out of range"
+	case FaultProtection:
+		return "protection fault"
+	case FaultStackUnderflow:
+		return "stack underflow"
+	case FaultAlignment:
+		return "misaligned access"
+	}
+	return "unknown fault"
+}
+
+// trappable reports whether faults of this kind can be delivered
+// to the guest trap handler.
+func (k FaultKind) trappable() bool {
+	switch k {
+	case FaultInvalidOpcode, FaultInvalidRegister, FaultDivideByZero, FaultTableIndex:
+		return true
+	}
+	return false
+}
+
+// Fault is the error returned when the guest program faults.
+type Fault struct {
+	Kind FaultKind
+
+	// Program Counter of the faulting instruction
+	PC uint64
+	// Faulting Instruction
+	Instruction Instruction
+
+	// Faulting memory address, register ID (FaultInvalidRegister),
+	// syscall number (FaultUnknownSyscall) or table index (FaultTableIndex)
+	Address uint64
+	// Violated permission (FaultProtection)
+	Access Perm
+
+	// Call Depth at the time of the fault
+	CallDepth uint64
+}
+
+func (f *Fault) Error() string {
+	var sb strings.Builder
+	sb.WriteString(f.Kind.String())
+	sb.WriteString(" at pc 0x")
+	sb.WriteString(strconv.FormatUint(f.PC, 16))
+	switch f.Kind {
+	case FaultSegmentation, FaultAlignment:
+		sb.WriteString(": address 0x")
+		sb.WriteString(strconv.FormatUint(f.Address, 16))
+	case FaultStackOverflow, FaultStackUnderflow:
+		sb.WriteString(": address 0x")
+		sb.WriteString(strconv.FormatUint(f.Address, 16))
+		sb.WriteString(", call depth ")
+		sb.WriteString(strconv.FormatUint(f.CallDepth, 10))
+	case FaultProtection:
+		sb.WriteString(": address 0x")
+		sb.WriteString(strconv.FormatUint(f.Address, 16))
+		sb.WriteString(" not ")
+		sb.WriteString(f.Access.String())
+	case FaultInvalidRegister:
+		sb.WriteString(": register ")
+		sb.WriteString(strconv.FormatUint(f.Address, 10))
+	case FaultUnknownSyscall:
+		sb.WriteString(": syscall ")
+		sb.WriteString(strconv.FormatUint(f.Address, 10))
+	case FaultTableIndex:
+		sb.WriteString(": index ")
+		sb.WriteString(strconv.FormatUint(f.Address, 10))
+	}
+	sb.WriteString(" (")
+	sb.WriteString(f.Instruction.String())
+	sb.WriteString(")")
+	return sb.String()
+}
+
+// Is reports whether the fault matches one of the legacy sentinel errors.
+func (f *Fault) Is(target error) bool {
+	switch target {
+	case ErrSegmentationFault:
+		return f.Kind == FaultSegmentation || f.Kind == FaultStackOverflow || f.Kind == FaultStackUnderflow
+	case ErrInvalidInstruction:
+		return f.Kind == FaultInvalidOpcode
+	}
+	return false
+}
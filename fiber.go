@@ -0,0 +1,223 @@
+package lvm2
+
+import "github.com/lemon-mint/lvm2/errs"
+
+// DEFAULT_FIBER_STACK_SIZE is the stack size of fibers created without one.
+const DEFAULT_FIBER_STACK_SIZE = 16 * 1024 // 16KB
+
+// FiberState is the state of a fiber.
+type FiberState uint8
+
+const (
+	// Created or yielded, waiting for SYS_FIBER_RESUME
+	FiberSuspended FiberState = iota
+	FiberRunning
+	// Waiting for a fiber it resumed to yield
+	FiberResuming
+)
+
+// Values of SYS34 after SYS_FIBER_RESUME returns
+const (
+	FIBER_YIELDED  = 0
+	FIBER_FINISHED = 1
+)
+
+// Fiber is a stackful coroutine of a VM (or of a thread).
+//
+// A fiber has its own registers and stack, and runs only while resumed:
+// SYS_FIBER_RESUME switches to it, SYS_FIBER_YIELD and SYS_FIBER_EXIT
+// switch back to the context that resumed it. The context the VM started
+// in is fiber 0.
+type Fiber struct {
+	ID    uint64
+	State FiberState
+
+	// Saved while the fiber is not running
+	Registers [REGISTER_COUNT]uint64
+	CallDepth uint64
+
+	// Heap allocation holding the stack (0: fiber 0, on the VM's stack)
+	Stack uint64
+
+	// Fiber that resumed this one
+	resumer uint64
+}
+
+// fiberTable holds the fibers of a VM.
+type fiberTable struct {
+	Fibers  map[uint64]*Fiber
+	NextID  uint64
+	Current uint64
+
+	// Fiber to switch to once the running syscall has returned
+	next *Fiber
+}
+
+// fiberTable returns the fibers of v, making the current context fiber 0
+// if needed.
+func (v *VM) fiberTable() *fiberTable {
+	if v.fibers == nil {
+		v.fibers = &fiberTable{
+			Fibers: map[uint64]*Fiber{0: {State: FiberRunning}},
+			NextID: 1,
+		}
+	}
+	return v.fibers
+}
+
+// clone returns a deep copy of t.
+func (t *fiberTable) clone() *fiberTable {
+	if t == nil {
+		return nil
+	}
+	c := &fiberTable{
+		Fibers:  make(map[uint64]*Fiber, len(t.Fibers)),
+		NextID:  t.NextID,
+		Current: t.Current,
+	}
+	for id, f := range t.Fibers {
+		fiber := *f
+		c.Fibers[id] = &fiber
+	}
+	return c
+}
+
+// switchFiber saves the running context and switches to the fiber
+// selected by the last syscall.
+func (v *VM) switchFiber() {
+	t := v.fibers
+	if current, ok := t.Fibers[t.Current]; ok {
+		current.Registers = v.Registers
+		current.CallDepth = v.CallDepth
+	}
+	v.Registers = t.next.Registers
+	v.CallDepth = t.next.CallDepth
+	t.Current = t.next.ID
+	t.next = nil
+}
+
+// suspend switches from the running fiber back to its resumer,
+// which receives value and state in SYS33 and SYS34.
+func (t *fiberTable) suspend(value, state uint64) (*Fiber, bool) {
+	current := t.Fibers[t.Current]
+	resumer, ok := t.Fibers[current.resumer]
+	if t.Current == 0 || !ok {
+		return nil, false
+	}
+	resumer.State = FiberRunning
+	resumer.Registers[REGISTER_SYS33] = value
+	resumer.Registers[REGISTER_SYS34] = state
+	t.next = resumer
+	return current, true
+}
+
+func _syscall_fiber_create(vm *VM, _, _, _ uint64) (errno uint64, err error) {
+	// func FiberCreate(entry uint64, arg uint64, stackSize uint64) (id uint64, errno uint64)
+	// SYS32[in]: entry (the fiber ends with SYS_FIBER_EXIT)
+	// SYS33[in]: arg (R0 of the fiber)
+	// SYS34[in]: stack size (0: DEFAULT_FIBER_STACK_SIZE)
+	// SYS35[out]: fiber ID
+
+	entry := vm.Registers[REGISTER_SYS32]
+	arg := vm.Registers[REGISTER_SYS33]
+	size := vm.Registers[REGISTER_SYS34]
+	if size == 0 {
+		size = DEFAULT_FIBER_STACK_SIZE
+	}
+	vm.Registers[REGISTER_SYS35] = 0
+	if alignUp(size, WORD_SIZE) < size {
+		return errs.EINVALIDSIZE.Errno(), nil
+	}
+	size = alignUp(size, WORD_SIZE)
+
+	stack, err := allocateStack(vm.Memory, size)
+	if err != nil {
+		return allocErrno(err), nil
+	}
+	t := vm.fiberTable()
+	f := &Fiber{ID: t.NextID, State: FiberSuspended, Stack: stack}
+	t.NextID++
+	f.Registers[REGISTER_PC] = entry
+	f.Registers[REGISTER_SP] = stack + size
+	f.Registers[REGISTER_SB] = stack + size
+	f.Registers[REGISTER_R0] = arg
+	t.Fibers[f.ID] = f
+
+	vm.Registers[REGISTER_SYS35] = f.ID
+	return 0, nil
+}
+
+func _syscall_fiber_resume(vm *VM, _, _, _ uint64) (errno uint64, err error) {
+	// func FiberResume(id uint64, value uint64) (value uint64, state uint64, errno uint64)
+	// SYS32[in]: fiber ID (must be suspended)
+	// SYS33[in/out]: value passed to the fiber in its SYS33 / value it yields
+	// SYS34[out]: FIBER_YIELDED or FIBER_FINISHED
+
+	id := vm.Registers[REGISTER_SYS32]
+	value := vm.Registers[REGISTER_SYS33]
+	t := vm.fiberTable()
+	f, ok := t.Fibers[id]
+	if !ok || f.State != FiberSuspended {
+		return errs.EINVALIDFIBER.Errno(), nil
+	}
+
+	t.Fibers[t.Current].State = FiberResuming
+	f.State = FiberRunning
+	f.resumer = t.Current
+	f.Registers[REGISTER_SYS33] = value
+	t.next = f
+	return 0, nil
+}
+
+func _syscall_fiber_yield(vm *VM, _, _, _ uint64) (errno uint64, err error) {
+	// func FiberYield(value uint64) (value uint64, errno uint64)
+	// SYS32[in]: value passed to the resumer
+	// SYS33[out]: value passed by the next SYS_FIBER_RESUME
+
+	t := vm.fiberTable()
+	f, ok := t.suspend(vm.Registers[REGISTER_SYS32], FIBER_YIELDED)
+	if !ok {
+		return errs.EINVALIDFIBER.Errno(), nil
+	}
+	f.State = FiberSuspended
+	return 0, nil
+}
+
+func _syscall_fiber_exit(vm *VM, _, _, _ uint64) (errno uint64, err error) {
+	// func FiberExit(value uint64) (errno uint64)
+	// SYS32[in]: value passed to the resumer
+	//
+	// Returns only on error.
+
+	t := vm.fiberTable()
+	f := t.Fibers[t.Current]
+	if _, ok := t.Fibers[f.resumer]; t.Current == 0 || !ok {
+		return errs.EINVALIDFIBER.Errno(), nil
+	}
+	// Free the stack while the fiber can still see the errno.
+	err = vm.Memory.Free(f.Stack)
+	if err != nil {
+		return allocErrno(err), nil
+	}
+	t.suspend(vm.Registers[REGISTER_SYS32], FIBER_FINISHED)
+	delete(t.Fibers, f.ID)
+	return 0, nil
+}
+
+func _syscall_fiber_free(vm *VM, _, _, _ uint64) (errno uint64, err error) {
+	// func FiberFree(id uint64) (errno uint64)
+	// SYS32[in]: fiber ID (must be suspended)
+
+	id := vm.Registers[REGISTER_SYS32]
+	t := vm.fiberTable()
+	f, ok := t.Fibers[id]
+	if !ok || id == 0 || f.State != FiberSuspended {
+		return errs.EINVALIDFIBER.Errno(), nil
+	}
+	err = vm.Memory.Free(f.Stack)
+	if err != nil {
+		return allocErrno(err), nil
+	}
+	delete(t.Fibers, id)
+	return 0, nil
+}
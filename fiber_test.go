@@ -0,0 +1,209 @@
+package lvm2
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/lemon-mint/lvm2/errs"
+)
+
+// generatorProgram returns a program that sums what a generator fiber
+// yields, counting 1 to 5 on its own stack, plus the value it exits with.
+// The main fiber keeps 77 on its stack and 1234 in R8.
+func generatorProgram() []testInstruction {
+	return []testInstruction{
+		inst(InstructionType_MOV, cnst(REGISTER_SYS32), cnst(at(16))),
+		inst(InstructionType_MOV, cnst(REGISTER_SYS33), cnst(5)),
+		inst(InstructionType_MOV, cnst(REGISTER_SYS34), cnst(0)),
+		sys(SYS_FIBER_CREATE),
+		inst(InstructionType_MOV, cnst(REGISTER_R6), reg(REGISTER_SYS35)),
+		inst(InstructionType_MOV, cnst(REGISTER_R8), cnst(1234)),
+		inst(InstructionType_PUSH, cnst(77)),
+		// 7: resume until finished
+		inst(InstructionType_MOV, cnst(REGISTER_SYS32), reg(REGISTER_R6)),
+		inst(InstructionType_MOV, cnst(REGISTER_SYS33), cnst(0)),
+		sys(SYS_FIBER_RESUME),
+		inst(InstructionType_ADD, cnst(REGISTER_R7), reg(REGISTER_R7), reg(REGISTER_SYS33)),
+		inst(InstructionType_JE, reg(REGISTER_SYS34), cnst(at(7))),
+		inst(InstructionType_POP, cnst(REGISTER_R9)),
+		inst(InstructionType_MOV, cnst(REGISTER_SYS32), reg(REGISTER_R7)),
+		sys(SYS_EXIT),
+		inst(InstructionType_NOP),
+
+		// 16: generator, R0 = count
+		inst(InstructionType_MOV, cnst(REGISTER_R8), cnst(0)),
+		inst(InstructionType_PUSH, cnst(1)),
+		inst(InstructionType_POP, cnst(REGISTER_R1)),
+		inst(InstructionType_MOV, cnst(REGISTER_SYS32), reg(REGISTER_R1)),
+		inst(InstructionType_ADD, cnst(REGISTER_R1), reg(REGISTER_R1), cnst(1)),
+		inst(InstructionType_PUSH, reg(REGISTER_R1)),
+		sys(SYS_FIBER_YIELD),
+		inst(InstructionType_SUB, cnst(REGISTER_R2), reg(REGISTER_R1), reg(REGISTER_R0)),
+		inst(InstructionType_SUB, cnst(REGISTER_R2), reg(REGISTER_R2), cnst(1)),
+		inst(InstructionType_JNE, reg(REGISTER_R2), cnst(at(16+2))),
+		inst(InstructionType_MOV, cnst(REGISTER_SYS32), cnst(100)),
+		sys(SYS_FIBER_EXIT),
+	}
+}
+
+func TestVM_Fibers(t *testing.T) {
+	vm := newTestVM(generatorProgram()...)
+	code, err := vm.Run()
+	if err != nil || code != 1+2+3+4+5+100 {
+		t.Fatalf("Run() = %d, %v", code, err)
+	}
+	if vm.Registers[REGISTER_R8] != 1234 || vm.Registers[REGISTER_R9] != 77 || vm.Registers[REGISTER_R4] != 0 {
+		t.Errorf("R8, R9, R4 = %d, %d, %d", vm.Registers[REGISTER_R8], vm.Registers[REGISTER_R9], vm.Registers[REGISTER_R4])
+	}
+	if len(vm.fibers.Fibers) != 1 || vm.Memory.(*Memory).HeapBytes != 0 {
+		t.Errorf("fibers = %d, heap = %d after exit", len(vm.fibers.Fibers), vm.Memory.(*Memory).HeapBytes)
+	}
+}
+
+func TestVM_FibersValues(t *testing.T) {
+	// The fiber doubles every value it is resumed with.
+	prog := []testInstruction{
+		inst(InstructionType_MOV, cnst(REGISTER_SYS32), cnst(at(10))),
+		sys(SYS_FIBER_CREATE),
+		inst(InstructionType_MOV, cnst(REGISTER_R6), reg(REGISTER_SYS35)),
+		inst(InstructionType_MOV, cnst(REGISTER_SYS32), reg(REGISTER_R6)),
+		inst(InstructionType_MOV, cnst(REGISTER_SYS33), cnst(3)),
+		sys(SYS_FIBER_RESUME),
+		inst(InstructionType_MOV, cnst(REGISTER_SYS33), cnst(20)),
+		sys(SYS_FIBER_RESUME),
+		inst(InstructionType_ADD, cnst(REGISTER_SYS32), reg(REGISTER_SYS33), cnst(0)),
+		sys(SYS_EXIT),
+
+		// 10: fiber
+		inst(InstructionType_MUL, cnst(REGISTER_SYS32), reg(REGISTER_SYS33), cnst(2)),
+		sys(SYS_FIBER_YIELD),
+		inst(InstructionType_JMP, cnst(at(10))),
+	}
+	vm := newTestVM(prog...)
+	if code, err := vm.Run(); err != nil || code != 40 {
+		t.Fatalf("Run() = %d, %v", code, err)
+	}
+}
+
+func TestVM_FibersErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		prog []testInstruction
+	}{
+		{"YieldMain", []testInstruction{
+			sys(SYS_FIBER_YIELD),
+		}},
+		{"ExitMain", []testInstruction{
+			sys(SYS_FIBER_EXIT),
+		}},
+		{"ResumeUnknown", []testInstruction{
+			inst(InstructionType_MOV, cnst(REGISTER_SYS32), cnst(9)),
+			sys(SYS_FIBER_RESUME),
+		}},
+		{"ResumeMain", []testInstruction{
+			inst(InstructionType_MOV, cnst(REGISTER_SYS32), cnst(0)),
+			sys(SYS_FIBER_RESUME),
+		}},
+		{"FreeMain", []testInstruction{
+			inst(InstructionType_MOV, cnst(REGISTER_SYS32), cnst(0)),
+			sys(SYS_FIBER_FREE),
+		}},
+		{"FreeTwice", []testInstruction{
+			sys(SYS_FIBER_CREATE),
+			inst(InstructionType_MOV, cnst(REGISTER_SYS32), reg(REGISTER_SYS35)),
+			sys(SYS_FIBER_FREE),
+			sys(SYS_FIBER_FREE),
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm := newTestVM(tt.prog...)
+			for range tt.prog {
+				if _, err := vm.Step(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if vm.Registers[REGISTER_R4] != errs.EINVALIDFIBER.Errno() {
+				t.Errorf("errno = %d, want %d", vm.Registers[REGISTER_R4], errs.EINVALIDFIBER.Errno())
+			}
+		})
+	}
+}
+
+func TestVM_FibersStack(t *testing.T) {
+	// The fiber pushes until it runs into the guard below its stack.
+	vm := newTestVM(
+		inst(InstructionType_MOV, cnst(REGISTER_SYS32), cnst(at(4))),
+		sys(SYS_FIBER_CREATE),
+		inst(InstructionType_MOV, cnst(REGISTER_SYS32), reg(REGISTER_SYS35)),
+		sys(SYS_FIBER_RESUME),
+		inst(InstructionType_PUSH, reg(REGISTER_R0)),
+		inst(InstructionType_JMP, cnst(at(4))),
+	)
+	_, err := vm.Run()
+	var f *Fault
+	if !errors.As(err, &f) || f.Kind != FaultStackOverflow || f.PC != at(4) {
+		t.Fatalf("Run() err = %v, want stack overflow", err)
+	}
+
+	// A fiber freeing its own stack cannot exit or be freed, and is told so.
+	vm = newTestVM(
+		inst(InstructionType_MOV, cnst(REGISTER_SYS32), cnst(at(10))),
+		sys(SYS_FIBER_CREATE),
+		inst(InstructionType_MOV, cnst(REGISTER_R6), reg(REGISTER_SYS35)),
+		inst(InstructionType_MOV, cnst(REGISTER_SYS32), reg(REGISTER_R6)),
+		sys(SYS_FIBER_RESUME),
+		inst(InstructionType_MOV, cnst(REGISTER_R7), reg(REGISTER_SYS33)),
+		inst(InstructionType_MOV, cnst(REGISTER_SYS32), reg(REGISTER_R6)),
+		sys(SYS_FIBER_FREE),
+		inst(InstructionType_MOV, cnst(REGISTER_SYS32), cnst(0)),
+		sys(SYS_EXIT),
+
+		// 10: fiber
+		inst(InstructionType_SUB, cnst(REGISTER_SYS32), reg(REGISTER_SB), cnst(DEFAULT_FIBER_STACK_SIZE)),
+		sys(SYS_FREE),
+		sys(SYS_FIBER_EXIT),
+		inst(InstructionType_MOV, cnst(REGISTER_SYS32), reg(REGISTER_R4)),
+		sys(SYS_FIBER_YIELD),
+	)
+	if code, err := vm.Run(); err != nil || code != 0 {
+		t.Fatalf("Run() = %d, %v", code, err)
+	}
+	want := errs.EDOUBLEFREE.Errno()
+	if vm.Registers[REGISTER_R7] != want || vm.Registers[REGISTER_R4] != want || len(vm.fibers.Fibers) != 2 {
+		t.Errorf("exit errno %d, free errno %d, %d fibers", vm.Registers[REGISTER_R7], vm.Registers[REGISTER_R4], len(vm.fibers.Fibers))
+	}
+}
+
+func TestVM_FibersFork(t *testing.T) {
+	vm := newTestVM(generatorProgram()...)
+	for vm.fibers == nil || vm.fibers.Current == 0 || vm.Registers[REGISTER_R1] < 3 {
+		if _, err := vm.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := vm.WriteCheckpoint(&bytes.Buffer{}); err != ErrCheckpointNotSupported {
+		t.Fatalf("WriteCheckpoint() err = %v, want %v", err, ErrCheckpointNotSupported)
+	}
+	s, err := vm.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	child, err := vm.Fork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []*VM{vm, child} {
+		if code, err := v.Run(); err != nil || code != 115 {
+			t.Fatalf("Run() = %d, %v", code, err)
+		}
+	}
+	if err := vm.Restore(s); err != nil {
+		t.Fatal(err)
+	}
+	if code, err := vm.Run(); err != nil || code != 115 {
+		t.Fatalf("restored: Run() = %d, %v", code, err)
+	}
+}
@@ -0,0 +1,50 @@
+package lvm2
+
+import "math"
+
+func f64(v uint64) float64 {
+	return math.Float64frombits(v)
+}
+
+func f64bits(f float64) uint64 {
+	return math.Float64bits(f)
+}
+
+// fcmp compares two float64 values. Unordered (NaN) operands compare as 2
+// with unordered set to 1. FCMP stores unordered in CF: JG and JGE take 2
+// as greater, so guest code comparing floats tests CF before them.
+func fcmp(a, b float64) (result, unordered uint64) {
+	switch {
+	case a < b:
+		return ^uint64(0), 0
+	case a > b:
+		return 1, 0
+	case a == b:
+		return 0, 0
+	}
+	return 2, 1
+}
+
+// ftoi converts f to int64, saturating out-of-range values. NaN converts to 0.
+func ftoi(f float64) uint64 {
+	switch {
+	case f != f:
+		return 0
+	case f >= math.MaxInt64:
+		return math.MaxInt64
+	case f <= math.MinInt64:
+		return uint64(1) << 63
+	}
+	return uint64(int64(f))
+}
+
+// ftou converts f to uint64, saturating out-of-range values. NaN converts to 0.
+func ftou(f float64) uint64 {
+	switch {
+	case f != f || f <= 0:
+		return 0
+	case f >= math.MaxUint64:
+		return math.MaxUint64
+	}
+	return uint64(f)
+}
@@ -1,5 +1,7 @@
 package lvm2
 
+import "strconv"
+
 type InstructionType byte
 
 const WORD_SIZE = 8
@@ -23,7 +25,7 @@ const (
 	InstructionType_SHL // R0 = R1 << R2
 	InstructionType_SHR // R0 = R1 >> R2
 
-	InstructionType_CMP // R0 = R1 - R2 (signed)
+	InstructionType_CMP // R0 = R1 - R2 (signed) (-1: R1 < R2, 0: R1 == R2, 1: R1 > R2)
 	InstructionType_JMP // PC = R0
 
 	InstructionType_JG  // if R0 > 0; PC = R1
@@ -51,7 +53,80 @@ const (
 	InstructionType_CALL // SP = SP - WORD_SIZE; [SP] = PC; PC = R0
 	InstructionType_RET  // PC = [SP]; SP = SP + WORD_SIZE
 
-	InstructionType_SYSCALL // R0 = syscall(R1, R2) (System Call) R0: errno, R1: syscall number, R2: register parameter
+	InstructionType_SYSCALL // R0 = syscall(R1, R2) (System Call) R0: register receiving the errno (0 on success), R1: syscall number, R2: register parameter
+
+	InstructionType_IDIV // R0 = R1 / R2 (signed)
+	InstructionType_IMOD // R0 = R1 % R2 (signed)
+	InstructionType_SAR  // R0 = R1 >> R2 (arithmetic)
+
+	InstructionType_LOADSH // R0 = [MEM[R1 + R2]] (Load Register from Memory (HALF_WORD_SIZE, sign-extended))
+	InstructionType_LOADSB // R0 = [MEM[R1 + R2]] (Load Register from Memory (BYTE_SIZE, sign-extended))
+
+	InstructionType_UCMP // R0 = R1 - R2 (unsigned)
+
+	InstructionType_FADD  // R0 = R1 + R2 (float64)
+	InstructionType_FSUB  // R0 = R1 - R2 (float64)
+	InstructionType_FMUL  // R0 = R1 * R2 (float64)
+	InstructionType_FDIV  // R0 = R1 / R2 (float64)
+	InstructionType_FCMP  // R0 = R1 - R2 (float64) (-1: R1 < R2, 0: R1 == R2, 1: R1 > R2, 2: unordered); CF = unordered
+	InstructionType_FSQRT // R0 = sqrt(R1) (float64)
+	InstructionType_FABS  // R0 = |R1| (float64)
+	InstructionType_FNEG  // R0 = -R1 (float64)
+
+	InstructionType_FTOI   // R0 = int64(R1) (float64 to signed integer, saturating)
+	InstructionType_FTOU   // R0 = uint64(R1) (float64 to unsigned integer, saturating)
+	InstructionType_ITOF   // R0 = float64(R1) (signed integer to float64)
+	InstructionType_UTOF   // R0 = float64(R1) (unsigned integer to float64)
+	InstructionType_FTOF32 // R0 = float32(R1) (float64 to float32)
+	InstructionType_F32TOF // R0 = float64(R1) (float32 to float64)
+
+	InstructionType_POPCNT // R0 = popcount(R1)
+	InstructionType_CLZ    // R0 = leading zeros of R1 (64 if R1 == 0)
+	InstructionType_CTZ    // R0 = trailing zeros of R1 (64 if R1 == 0)
+	InstructionType_ROL    // R0 = R1 rotated left by R2 % 64
+	InstructionType_ROR    // R0 = R1 rotated right by R2 % 64
+	InstructionType_BSWAP  // R0 = R1 with its byte order reversed
+
+	InstructionType_MULH  // R0 = (R1 * R2) >> 64 (signed, high word of the 128-bit product)
+	InstructionType_UMULH // R0 = (R1 * R2) >> 64 (unsigned, high word of the 128-bit product)
+	InstructionType_ADC   // R0 = R1 + R2 + CF; CF = carry out
+
+	InstructionType_CMOVG  // if R2 > 0; R0 = R1
+	InstructionType_CMOVL  // if R2 < 0; R0 = R1
+	InstructionType_CMOVE  // if R2 == 0; R0 = R1
+	InstructionType_CMOVNE // if R2 != 0; R0 = R1
+	InstructionType_CMOVGE // if R2 >= 0; R0 = R1
+	InstructionType_CMOVLE // if R2 <= 0; R0 = R1
+	InstructionType_SELECT // if R0 != 0; R0 = R1; else R0 = R2
+
+	InstructionType_JTAB  // PC = TABLE(R0)[R1] (Jump through Jump Table, faults if R1 is out of range)
+	InstructionType_CALLT // SP = SP - WORD_SIZE; [SP] = PC; PC = TABLE(R0)[R1]
+
+	// MEMCPY and MEMSET only read their operands. MEMCMP reads the size from
+	// R0 and replaces it with the result. Each full BULK_CHUNK_SIZE bytes are
+	// charged as one more instruction against the instruction budget.
+	InstructionType_MEMCPY // MEM[R0 : R0+R2] = MEM[R1 : R1+R2] (ranges may overlap)
+	InstructionType_MEMSET // MEM[R0 : R0+R2] = byte(R1)
+	InstructionType_MEMCMP // R0 = compare(MEM[R1 : R1+R0], MEM[R2 : R2+R0]) (-1: less, 0: equal, 1: greater)
+
+	// Atomic instructions fault unless the address is aligned to the access size.
+	InstructionType_LOADA   // R0 = [MEM[R1 + R2]] (Atomic Load-Acquire (WORD_SIZE))
+	InstructionType_LOADAH  // R0 = [MEM[R1 + R2]] (Atomic Load-Acquire (HALF_WORD_SIZE))
+	InstructionType_LOADAB  // R0 = [MEM[R1 + R2]] (Atomic Load-Acquire (BYTE_SIZE))
+	InstructionType_STOREL  // [MEM[R1 + R2]] = R0 (Atomic Store-Release (WORD_SIZE))
+	InstructionType_STORELH // [MEM[R1 + R2]] = R0 (Atomic Store-Release (HALF_WORD_SIZE))
+	InstructionType_STORELB // [MEM[R1 + R2]] = R0 (Atomic Store-Release (BYTE_SIZE))
+	InstructionType_XADD    // R0 = [MEM[R1]]; [MEM[R1]] += R2 (Atomic Fetch-and-Add (WORD_SIZE))
+	InstructionType_XADDH   // R0 = [MEM[R1]]; [MEM[R1]] += R2 (Atomic Fetch-and-Add (HALF_WORD_SIZE))
+	InstructionType_XADDB   // R0 = [MEM[R1]]; [MEM[R1]] += R2 (Atomic Fetch-and-Add (BYTE_SIZE))
+	InstructionType_XCHG    // R0 = [MEM[R1]]; [MEM[R1]] = R2 (Atomic Exchange (WORD_SIZE))
+	InstructionType_XCHGH   // R0 = [MEM[R1]]; [MEM[R1]] = R2 (Atomic Exchange (HALF_WORD_SIZE))
+	InstructionType_XCHGB   // R0 = [MEM[R1]]; [MEM[R1]] = R2 (Atomic Exchange (BYTE_SIZE))
+	InstructionType_CAS     // if [MEM[R1]] == R0; [MEM[R1]] = R2. R0 = old [MEM[R1]] (Atomic Compare-and-Swap (WORD_SIZE))
+	InstructionType_CASH    // if [MEM[R1]] == R0; [MEM[R1]] = R2. R0 = old [MEM[R1]] (Atomic Compare-and-Swap (HALF_WORD_SIZE))
+	InstructionType_CASB    // if [MEM[R1]] == R0; [MEM[R1]] = R2. R0 = old [MEM[R1]] (Atomic Compare-and-Swap (BYTE_SIZE))
+
+	InstructionType_IRET // PC = [SP]; SP = SP + WORD_SIZE (Return from Interrupt Handler, reenables interrupts)
 )
 
 func (v InstructionType) String() string {
@@ -66,6 +141,8 @@ func (v InstructionType) String() string {
 		return "MUL"
 	case InstructionType_DIV:
 		return "DIV"
+	case InstructionType_MOD:
+		return "MOD"
 	case InstructionType_AND:
 		return "AND"
 	case InstructionType_OR:
@@ -122,16 +199,162 @@ func (v InstructionType) String() string {
 		return "RET"
 	case InstructionType_SYSCALL:
 		return "SYSCALL"
+	case InstructionType_IDIV:
+		return "IDIV"
+	case InstructionType_IMOD:
+		return "IMOD"
+	case InstructionType_SAR:
+		return "SAR"
+	case InstructionType_LOADSH:
+		return "LOADSH"
+	case InstructionType_LOADSB:
+		return "LOADSB"
+	case InstructionType_UCMP:
+		return "UCMP"
+	case InstructionType_FADD:
+		return "FADD"
+	case InstructionType_FSUB:
+		return "FSUB"
+	case InstructionType_FMUL:
+		return "FMUL"
+	case InstructionType_FDIV:
+		return "FDIV"
+	case InstructionType_FCMP:
+		return "FCMP"
+	case InstructionType_FSQRT:
+		return "FSQRT"
+	case InstructionType_FABS:
+		return "FABS"
+	case InstructionType_FNEG:
+		return "FNEG"
+	case InstructionType_FTOI:
+		return "FTOI"
+	case InstructionType_FTOU:
+		return "FTOU"
+	case InstructionType_ITOF:
+		return "ITOF"
+	case InstructionType_UTOF:
+		return "UTOF"
+	case InstructionType_FTOF32:
+		return "FTOF32"
+	case InstructionType_F32TOF:
+		return "F32TOF"
+	case InstructionType_POPCNT:
+		return "POPCNT"
+	case InstructionType_CLZ:
+		return "CLZ"
+	case InstructionType_CTZ:
+		return "CTZ"
+	case InstructionType_ROL:
+		return "ROL"
+	case InstructionType_ROR:
+		return "ROR"
+	case InstructionType_BSWAP:
+		return "BSWAP"
+	case InstructionType_MULH:
+		return "MULH"
+	case InstructionType_UMULH:
+		return "UMULH"
+	case InstructionType_ADC:
+		return "ADC"
+	case InstructionType_CMOVG:
+		return "CMOVG"
+	case InstructionType_CMOVL:
+		return "CMOVL"
+	case InstructionType_CMOVE:
+		return "CMOVE"
+	case InstructionType_CMOVNE:
+		return "CMOVNE"
+	case InstructionType_CMOVGE:
+		return "CMOVGE"
+	case InstructionType_CMOVLE:
+		return "CMOVLE"
+	case InstructionType_SELECT:
+		return "SELECT"
+	case InstructionType_JTAB:
+		return "JTAB"
+	case InstructionType_CALLT:
+		return "CALLT"
+	case InstructionType_MEMCPY:
+		return "MEMCPY"
+	case InstructionType_MEMSET:
+		return "MEMSET"
+	case InstructionType_MEMCMP:
+		return "MEMCMP"
+	case InstructionType_LOADA:
+		return "LOADA"
+	case InstructionType_LOADAH:
+		return "LOADAH"
+	case InstructionType_LOADAB:
+		return "LOADAB"
+	case InstructionType_STOREL:
+		return "STOREL"
+	case InstructionType_STORELH:
+		return "STORELH"
+	case InstructionType_STORELB:
+		return "STORELB"
+	case InstructionType_XADD:
+		return "XADD"
+	case InstructionType_XADDH:
+		return "XADDH"
+	case InstructionType_XADDB:
+		return "XADDB"
+	case InstructionType_XCHG:
+		return "XCHG"
+	case InstructionType_XCHGH:
+		return "XCHGH"
+	case InstructionType_XCHGB:
+		return "XCHGB"
+	case InstructionType_CAS:
+		return "CAS"
+	case InstructionType_CASH:
+		return "CASH"
+	case InstructionType_CASB:
+		return "CASB"
+	case InstructionType_IRET:
+		return "IRET"
 	}
 	return "UNKNOWN"
 }
 
+// WritesRegister reports whether the instruction stores its result
+// in the register named by Op0.
+func (v InstructionType) WritesRegister() bool {
+	switch v {
+	case InstructionType_ADD, InstructionType_SUB, InstructionType_MUL, InstructionType_DIV, InstructionType_MOD,
+		InstructionType_AND, InstructionType_OR, InstructionType_XOR, InstructionType_NOT,
+		InstructionType_SHL, InstructionType_SHR, InstructionType_CMP,
+		InstructionType_LOAD, InstructionType_LOADH, InstructionType_LOADB,
+		InstructionType_MOV, InstructionType_MOVH, InstructionType_MOVB,
+		InstructionType_POP, InstructionType_SYSCALL,
+		InstructionType_IDIV, InstructionType_IMOD, InstructionType_SAR,
+		InstructionType_LOADSH, InstructionType_LOADSB, InstructionType_UCMP,
+		InstructionType_FADD, InstructionType_FSUB, InstructionType_FMUL, InstructionType_FDIV, InstructionType_FCMP,
+		InstructionType_FSQRT, InstructionType_FABS, InstructionType_FNEG,
+		InstructionType_FTOI, InstructionType_FTOU, InstructionType_ITOF, InstructionType_UTOF,
+		InstructionType_FTOF32, InstructionType_F32TOF,
+		InstructionType_POPCNT, InstructionType_CLZ, InstructionType_CTZ,
+		InstructionType_ROL, InstructionType_ROR, InstructionType_BSWAP,
+		InstructionType_MULH, InstructionType_UMULH, InstructionType_ADC,
+		InstructionType_CMOVG, InstructionType_CMOVL, InstructionType_CMOVE,
+		InstructionType_CMOVNE, InstructionType_CMOVGE, InstructionType_CMOVLE,
+		InstructionType_SELECT, InstructionType_MEMCMP,
+		InstructionType_LOADA, InstructionType_LOADAH, InstructionType_LOADAB,
+		InstructionType_XADD, InstructionType_XADDH, InstructionType_XADDB,
+		InstructionType_XCHG, InstructionType_XCHGH, InstructionType_XCHGB,
+		InstructionType_CAS, InstructionType_CASH, InstructionType_CASB:
+		return true
+	}
+	return false
+}
+
 var Instructions = map[string]InstructionType{
 	"NOP":     InstructionType_NOP,
 	"ADD":     InstructionType_ADD,
 	"SUB":     InstructionType_SUB,
 	"MUL":     InstructionType_MUL,
 	"DIV":     InstructionType_DIV,
+	"MOD":     InstructionType_MOD,
 	"AND":     InstructionType_AND,
 	"OR":      InstructionType_OR,
 	"XOR":     InstructionType_XOR,
@@ -160,4 +383,103 @@ var Instructions = map[string]InstructionType{
 	"CALL":    InstructionType_CALL,
 	"RET":     InstructionType_RET,
 	"SYSCALL": InstructionType_SYSCALL,
+	"IDIV":    InstructionType_IDIV,
+	"IMOD":    InstructionType_IMOD,
+	"SAR":     InstructionType_SAR,
+	"LOADSH":  InstructionType_LOADSH,
+	"LOADSB":  InstructionType_LOADSB,
+	"UCMP":    InstructionType_UCMP,
+	"FADD":    InstructionType_FADD,
+	"FSUB":    InstructionType_FSUB,
+	"FMUL":    InstructionType_FMUL,
+	"FDIV":    InstructionType_FDIV,
+	"FCMP":    InstructionType_FCMP,
+	"FSQRT":   InstructionType_FSQRT,
+	"FABS":    InstructionType_FABS,
+	"FNEG":    InstructionType_FNEG,
+	"FTOI":    InstructionType_FTOI,
+	"FTOU":    InstructionType_FTOU,
+	"ITOF":    InstructionType_ITOF,
+	"UTOF":    InstructionType_UTOF,
+	"FTOF32":  InstructionType_FTOF32,
+	"F32TOF":  InstructionType_F32TOF,
+	"POPCNT":  InstructionType_POPCNT,
+	"CLZ":     InstructionType_CLZ,
+	"CTZ":     InstructionType_CTZ,
+	"ROL":     InstructionType_ROL,
+	"ROR":     InstructionType_ROR,
+	"BSWAP":   InstructionType_BSWAP,
+	"MULH":    InstructionType_MULH,
+	"UMULH":   InstructionType_UMULH,
+	"ADC":     InstructionType_ADC,
+	"CMOVG":   InstructionType_CMOVG,
+	"CMOVL":   InstructionType_CMOVL,
+	"CMOVE":   InstructionType_CMOVE,
+	"CMOVNE":  InstructionType_CMOVNE,
+	"CMOVGE":  InstructionType_CMOVGE,
+	"CMOVLE":  InstructionType_CMOVLE,
+	"SELECT":  InstructionType_SELECT,
+	"JTAB":    InstructionType_JTAB,
+	"CALLT":   InstructionType_CALLT,
+	"MEMCPY":  InstructionType_MEMCPY,
+	"MEMSET":  InstructionType_MEMSET,
+	"MEMCMP":  InstructionType_MEMCMP,
+	"LOADA":   InstructionType_LOADA,
+	"LOADAH":  InstructionType_LOADAH,
+	"LOADAB":  InstructionType_LOADAB,
+	"STOREL":  InstructionType_STOREL,
+	"STORELH": InstructionType_STORELH,
+	"STORELB": InstructionType_STORELB,
+	"XADD":    InstructionType_XADD,
+	"XADDH":   InstructionType_XADDH,
+	"XADDB":   InstructionType_XADDB,
+	"XCHG":    InstructionType_XCHG,
+	"XCHGH":   InstructionType_XCHGH,
+	"XCHGB":   InstructionType_XCHGB,
+	"CAS":     InstructionType_CAS,
+	"CASH":    InstructionType_CASH,
+	"CASB":    InstructionType_CASB,
+	"IRET":    InstructionType_IRET,
+}
+
+// Instruction is a decoded instruction.
+type Instruction struct {
+	Type InstructionType
+
+	Op0Type OpType
+	Op1Type OpType
+	Op2Type OpType
+
+	Op0Value uint64
+	Op1Value uint64
+	Op2Value uint64
+}
+
+func (i Instruction) String() string {
+	s := i.Type.String()
+	ops := [3]struct {
+		t OpType
+		v uint64
+	}{
+		{i.Op0Type, i.Op0Value},
+		{i.Op1Type, i.Op1Value},
+		{i.Op2Type, i.Op2Value},
+	}
+	for n, op := range ops {
+		if op.t == OpTypeNone {
+			continue
+		}
+		if n == 0 {
+			s += " "
+		} else {
+			s += ", "
+		}
+		switch op.t {
+		case OpTypeRegister:
+			s += "%" + RegisterName(op.v)
+		default:
+			s += "0x" + strconv.FormatUint(op.v, 16)
+		}
+	}
+	return s
 }
@@ -0,0 +1,182 @@
+package lvm2
+
+import (
+	"math"
+	"testing"
+)
+
+type instructionTest struct {
+	name string
+	inst testInstruction
+	regs map[uint64]uint64
+	mem  []byte // placed right after the instruction
+	want uint64 // value of R0 after execution
+}
+
+// memAddr is the address of instructionTest.mem.
+const memAddr = InstructionBytecodeSize
+
+func runInstructionTests(t *testing.T, tests []instructionTest) {
+	t.Helper()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm := newTestVM(tt.inst)
+			vm.SetProgram(append(assemble(tt.inst), tt.mem...))
+			for r, v := range tt.regs {
+				vm.Registers[r] = v
+			}
+			if _, err := vm.Step(); err != nil {
+				t.Fatal(err)
+			}
+			if got := vm.Registers[REGISTER_R0]; got != tt.want {
+				t.Errorf("R0 = %#x, want %#x", got, tt.want)
+			}
+		})
+	}
+}
+
+func i64(v int64) uint64 { return uint64(v) }
+
+func TestInstruction_Signed(t *testing.T) {
+	runInstructionTests(t, []instructionTest{
+		{"IDIV", inst(InstructionType_IDIV, cnst(REGISTER_R0), cnst(i64(-7)), cnst(2)), nil, nil, i64(-3)},
+		{"IDIV/MinInt64", inst(InstructionType_IDIV, cnst(REGISTER_R0), cnst(1<<63), cnst(i64(-1))), nil, nil, 1 << 63},
+		{"IMOD", inst(InstructionType_IMOD, cnst(REGISTER_R0), cnst(i64(-7)), cnst(2)), nil, nil, i64(-1)},
+		{"SAR", inst(InstructionType_SAR, cnst(REGISTER_R0), cnst(i64(-16)), cnst(2)), nil, nil, i64(-4)},
+		{"SHR", inst(InstructionType_SHR, cnst(REGISTER_R0), cnst(i64(-16)), cnst(60)), nil, nil, 0xF},
+		{"LOADSH", inst(InstructionType_LOADSH, cnst(REGISTER_R0), cnst(memAddr), cnst(0)), nil, []byte{0xFE, 0xFF, 0xFF, 0xFF}, i64(-2)},
+		{"LOADH", inst(InstructionType_LOADH, cnst(REGISTER_R0), cnst(memAddr), cnst(0)), nil, []byte{0xFE, 0xFF, 0xFF, 0xFF}, 0xFFFFFFFE},
+		{"LOADSB", inst(InstructionType_LOADSB, cnst(REGISTER_R0), cnst(memAddr), cnst(0)), nil, []byte{0x80}, i64(-128)},
+		{"CMP/less", inst(InstructionType_CMP, cnst(REGISTER_R0), cnst(i64(-1)), cnst(1)), nil, nil, i64(-1)},
+		{"CMP/greater", inst(InstructionType_CMP, cnst(REGISTER_R0), cnst(1), cnst(i64(-1))), nil, nil, 1},
+		{"CMP/equal", inst(InstructionType_CMP, cnst(REGISTER_R0), cnst(5), cnst(5)), nil, nil, 0},
+		{"UCMP/less", inst(InstructionType_UCMP, cnst(REGISTER_R0), cnst(1), cnst(i64(-1))), nil, nil, i64(-1)},
+		{"UCMP/greater", inst(InstructionType_UCMP, cnst(REGISTER_R0), cnst(i64(-1)), cnst(1)), nil, nil, 1},
+		{"UCMP/equal", inst(InstructionType_UCMP, cnst(REGISTER_R0), reg(REGISTER_R1), cnst(3)), map[uint64]uint64{REGISTER_R1: 3}, nil, 0},
+	})
+}
+
+func TestInstruction_Float(t *testing.T) {
+	f := f64bits
+	nan := math.NaN()
+	runInstructionTests(t, []instructionTest{
+		{"FADD", inst(InstructionType_FADD, cnst(REGISTER_R0), cnst(f(1.5)), cnst(f(2.25))), nil, nil, f(3.75)},
+		{"FSUB", inst(InstructionType_FSUB, cnst(REGISTER_R0), cnst(f(1.5)), cnst(f(2.25))), nil, nil, f(-0.75)},
+		{"FMUL", inst(InstructionType_FMUL, cnst(REGISTER_R0), cnst(f(1.5)), cnst(f(-2))), nil, nil, f(-3)},
+		{"FDIV", inst(InstructionType_FDIV, cnst(REGISTER_R0), cnst(f(1)), cnst(f(4))), nil, nil, f(0.25)},
+		{"FDIV/zero", inst(InstructionType_FDIV, cnst(REGISTER_R0), cnst(f(1)), cnst(f(0))), nil, nil, f(math.Inf(1))},
+		{"FCMP/less", inst(InstructionType_FCMP, cnst(REGISTER_R0), cnst(f(-1)), cnst(f(1))), nil, nil, i64(-1)},
+		{"FCMP/greater", inst(InstructionType_FCMP, cnst(REGISTER_R0), cnst(f(2)), cnst(f(1))), nil, nil, 1},
+		{"FCMP/equal", inst(InstructionType_FCMP, cnst(REGISTER_R0), cnst(f(0)), cnst(f(math.Copysign(0, -1)))), nil, nil, 0},
+		{"FCMP/unordered", inst(InstructionType_FCMP, cnst(REGISTER_R0), cnst(f(nan)), cnst(f(1))), nil, nil, 2},
+		{"FSQRT", inst(InstructionType_FSQRT, cnst(REGISTER_R0), cnst(f(2.25))), nil, nil, f(1.5)},
+		{"FABS", inst(InstructionType_FABS, cnst(REGISTER_R0), cnst(f(-2.5))), nil, nil, f(2.5)},
+		{"FNEG", inst(InstructionType_FNEG, cnst(REGISTER_R0), reg(REGISTER_R1)), map[uint64]uint64{REGISTER_R1: f(2.5)}, nil, f(-2.5)},
+		{"FTOI", inst(InstructionType_FTOI, cnst(REGISTER_R0), cnst(f(-3.9))), nil, nil, i64(-3)},
+		{"FTOI/saturate", inst(InstructionType_FTOI, cnst(REGISTER_R0), cnst(f(1e300))), nil, nil, math.MaxInt64},
+		{"FTOI/NaN", inst(InstructionType_FTOI, cnst(REGISTER_R0), cnst(f(nan))), nil, nil, 0},
+		{"FTOU", inst(InstructionType_FTOU, cnst(REGISTER_R0), cnst(f(1e19))), nil, nil, 1e19},
+		{"FTOU/negative", inst(InstructionType_FTOU, cnst(REGISTER_R0), cnst(f(-1))), nil, nil, 0},
+		{"ITOF", inst(InstructionType_ITOF, cnst(REGISTER_R0), cnst(i64(-4))), nil, nil, f(-4)},
+		{"UTOF", inst(InstructionType_UTOF, cnst(REGISTER_R0), cnst(1<<63)), nil, nil, f(1 << 63)},
+		{"FTOF32", inst(InstructionType_FTOF32, cnst(REGISTER_R0), cnst(f(0.5))), nil, nil, uint64(math.Float32bits(0.5))},
+		{"F32TOF", inst(InstructionType_F32TOF, cnst(REGISTER_R0), cnst(uint64(math.Float32bits(-0.25)))), nil, nil, f(-0.25)},
+	})
+}
+
+// TestInstruction_FCMPBranch branches on FCMP the way guest code has to:
+// CF first, then the ordered jump.
+func TestInstruction_FCMPBranch(t *testing.T) {
+	prog := []testInstruction{
+		inst(InstructionType_FCMP, cnst(REGISTER_R0), reg(REGISTER_R1), reg(REGISTER_R2)),
+		inst(InstructionType_JNE, reg(REGISTER_CF), cnst(at(5))),
+		inst(InstructionType_JG, reg(REGISTER_R0), cnst(at(7))),
+	}
+	prog = append(prog, exitInst(0)...)
+	prog = append(prog, exitInst(2)...)
+	prog = append(prog, exitInst(1)...)
+
+	nan := math.NaN()
+	for _, tt := range []struct {
+		a, b float64
+		want uint64
+	}{
+		{2, 1, 1},
+		{1, 2, 0},
+		{nan, 1, 2},
+		{1, nan, 2},
+		{nan, nan, 2},
+	} {
+		vm := newTestVM(prog...)
+		vm.Registers[REGISTER_R1] = f64bits(tt.a)
+		vm.Registers[REGISTER_R2] = f64bits(tt.b)
+		vm.Registers[REGISTER_CF] = 1
+		if code, err := vm.Run(); err != nil || code != tt.want {
+			t.Errorf("FCMP %v, %v: Run() = %d, %v, want %d", tt.a, tt.b, code, err, tt.want)
+		}
+	}
+}
+
+func TestInstruction_Bits(t *testing.T) {
+	runInstructionTests(t, []instructionTest{
+		{"POPCNT", inst(InstructionType_POPCNT, cnst(REGISTER_R0), cnst(0xF0F0)), nil, nil, 8},
+		{"CLZ", inst(InstructionType_CLZ, cnst(REGISTER_R0), cnst(1)), nil, nil, 63},
+		{"CLZ/zero", inst(InstructionType_CLZ, cnst(REGISTER_R0), cnst(0)), nil, nil, 64},
+		{"CTZ", inst(InstructionType_CTZ, cnst(REGISTER_R0), cnst(0x100)), nil, nil, 8},
+		{"CTZ/zero", inst(InstructionType_CTZ, cnst(REGISTER_R0), cnst(0)), nil, nil, 64},
+		{"ROL", inst(InstructionType_ROL, cnst(REGISTER_R0), cnst(0x8000000000000001), cnst(4)), nil, nil, 0x18},
+		{"ROL/wrap", inst(InstructionType_ROL, cnst(REGISTER_R0), cnst(1), cnst(65)), nil, nil, 2},
+		{"ROR", inst(InstructionType_ROR, cnst(REGISTER_R0), cnst(0x18), cnst(4)), nil, nil, 0x8000000000000001},
+		{"BSWAP", inst(InstructionType_BSWAP, cnst(REGISTER_R0), cnst(0x0102030405060708)), nil, nil, 0x0807060504030201},
+		{"MULH", inst(InstructionType_MULH, cnst(REGISTER_R0), cnst(i64(-1)), cnst(i64(-1))), nil, nil, 0},
+		{"MULH/negative", inst(InstructionType_MULH, cnst(REGISTER_R0), cnst(i64(-2)), cnst(1<<62)), nil, nil, i64(-1)},
+		{"UMULH", inst(InstructionType_UMULH, cnst(REGISTER_R0), cnst(i64(-1)), cnst(i64(-1))), nil, nil, 0xFFFFFFFFFFFFFFFE},
+		{"ADC", inst(InstructionType_ADC, cnst(REGISTER_R0), cnst(1), cnst(2)), map[uint64]uint64{REGISTER_CF: 1}, nil, 4},
+	})
+}
+
+func TestInstruction_ADCCarry(t *testing.T) {
+	// 128-bit addition: (R1:R0) + (R3:R2)
+	vm := newTestVM(
+		inst(InstructionType_MOV, cnst(REGISTER_CF), cnst(0)),
+		inst(InstructionType_ADC, cnst(REGISTER_R0), reg(REGISTER_R0), reg(REGISTER_R2)),
+		inst(InstructionType_ADC, cnst(REGISTER_R1), reg(REGISTER_R1), reg(REGISTER_R3)),
+	)
+	vm.Registers[REGISTER_R0] = ^uint64(0)
+	vm.Registers[REGISTER_R1] = 1
+	vm.Registers[REGISTER_R2] = 2
+	vm.Registers[REGISTER_R3] = 3
+	for i := 0; i < 3; i++ {
+		if _, err := vm.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if vm.Registers[REGISTER_R0] != 1 || vm.Registers[REGISTER_R1] != 5 || vm.Registers[REGISTER_CF] != 0 {
+		t.Fatalf("R1:R0 = %d:%d, CF = %d", vm.Registers[REGISTER_R1], vm.Registers[REGISTER_R0], vm.Registers[REGISTER_CF])
+	}
+}
+
+func TestInstruction_ConditionalMove(t *testing.T) {
+	neg := map[uint64]uint64{REGISTER_R0: 7, REGISTER_R1: i64(-1)}
+	zero := map[uint64]uint64{REGISTER_R0: 7, REGISTER_R1: 0}
+	pos := map[uint64]uint64{REGISTER_R0: 7, REGISTER_R1: 1}
+	cmov := func(t InstructionType) testInstruction {
+		return inst(t, cnst(REGISTER_R0), cnst(42), reg(REGISTER_R1))
+	}
+	runInstructionTests(t, []instructionTest{
+		{"CMOVG/taken", cmov(InstructionType_CMOVG), pos, nil, 42},
+		{"CMOVG/not-taken", cmov(InstructionType_CMOVG), zero, nil, 7},
+		{"CMOVL/taken", cmov(InstructionType_CMOVL), neg, nil, 42},
+		{"CMOVL/not-taken", cmov(InstructionType_CMOVL), zero, nil, 7},
+		{"CMOVE/taken", cmov(InstructionType_CMOVE), zero, nil, 42},
+		{"CMOVE/not-taken", cmov(InstructionType_CMOVE), pos, nil, 7},
+		{"CMOVNE/taken", cmov(InstructionType_CMOVNE), neg, nil, 42},
+		{"CMOVNE/not-taken", cmov(InstructionType_CMOVNE), zero, nil, 7},
+		{"CMOVGE/taken", cmov(InstructionType_CMOVGE), zero, nil, 42},
+		{"CMOVGE/not-taken", cmov(InstructionType_CMOVGE), neg, nil, 7},
+		{"CMOVLE/taken", cmov(InstructionType_CMOVLE), zero, nil, 42},
+		{"CMOVLE/not-taken", cmov(InstructionType_CMOVLE), pos, nil, 7},
+		{"SELECT/true", inst(InstructionType_SELECT, cnst(REGISTER_R0), cnst(1), cnst(2)), map[uint64]uint64{REGISTER_R0: 5}, nil, 1},
+		{"SELECT/false", inst(InstructionType_SELECT, cnst(REGISTER_R0), cnst(1), cnst(2)), nil, nil, 2},
+	})
+}
@@ -0,0 +1,153 @@
+package lvm2
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"sync/atomic"
+	"time"
+
+	"github.com/lemon-mint/lvm2/errs"
+)
+
+// INTERRUPT_COUNT is the number of IRQs a VM supports.
+const INTERRUPT_COUNT = 64
+
+var ErrInvalidIRQ = errors.New("Invalid IRQ")
+
+// Raise marks irq pending. It is delivered to the guest before the next
+// instruction v executes, once an interrupt table is installed and
+// interrupts are enabled. Raise is safe to call from any goroutine,
+// also while v is running.
+func (v *VM) Raise(irq uint64) error {
+	if irq >= INTERRUPT_COUNT {
+		return ErrInvalidIRQ
+	}
+	for {
+		pending := atomic.LoadUint64(&v.pendingInterrupts)
+		if atomic.CompareAndSwapUint64(&v.pendingInterrupts, pending, pending|1<<irq) {
+			return nil
+		}
+	}
+}
+
+// PendingInterrupts returns the raised IRQs not delivered yet, one bit each.
+func (v *VM) PendingInterrupts() uint64 {
+	return atomic.LoadUint64(&v.pendingInterrupts)
+}
+
+// takeInterrupt clears and returns the lowest pending IRQ.
+func (v *VM) takeInterrupt() (uint64, bool) {
+	for {
+		pending := atomic.LoadUint64(&v.pendingInterrupts)
+		if pending == 0 {
+			return 0, false
+		}
+		irq := uint64(bits.TrailingZeros64(pending))
+		if atomic.CompareAndSwapUint64(&v.pendingInterrupts, pending, pending&^(1<<irq)) {
+			return irq, true
+		}
+	}
+}
+
+// interrupt delivers the lowest pending IRQ to its handler in the
+// interrupt table: the PC is pushed like CALL does and interrupts are
+// disabled until IRET. IRQs without a handler are dropped.
+// It returns the IRQ and whether it was delivered.
+func (v *VM) interrupt() (uint64, bool, error) {
+	if v.InterruptTable == 0 || v.InterruptsDisabled {
+		return 0, false, nil
+	}
+	for {
+		irq, ok := v.takeInterrupt()
+		if !ok {
+			return 0, false, nil
+		}
+		handler, err := v.tableEntry(v.InterruptTable, irq)
+		var f *Fault
+		if errors.As(err, &f) && f.Kind == FaultTableIndex {
+			continue
+		}
+		if err != nil {
+			return irq, false, err
+		}
+		if handler == 0 {
+			continue
+		}
+
+		var buffer [8]byte
+		binary.LittleEndian.PutUint64(buffer[:], v.Registers[REGISTER_PC])
+		_, err = v.Memory.WriteAt(v.Registers[REGISTER_SP]-8, buffer[:])
+		if err != nil {
+			return irq, false, stackFault(err)
+		}
+		v.Registers[REGISTER_SP] -= 8
+		v.Registers[REGISTER_PC] = handler
+		v.InterruptsDisabled = true
+		v.CallDepth++
+		return irq, true, nil
+	}
+}
+
+// stopTimers cancels the timers started with SYS_INTERRUPT_TIMER.
+func (v *VM) stopTimers() {
+	for irq, t := range v.timers {
+		t.Stop()
+		delete(v.timers, irq)
+	}
+}
+
+func _syscall_interrupt_table(vm *VM, _, _, _ uint64) (errno uint64, err error) {
+	// func InterruptTable(table uint64) (previous uint64, errno uint64)
+	// SYS32[in]: interrupt table in jump table format, indexed by IRQ (0: disable)
+	// SYS33[out]: previous table
+
+	vm.Registers[REGISTER_SYS33] = vm.InterruptTable
+	vm.InterruptTable = vm.Registers[REGISTER_SYS32]
+	return 0, nil
+}
+
+func _syscall_interrupt_mask(vm *VM, _, _, _ uint64) (errno uint64, err error) {
+	// func InterruptMask(disable uint64) (previous uint64, errno uint64)
+	// SYS32[in]: 1: disable interrupts, 0: enable them
+	// SYS33[out]: previous setting
+
+	vm.Registers[REGISTER_SYS33] = 0
+	if vm.InterruptsDisabled {
+		vm.Registers[REGISTER_SYS33] = 1
+	}
+	vm.InterruptsDisabled = vm.Registers[REGISTER_SYS32] != 0
+	return 0, nil
+}
+
+func _syscall_interrupt_timer(vm *VM, _, _, _ uint64) (errno uint64, err error) {
+	// func InterruptTimer(irq uint64, delay uint64) (errno uint64)
+	// SYS32[in]: IRQ raised when the timer fires
+	// SYS33[in]: delay in microseconds (0: cancel the timer of the IRQ)
+	//
+	// Each IRQ has at most one timer, starting a timer replaces it.
+
+	irq := vm.Registers[REGISTER_SYS32]
+	delay := vm.Registers[REGISTER_SYS33]
+	if irq >= INTERRUPT_COUNT {
+		return errs.EINVALIDIRQ.Errno(), nil
+	}
+	d := time.Duration(delay) * time.Microsecond
+	if d/time.Microsecond != time.Duration(delay) || d < 0 {
+		return errs.EINVALIDSIZE.Errno(), nil
+	}
+	if t, ok := vm.timers[irq]; ok {
+		t.Stop()
+		delete(vm.timers, irq)
+	}
+	if delay == 0 {
+		return 0, nil
+	}
+	if vm.timers == nil {
+		vm.timers = make(map[uint64]*time.Timer)
+	}
+	vm.timers[irq] = time.AfterFunc(d, func() {
+		vm.Raise(irq)
+	})
+	return 0, nil
+}
@@ -0,0 +1,195 @@
+package lvm2
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+// runSpinning runs vm, which spins until an interrupt arrives, with a
+// timeout so that a lost interrupt fails the test instead of hanging it.
+func runSpinning(t *testing.T, vm *VM) (uint64, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return vm.RunContext(ctx)
+}
+
+// interruptProgram returns a program installing the interrupt table
+// table (appended after the code) and running body.
+// Handlers start at instruction 16.
+func interruptProgram(table []uint64, body []testInstruction, handlers ...testInstruction) []byte {
+	prog := []testInstruction{
+		inst(InstructionType_MOV, cnst(REGISTER_SYS32), cnst(at(32))),
+		sys(SYS_INTERRUPT_TABLE),
+	}
+	prog = append(prog, body...)
+	for len(prog) < 16 {
+		prog = append(prog, inst(InstructionType_NOP))
+	}
+	prog = append(prog, handlers...)
+	for len(prog) < 32 {
+		prog = append(prog, inst(InstructionType_NOP))
+	}
+	return append(assemble(prog...), words(table...)...)
+}
+
+func TestVM_Interrupt(t *testing.T) {
+	// IRQ 1 and 3 have handlers adding 10 and 30 to R3, IRQ 0 and 2
+	// have none. The main program waits for two interrupts.
+	code := interruptProgram([]uint64{4, 0, at(16), 0, at(19)},
+		[]testInstruction{
+			inst(InstructionType_SUB, cnst(REGISTER_R2), reg(REGISTER_R1), cnst(2)),
+			inst(InstructionType_JNE, reg(REGISTER_R2), cnst(at(2))),
+			inst(InstructionType_MOV, cnst(REGISTER_SYS32), reg(REGISTER_R3)),
+			sys(SYS_EXIT),
+		},
+		inst(InstructionType_ADD, cnst(REGISTER_R1), reg(REGISTER_R1), cnst(1)),
+		inst(InstructionType_ADD, cnst(REGISTER_R3), reg(REGISTER_R3), cnst(10)),
+		inst(InstructionType_IRET),
+		inst(InstructionType_ADD, cnst(REGISTER_R1), reg(REGISTER_R1), cnst(1)),
+		inst(InstructionType_ADD, cnst(REGISTER_R3), reg(REGISTER_R3), cnst(30)),
+		inst(InstructionType_IRET),
+	)
+
+	vm := newTestVM()
+	vm.SetProgram(code)
+	for _, irq := range []uint64{0, 1, 2, 3} {
+		if err := vm.Raise(irq); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := vm.Raise(INTERRUPT_COUNT); err != ErrInvalidIRQ {
+		t.Fatalf("Raise(%d) err = %v, want %v", INTERRUPT_COUNT, err, ErrInvalidIRQ)
+	}
+
+	// Interrupts stay pending until the table is installed.
+	for i := 0; i < 2; i++ {
+		if result, err := vm.Step(); err != nil || result.Interrupted {
+			t.Fatalf("Step() = %+v, %v", result, err)
+		}
+	}
+	result, err := vm.Step()
+	if err != nil || !result.Interrupted || result.IRQ != 1 || result.PC != at(16) {
+		t.Fatalf("Step() = %+v, %v, want IRQ 1", result, err)
+	}
+	if !vm.InterruptsDisabled || vm.PendingInterrupts() != 1<<2|1<<3 {
+		t.Fatalf("disabled %v, pending %b in handler", vm.InterruptsDisabled, vm.PendingInterrupts())
+	}
+
+	ret, err := vm.Run()
+	if err != nil || ret != 40 {
+		t.Fatalf("Run() = %d, %v", ret, err)
+	}
+	if vm.InterruptsDisabled || vm.CallDepth != 0 || vm.Registers[REGISTER_SP] != vm.Memory.(*Memory).StackTop() {
+		t.Errorf("disabled %v, call depth %d, SP %#x after handlers", vm.InterruptsDisabled, vm.CallDepth, vm.Registers[REGISTER_SP])
+	}
+}
+
+func TestVM_InterruptMask(t *testing.T) {
+	code := interruptProgram([]uint64{1, at(16)},
+		[]testInstruction{
+			inst(InstructionType_MOV, cnst(REGISTER_SYS32), cnst(1)),
+			sys(SYS_INTERRUPT_MASK),
+			inst(InstructionType_MOV, cnst(REGISTER_R5), reg(REGISTER_R1)),
+			inst(InstructionType_MOV, cnst(REGISTER_SYS32), cnst(0)),
+			sys(SYS_INTERRUPT_MASK),
+			inst(InstructionType_NOP),
+			inst(InstructionType_MUL, cnst(REGISTER_SYS32), reg(REGISTER_R5), cnst(10)),
+			inst(InstructionType_ADD, cnst(REGISTER_SYS32), reg(REGISTER_SYS32), reg(REGISTER_R1)),
+			sys(SYS_EXIT),
+		},
+		inst(InstructionType_MOV, cnst(REGISTER_R1), cnst(1)),
+		inst(InstructionType_IRET),
+	)
+
+	vm := newTestVM()
+	vm.SetProgram(code)
+	for i := 0; i < 4; i++ {
+		if _, err := vm.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	vm.Raise(0)
+	if ret, err := vm.Run(); err != nil || ret != 1 {
+		t.Fatalf("Run() = %d, %v, want delivery after unmasking", ret, err)
+	}
+	if err := vm.WriteCheckpoint(&bytes.Buffer{}); err != ErrCheckpointNotSupported {
+		t.Fatalf("WriteCheckpoint() err = %v, want %v", err, ErrCheckpointNotSupported)
+	}
+}
+
+func TestVM_InterruptConcurrent(t *testing.T) {
+	// The guest spins until the host raises IRQ 0 from another goroutine.
+	code := interruptProgram([]uint64{1, at(16)},
+		[]testInstruction{
+			inst(InstructionType_JE, reg(REGISTER_R1), cnst(at(2))),
+			inst(InstructionType_MOV, cnst(REGISTER_SYS32), reg(REGISTER_R1)),
+			sys(SYS_EXIT),
+		},
+		inst(InstructionType_MOV, cnst(REGISTER_R1), cnst(7)),
+		inst(InstructionType_IRET),
+	)
+
+	vm := newTestVM()
+	vm.SetProgram(code)
+	go vm.Raise(0)
+	if ret, err := runSpinning(t, vm); err != nil || ret != 7 {
+		t.Fatalf("Run() = %d, %v", ret, err)
+	}
+}
+
+func TestVM_InterruptTimer(t *testing.T) {
+	code := interruptProgram([]uint64{6, 0, 0, 0, 0, 0, at(16)},
+		[]testInstruction{
+			inst(InstructionType_MOV, cnst(REGISTER_SYS32), cnst(INTERRUPT_COUNT)),
+			inst(InstructionType_MOV, cnst(REGISTER_SYS33), cnst(1000)),
+			sys(SYS_INTERRUPT_TIMER),
+			inst(InstructionType_MOV, cnst(REGISTER_R6), reg(REGISTER_R4)),
+			inst(InstructionType_MOV, cnst(REGISTER_SYS32), cnst(5)),
+			sys(SYS_INTERRUPT_TIMER),
+			inst(InstructionType_JE, reg(REGISTER_R1), cnst(at(8))),
+			inst(InstructionType_MOV, cnst(REGISTER_SYS32), reg(REGISTER_R1)),
+			sys(SYS_EXIT),
+		},
+		inst(InstructionType_MOV, cnst(REGISTER_R1), cnst(5)),
+		inst(InstructionType_IRET),
+	)
+
+	vm := newTestVM()
+	vm.SetProgram(code)
+	if ret, err := runSpinning(t, vm); err != nil || ret != 5 {
+		t.Fatalf("Run() = %d, %v", ret, err)
+	}
+	if vm.Registers[REGISTER_R6] == 0 {
+		t.Errorf("timer for IRQ %d: errno = 0", INTERRUPT_COUNT)
+	}
+}
+
+func TestVM_InterruptRestore(t *testing.T) {
+	// The guest starts an hour long timer for IRQ 5 and exits.
+	vm := newTestVM(append([]testInstruction{
+		inst(InstructionType_MOV, cnst(REGISTER_SYS32), cnst(5)),
+		inst(InstructionType_MOV, cnst(REGISTER_SYS33), cnst(uint64(time.Hour/time.Microsecond))),
+		sys(SYS_INTERRUPT_TIMER),
+	}, exitInst(0)...)...)
+	s, err := vm.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret, err := vm.Run(); err != nil || ret != 0 {
+		t.Fatalf("Run() = %d, %v", ret, err)
+	}
+	vm.Raise(1)
+	if len(vm.timers) != 1 {
+		t.Fatalf("timers = %d", len(vm.timers))
+	}
+
+	if err := vm.Restore(s); err != nil {
+		t.Fatal(err)
+	}
+	if len(vm.timers) != 0 || vm.PendingInterrupts() != 0 {
+		t.Fatalf("timers = %d, pending %b after Restore", len(vm.timers), vm.PendingInterrupts())
+	}
+}
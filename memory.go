@@ -1,12 +1,78 @@
 package lvm2
 
-import "errors"
+import (
+	"errors"
+	"sort"
+)
+
+// Perm is a set of memory access permissions.
+type Perm uint8
+
+const (
+	PermRead Perm = 1 << iota
+	PermWrite
+	PermExec
+
+	PermNone Perm = 0
+	PermRW        = PermRead | PermWrite
+	PermRX        = PermRead | PermExec
+	PermRWX       = PermRead | PermWrite | PermExec
+)
+
+func (p Perm) String() string {
+	b := []byte("---")
+	if p&PermRead != 0 {
+		b[0] = 'r'
+	}
+	if p&PermWrite != 0 {
+		b[1] = 'w'
+	}
+	if p&PermExec != 0 {
+		b[2] = 'x'
+	}
+	return string(b)
+}
 
 type MemoryBlock struct {
 	Start uint64
 	End   uint64
 
 	Block []byte
+	Perm  Perm
+
+	// Heap is set on blocks handed out by Allocate.
+	Heap bool
+	// Unmapped bytes reserved below Start, released with the block
+	// (see AllocateStack)
+	Guard uint64
+
+	// Block is shared with a clone and copied on write
+	shared bool
+
+	// Shared region mapped by the block, its Block (nil: private memory)
+	region *SharedRegion
+}
+
+// Contains reports whether address is in [Start, End).
+func (b *MemoryBlock) Contains(address uint64) bool {
+	return b.Start <= address && address < b.End
+}
+
+// slice returns the bytes of the block from address up to End.
+// It is empty if address is outside the block or past the backing slice.
+func (b *MemoryBlock) slice(address uint64) []byte {
+	if !b.Contains(address) {
+		return nil
+	}
+	size := b.End - b.Start
+	if size > uint64(len(b.Block)) {
+		size = uint64(len(b.Block))
+	}
+	offset := address - b.Start
+	if offset >= size {
+		return nil
+	}
+	return b.Block[offset:size]
 }
 
 type Memory struct {
@@ -15,64 +81,306 @@ type Memory struct {
 	MemoryHead uint64
 	MaxAddress uint64
 
-	Stack      MemoryBlock
-	Cache      *MemoryBlock
+	// Released heap address space, reused by Allocate
+	FreeList FreeList
+
+	// Resource Limits
+	Config MemoryConfig
+	// Bytes and number of heap blocks in use
+	HeapBytes  uint64
+	HeapBlocks int
+
+	Stack MemoryBlock
+	// Index into Blocks of the last block found by LoadBlockIndex (-1: none)
+	//
+	// The entry is revalidated on every lookup, so a stale index after
+	// Blocks changes can only miss, never resolve to the wrong block.
 	CacheIndex int
 }
 
+// MemoryConfig configures the stack size and heap quotas of a Memory.
+// Zero quotas are unlimited.
+type MemoryConfig struct {
+	// Stack Size (0: DEFAULT_STACK_SIZE)
+	StackSize uint64
+
+	// Maximum total size of heap blocks
+	MaxHeapBytes uint64
+	// Maximum number of heap blocks
+	MaxBlocks int
+	// Maximum size of a single allocation
+	MaxAllocation uint64
+}
+
+const DEFAULT_STACK_SIZE = 1024 * 1024 * 16 // 16MB
+
+func DefaultMemoryConfig() MemoryConfig {
+	return MemoryConfig{
+		StackSize: DEFAULT_STACK_SIZE,
+	}
+}
+
+// MemoryUsage reports the resources used by a Memory.
+type MemoryUsage struct {
+	ProgramBytes uint64
+	HeapBytes    uint64
+	HeapBlocks   int
+	StackBytes   uint64
+	SharedBytes  uint64
+}
+
 func NewMemory() *Memory {
+	return NewMemoryWithConfig(DefaultMemoryConfig())
+}
+
+func NewMemoryWithConfig(config MemoryConfig) *Memory {
 	m := &Memory{}
 
 	m.MaxAddress = 0xFFFFFFFFFFFFFFFF
 
-	// Stack Size = 16MB
-	m.Stack.Block = make([]byte, 1024*1024*16)
+	if config.StackSize == 0 {
+		config.StackSize = DEFAULT_STACK_SIZE
+	}
+	m.Config = config
+
+	m.Stack.Block = make([]byte, config.StackSize)
 	m.Stack.End = m.MaxAddress
 	m.Stack.Start = m.Stack.End - uint64(len(m.Stack.Block))
+	m.Stack.Perm = PermRW
 
 	m.Blocks = make([]MemoryBlock, 0, 32)
+	m.CacheIndex = -1
 
 	return m
 }
 
+func (m *Memory) Usage() MemoryUsage {
+	u := MemoryUsage{
+		HeapBytes:  m.HeapBytes,
+		HeapBlocks: m.HeapBlocks,
+		StackBytes: uint64(len(m.Stack.Block)),
+	}
+	for i := range m.Blocks {
+		switch b := &m.Blocks[i]; {
+		case b.region != nil:
+			u.SharedBytes += uint64(len(b.Block))
+		case !b.Heap:
+			u.ProgramBytes += uint64(len(b.Block))
+		}
+	}
+	return u
+}
+
+// checkQuota reports whether growing the heap by size bytes and blocks blocks
+// stays within the configured quotas.
+func (m *Memory) checkQuota(size uint64, blocks int) error {
+	return m.Config.checkQuota(m.HeapBytes, m.HeapBlocks, size, blocks)
+}
+
+// checkQuota reports whether a heap of heapBytes bytes in heapBlocks blocks
+// can grow by size bytes and blocks blocks.
+func (c *MemoryConfig) checkQuota(heapBytes uint64, heapBlocks int, size uint64, blocks int) error {
+	if c.MaxAllocation != 0 && size > c.MaxAllocation {
+		return ErrNoMemory
+	}
+	if c.MaxHeapBytes != 0 && (heapBytes+size < heapBytes || heapBytes+size > c.MaxHeapBytes) {
+		return ErrNoMemory
+	}
+	if c.MaxBlocks != 0 && heapBlocks+blocks > c.MaxBlocks {
+		return ErrNoMemory
+	}
+	return nil
+}
+
 const PAGE_SIZE = 1 << 12 // 4KB
 
+// STACK_GUARD_SIZE is the size of the unmapped region below the stack.
+// Accesses to it fault with FaultStackOverflow, accesses at or above
+// Stack.End fault with FaultStackUnderflow.
+const STACK_GUARD_SIZE = PAGE_SIZE * 16
+
+// StackTop returns the address one past the top of the stack.
+func (m *Memory) StackTop() uint64 {
+	return m.Stack.End
+}
+
+// StackGuard returns the lowest address of the guard region below the stack.
+func (m *Memory) StackGuard() uint64 {
+	if m.Stack.Start < STACK_GUARD_SIZE {
+		return 0
+	}
+	return m.Stack.Start - STACK_GUARD_SIZE
+}
+
 var (
 	ErrInvalidSize    = errors.New("Invalid Size")
 	ErrNoMemory       = errors.New("No Memory")
 	ErrInvalidAddress = errors.New("Invalid Address")
+	ErrInvalidFree    = errors.New("Invalid Free")
+	ErrDoubleFree     = errors.New("Double Free")
 )
 
-func (m *Memory) Allocate(size uint64) uint64 {
+// Allocations are aligned to WORD_SIZE and reserve a multiple of it.
+func allocationSize(size uint64) uint64 {
+	return alignUp(size, WORD_SIZE)
+}
+
+func (m *Memory) Allocate(size uint64) (uint64, error) {
 	if size == 0 {
-		return m.MemoryHead
+		return m.MemoryHead, nil
+	}
+	err := m.checkQuota(size, 1)
+	if err != nil {
+		return 0, err
+	}
+	return m.allocate(size, 0)
+}
+
+// AllocateStack allocates size bytes like Allocate, above an unmapped
+// guard of STACK_GUARD_SIZE bytes. Free releases the guard too.
+func (m *Memory) AllocateStack(size uint64) (uint64, error) {
+	err := m.checkQuota(size, 1)
+	if err != nil {
+		return 0, err
+	}
+	return m.allocate(size, STACK_GUARD_SIZE)
+}
+
+// allocate allocates size bytes above guard unmapped bytes.
+func (m *Memory) allocate(size, guard uint64) (uint64, error) {
+	reserved := allocationSize(size) + guard
+	if reserved < size {
+		return 0, ErrNoMemory
 	}
 
-	var block MemoryBlock
-	block.Block = make([]byte, size)
-	block.Start = m.MemoryHead
-	block.End = block.Start + size
-	m.MemoryHead += size
-	m.Blocks = append(m.Blocks, block)
+	start, ok := m.FreeList.Alloc(&m.MemoryHead, reserved, m.StackGuard())
+	if !ok {
+		return 0, ErrNoMemory
+	}
 
-	return block.Start
+	start += guard
+	m.insertBlock(MemoryBlock{
+		Start: start,
+		End:   start + size,
+		Block: make([]byte, size),
+		Perm:  PermRW,
+		Heap:  true,
+		Guard: guard,
+	})
+	m.HeapBytes += size
+	m.HeapBlocks++
+	return start, nil
+}
+
+// insertBlock adds block to m.Blocks, keeping it sorted by Start.
+func (m *Memory) insertBlock(block MemoryBlock) {
+	i := sort.Search(len(m.Blocks), func(i int) bool { return m.Blocks[i].Start > block.Start })
+	m.Blocks = append(m.Blocks, MemoryBlock{})
+	copy(m.Blocks[i+1:], m.Blocks[i:])
+	m.Blocks[i] = block
+	m.CacheIndex = -1
+}
+
+// heapBlockIndex returns the index of the heap block starting at start.
+func (m *Memory) heapBlockIndex(start uint64) (int, error) {
+	i := sort.Search(len(m.Blocks), func(i int) bool { return m.Blocks[i].Start >= start })
+	if i < len(m.Blocks) && m.Blocks[i].Start == start && m.Blocks[i].Heap {
+		return i, nil
+	}
+	if m.FreeList.Contains(start) {
+		return -1, ErrDoubleFree
+	}
+	return -1, ErrInvalidFree
 }
 
 func (m *Memory) Free(start uint64) error {
-	_, index, err := m.LoadBlockIndex(start)
+	index, err := m.heapBlockIndex(start)
 	if err != nil {
 		return err
 	}
-	if index == -1 {
-		return ErrInvalidAddress
-	}
 
-	m.Blocks = append(m.Blocks[:index], m.Blocks[index+1:]...)
+	block := m.Blocks[index]
+	copy(m.Blocks[index:], m.Blocks[index+1:])
+	m.Blocks[len(m.Blocks)-1] = MemoryBlock{}
+	m.Blocks = m.Blocks[:len(m.Blocks)-1]
+	m.CacheIndex = -1
+	m.FreeList.Put(block.Start-block.Guard, allocationSize(block.End-block.Start)+block.Guard)
+	m.HeapBytes -= block.End - block.Start
+	m.HeapBlocks--
 	return nil
 }
 
+// Realloc resizes the heap block starting at start and returns its new address.
+// The contents are preserved up to the smaller of the old and new sizes.
+func (m *Memory) Realloc(start uint64, size uint64) (uint64, error) {
+	index, err := m.heapBlockIndex(start)
+	if err != nil {
+		return 0, err
+	}
+	if size == 0 {
+		return 0, ErrInvalidSize
+	}
+
+	block := &m.Blocks[index]
+	oldSize := block.End - block.Start
+	if m.Config.MaxAllocation != 0 && size > m.Config.MaxAllocation {
+		return 0, ErrNoMemory
+	}
+	if size > oldSize {
+		err = m.checkQuota(size-oldSize, 0)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if allocationSize(size) <= allocationSize(oldSize) {
+		// Shrink (or grow within the reserved size) in place.
+		if size <= oldSize {
+			block.Block = block.Block[:size]
+		} else {
+			b := make([]byte, size)
+			copy(b, block.Block)
+			block.Block = b
+		}
+		block.End = block.Start + size
+		m.HeapBytes = m.HeapBytes - oldSize + size
+		m.FreeList.Put(block.Start+allocationSize(size), allocationSize(oldSize)-allocationSize(size))
+		return start, nil
+	}
+
+	data := block.Block
+	perm := block.Perm
+	address, err := m.allocate(size, block.Guard)
+	if err != nil {
+		return 0, err
+	}
+	index, _ = m.heapBlockIndex(address)
+	copy(m.Blocks[index].Block, data)
+	m.Blocks[index].Perm = perm
+
+	err = m.Free(start)
+	if err != nil {
+		return 0, err
+	}
+	return address, nil
+}
+
 var ErrSegmentationFault = errors.New("Segmentation Fault")
 
+// Protect sets the permissions of the block containing address.
+func (m *Memory) Protect(address uint64, perm Perm) error {
+	_, index, err := m.LoadBlockIndex(address)
+	if err != nil {
+		return err
+	}
+	if index == -1 {
+		m.Stack.Perm = perm
+		return nil
+	}
+	m.Blocks[index].Perm = perm
+	return nil
+}
+
 func (m *Memory) LoadBlock(address uint64) (MemoryBlock, error) {
 	block, _, err := m.LoadBlockIndex(address)
 	return block, err
@@ -80,29 +388,29 @@ func (m *Memory) LoadBlock(address uint64) (MemoryBlock, error) {
 
 func (m *Memory) LoadBlockIndex(address uint64) (MemoryBlock, int, error) {
 	// Check if we have a cache
-	if m.Cache != nil && m.Cache.Start <= address && m.Cache.End >= address {
-		return *m.Cache, m.CacheIndex, nil
+	if i := m.CacheIndex; i >= 0 && i < len(m.Blocks) && m.Blocks[i].Contains(address) {
+		return m.Blocks[i], i, nil
 	}
 
 	// Check if address is in stack
-	if address >= m.Stack.Start && address < m.Stack.End {
+	if m.Stack.Contains(address) {
 		return m.Stack, -1, nil
 	}
 
+	// Check if address is in a stack guard region
+	if address >= m.StackGuard() && address < m.Stack.Start {
+		return MemoryBlock{}, -1, &Fault{Kind: FaultStackOverflow, Address: address}
+	}
+	if address >= m.Stack.End {
+		return MemoryBlock{}, -1, &Fault{Kind: FaultStackUnderflow, Address: address}
+	}
+
 	// Check if address is in memory (binary search)
 	low := 0
 	high := len(m.Blocks) - 1
-	// for i := range m.Blocks {
-	// 	if m.Blocks[i].Start <= address && m.Blocks[i].End >= address {
-	// 		m.Cache = &m.Blocks[i]
-	// 		m.CacheIndex = i
-	// 		return m.Blocks[i], i, nil
-	// 	}
-	// }
 	for low <= high {
 		mid := (low + high) / 2
-		if m.Blocks[mid].Start <= address && m.Blocks[mid].End >= address {
-			m.Cache = &m.Blocks[mid]
+		if m.Blocks[mid].Contains(address) {
 			m.CacheIndex = mid
 			return m.Blocks[mid], mid, nil
 		} else if m.Blocks[mid].Start > address {
@@ -112,97 +420,196 @@ func (m *Memory) LoadBlockIndex(address uint64) (MemoryBlock, int, error) {
 		}
 	}
 
-	return MemoryBlock{}, -1, ErrSegmentationFault
+	return MemoryBlock{}, -1, &Fault{Kind: FaultSegmentation, Address: address}
 }
 
 func (m *Memory) ReadAt(address uint64, p []byte) (int, error) {
+	return m.readAt(address, p, PermRead)
+}
+
+// Fetch reads an instruction at address. The memory must be executable.
+func (m *Memory) Fetch(address uint64, p []byte) (int, error) {
+	return m.readAt(address, p, PermExec)
+}
+
+func (m *Memory) readAt(address uint64, p []byte, perm Perm) (int, error) {
 	var read int
-	for {
+	for len(p) > 0 {
 		block, err := m.LoadBlock(address)
 		if err != nil {
 			return 0, err
 		}
+		if block.Perm&perm != perm {
+			return 0, &Fault{Kind: FaultProtection, Address: address, Access: perm}
+		}
+		b := block.slice(address)
+		if len(b) == 0 {
+			return 0, &Fault{Kind: FaultSegmentation, Address: address}
+		}
 
-		offset := address - block.Start
-		n := copy(p, block.Block[offset:])
+		block.region.lock(perm)
+		n := copy(p, b)
+		block.region.unlock(perm)
 		read += n
 		p = p[n:]
 		address += uint64(n)
-
-		if len(p) == 0 || n == 0 {
-			return read, nil
-		}
 	}
+	return read, nil
 }
 
+// WriteAt writes p to memory at address. Blocks are written in order,
+// so a fault leaves the bytes before the faulting address written.
 func (m *Memory) WriteAt(address uint64, p []byte) (int, error) {
 	var written int
-	for {
-		block, err := m.LoadBlock(address)
+	for len(p) > 0 {
+		block, index, err := m.LoadBlockIndex(address)
 		if err != nil {
 			return 0, err
 		}
+		if block.Perm&PermWrite == 0 {
+			return 0, &Fault{Kind: FaultProtection, Address: address, Access: PermWrite}
+		}
+		if block.shared {
+			block = m.unshare(index)
+		}
+		b := block.slice(address)
+		if len(b) == 0 {
+			return 0, &Fault{Kind: FaultSegmentation, Address: address}
+		}
 
-		offset := address - block.Start
-		n := copy(block.Block[offset:], p)
+		block.region.lock(PermWrite)
+		n := copy(b, p)
+		block.region.unlock(PermWrite)
 		written += n
 		p = p[n:]
 		address += uint64(n)
-
-		if len(p) == 0 || n == 0 {
-			return written, nil
-		}
 	}
+	return written, nil
 }
 
-func (m *Memory) GetMemoryFunc(address uint64, size uint64, iterf func(addr uint64, b []byte) error) error {
+// GetMemoryFunc calls iterf with the memory in [address, address+size),
+// one block at a time. perm is the access iterf needs.
+func (m *Memory) GetMemoryFunc(address uint64, size uint64, perm Perm, iterf func(addr uint64, b []byte) error) error {
 	var r uint64 = size
-	for {
-		block, err := m.LoadBlock(address)
+	for r > 0 {
+		block, index, err := m.LoadBlockIndex(address)
 		if err != nil {
 			return err
 		}
+		if block.Perm&perm != perm {
+			return &Fault{Kind: FaultProtection, Address: address, Access: perm}
+		}
+		if block.shared && perm&PermWrite != 0 {
+			block = m.unshare(index)
+		}
+		b := block.slice(address)
+		if len(b) == 0 {
+			return &Fault{Kind: FaultSegmentation, Address: address}
+		}
 
-		offset := address - block.Start
-		b := block.Block[offset:]
-		if r > uint64(len(b)) {
-			err = iterf(address, b)
-		} else {
+		if r < uint64(len(b)) {
 			b = b[:r]
-			err = iterf(address, b)
 		}
-
+		err = block.region.iterate(address, b, perm, iterf)
 		if err != nil {
 			return err
 		}
 
 		r -= uint64(len(b))
 		address += uint64(len(b))
-
-		if r == 0 {
-			return nil
-		}
 	}
+	return nil
 }
 
 func (m *Memory) SetProgram(p []byte) {
 	m.MemoryHead = uint64(len(p))
-	m.Blocks = append(m.Blocks, MemoryBlock{
+	m.insertBlock(MemoryBlock{
 		Start: 0,
 		End:   uint64(len(p)),
 		Block: p,
+		Perm:  PermRX,
 	})
 }
 
+// SetProgramData maps text read-execute at address 0 and a copy of data
+// read-write at DataAddress(len(text)).
+func (m *Memory) SetProgramData(text, data []byte) {
+	m.SetProgram(text)
+	if len(data) == 0 {
+		return
+	}
+	start := DataAddress(uint64(len(text)))
+	m.MemoryHead = start + uint64(len(data))
+	m.insertBlock(MemoryBlock{
+		Start: start,
+		End:   m.MemoryHead,
+		Block: append([]byte(nil), data...),
+		Perm:  PermRW,
+	})
+}
+
+// DataAddress returns the address the data of a program with textSize
+// bytes of text is mapped at: the next page boundary, so text and data
+// never share a page.
+func DataAddress(textSize uint64) uint64 {
+	return alignUp(textSize, PAGE_SIZE)
+}
+
 func (m *Memory) Reset() {
 	for i := range m.Blocks {
 		m.Blocks[i] = MemoryBlock{}
 	}
 	m.Blocks = m.Blocks[:0]
-	m.Cache = nil
-	m.CacheIndex = 0
+	m.CacheIndex = -1
 	m.MemoryHead = 0
-	for i := range m.Stack.Block {
-		m.Stack.Block[i] = 0
+	m.FreeList = m.FreeList[:0]
+	m.HeapBytes = 0
+	m.HeapBlocks = 0
+	if m.Stack.shared {
+		m.Stack.Block = make([]byte, len(m.Stack.Block))
+		m.Stack.shared = false
+	} else {
+		for i := range m.Stack.Block {
+			m.Stack.Block[i] = 0
+		}
+	}
+}
+
+// unshare gives the block at index (-1: stack) its own copy of contents
+// shared with a clone, and returns it.
+func (m *Memory) unshare(index int) MemoryBlock {
+	block := &m.Stack
+	if index != -1 {
+		block = &m.Blocks[index]
+	}
+	b := make([]byte, len(block.Block))
+	copy(b, block.Block)
+	block.Block = b
+	block.shared = false
+	return *block
+}
+
+// Clone returns a copy of m. Block contents are shared with m until
+// either side writes to them. Shared regions stay mapped into both.
+//
+// The first write to a shared block copies all of it, including the
+// stack, which is one block of StackSize bytes. PagedMemory.Clone copies
+// single pages instead.
+func (m *Memory) Clone() VMMemory {
+	c := *m
+	c.Blocks = make([]MemoryBlock, len(m.Blocks), cap(m.Blocks))
+	for i := range m.Blocks {
+		// Only write when needed, so cloning a snapshot is read-only.
+		if !m.Blocks[i].shared && m.Blocks[i].region == nil {
+			m.Blocks[i].shared = true
+		}
+	}
+	copy(c.Blocks, m.Blocks)
+	if !m.Stack.shared {
+		m.Stack.shared = true
 	}
+	c.Stack.shared = true
+	c.FreeList = append(FreeList(nil), m.FreeList...)
+	c.CacheIndex = -1
+	return &c
 }
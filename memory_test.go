@@ -1,6 +1,8 @@
 package lvm2
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"testing"
 )
@@ -9,17 +11,19 @@ func TestMemory_GetMemoryFunc(t *testing.T) {
 	m := NewMemory()
 	m.Blocks = append(m.Blocks, MemoryBlock{
 		Start: 0,
-		End:   9,
+		End:   10,
 		Block: []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9},
+		Perm:  PermRW,
 	})
 	m.Blocks = append(m.Blocks, MemoryBlock{
 		Start: 10,
-		End:   19,
+		End:   20,
 		Block: []byte{10, 11, 12, 13, 14, 15, 16, 17, 18, 19},
+		Perm:  PermRW,
 	})
 
 	var data []byte
-	m.GetMemoryFunc(0, 15, func(addr uint64, b []byte) error {
+	m.GetMemoryFunc(0, 15, PermRead, func(addr uint64, b []byte) error {
 		fmt.Printf("addr: %d, b: %v\n", addr, b)
 		data = append(data, b...)
 		return nil
@@ -30,3 +34,336 @@ func TestMemory_GetMemoryFunc(t *testing.T) {
 		t.Error("data error")
 	}
 }
+
+func TestMemory_AllocateReuse(t *testing.T) {
+	m := NewMemory()
+	m.SetProgram(make([]byte, 3))
+
+	a, _ := m.Allocate(10)
+	b, _ := m.Allocate(16)
+	c, _ := m.Allocate(8)
+	if a != 8 || b != 24 || c != 40 {
+		t.Fatalf("a = %d, b = %d, c = %d", a, b, c)
+	}
+
+	if err := m.Free(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Free(b); err != ErrDoubleFree {
+		t.Fatalf("double free: err = %v", err)
+	}
+	if err := m.Free(a + 1); err != ErrInvalidFree {
+		t.Fatalf("invalid free: err = %v", err)
+	}
+	if err := m.Free(0); err != ErrInvalidFree {
+		t.Fatalf("program free: err = %v", err)
+	}
+
+	// Best fit reuses the hole left by b.
+	d, _ := m.Allocate(12)
+	if d != b {
+		t.Fatalf("d = %d, want %d", d, b)
+	}
+
+	// Freeing everything coalesces the holes.
+	for _, p := range []uint64{a, c, d} {
+		if err := m.Free(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(m.FreeList) != 1 || m.FreeList[0] != (FreeRange{Start: 8, Size: 40}) {
+		t.Fatalf("free list = %v", m.FreeList)
+	}
+	if len(m.Blocks) != 1 {
+		t.Fatalf("blocks = %d, want 1", len(m.Blocks))
+	}
+
+	// A large allocation extends the released range at the head.
+	e, _ := m.Allocate(64)
+	if e != 8 || m.MemoryHead != 72 || len(m.FreeList) != 0 {
+		t.Fatalf("e = %d, head = %d, free list = %v", e, m.MemoryHead, m.FreeList)
+	}
+}
+
+func TestMemory_Realloc(t *testing.T) {
+	m := NewMemory()
+	a, _ := m.Allocate(4)
+	m.WriteAt(a, []byte{1, 2, 3, 4})
+
+	// Grow within the reserved size keeps the address.
+	a2, err := m.Realloc(a, 8)
+	if err != nil || a2 != a {
+		t.Fatalf("Realloc() = %d, %v", a2, err)
+	}
+
+	// Growing past it moves the block and keeps the contents.
+	a3, err := m.Realloc(a, 32)
+	if err != nil || a3 == a {
+		t.Fatalf("Realloc() = %d, %v", a3, err)
+	}
+	var buf [8]byte
+	if _, err := m.ReadAt(a3, buf[:]); err != nil {
+		t.Fatal(err)
+	}
+	if buf != [8]byte{1, 2, 3, 4} {
+		t.Fatalf("contents = %v", buf)
+	}
+	if _, err := m.ReadAt(a, buf[:1]); err == nil {
+		t.Fatal("old block still mapped")
+	}
+	if _, err := m.Realloc(a, 8); err != ErrDoubleFree {
+		t.Fatalf("realloc of freed block: err = %v", err)
+	}
+}
+
+func TestMemory_AllocateLimit(t *testing.T) {
+	m := NewMemory()
+	if _, err := m.Allocate(m.Stack.Start + 1); err != ErrNoMemory {
+		t.Fatalf("err = %v, want ErrNoMemory", err)
+	}
+	if _, err := m.Allocate(^uint64(0)); err != ErrNoMemory {
+		t.Fatalf("err = %v, want ErrNoMemory", err)
+	}
+}
+
+func TestMemory_Quota(t *testing.T) {
+	m := NewMemoryWithConfig(MemoryConfig{
+		StackSize:     PAGE_SIZE,
+		MaxHeapBytes:  100,
+		MaxBlocks:     3,
+		MaxAllocation: 60,
+	})
+	if m.Stack.End-m.Stack.Start != PAGE_SIZE {
+		t.Fatalf("stack size = %d", m.Stack.End-m.Stack.Start)
+	}
+
+	if _, err := m.Allocate(61); err != ErrNoMemory {
+		t.Fatalf("max allocation: err = %v", err)
+	}
+	a, err := m.Allocate(60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Allocate(41); err != ErrNoMemory {
+		t.Fatalf("max heap bytes: err = %v", err)
+	}
+	b, _ := m.Allocate(20)
+	m.Allocate(10)
+	if _, err := m.Allocate(1); err != ErrNoMemory {
+		t.Fatalf("max blocks: err = %v", err)
+	}
+	if _, err := m.Realloc(b, 31); err != ErrNoMemory {
+		t.Fatalf("realloc past max heap bytes: err = %v", err)
+	}
+
+	u := m.Usage()
+	if u.HeapBytes != 90 || u.HeapBlocks != 3 || u.StackBytes != PAGE_SIZE {
+		t.Fatalf("usage = %+v", u)
+	}
+
+	m.Free(a)
+	if _, err := m.Realloc(b, 60); err != nil {
+		t.Fatal(err)
+	}
+	if u := m.Usage(); u.HeapBytes != 70 || u.HeapBlocks != 2 {
+		t.Fatalf("usage = %+v", u)
+	}
+}
+
+// newTestMemory maps [0, 10) [10, 20) and [32, 40) read-write,
+// leaving a gap at [20, 32).
+func newTestMemory() *Memory {
+	m := NewMemoryWithConfig(MemoryConfig{StackSize: PAGE_SIZE})
+	for _, r := range [][2]uint64{{0, 10}, {10, 20}, {32, 40}} {
+		b := make([]byte, r[1]-r[0])
+		for i := range b {
+			b[i] = byte(r[0]) + byte(i)
+		}
+		m.insertBlock(MemoryBlock{Start: r[0], End: r[1], Block: b, Perm: PermRW})
+	}
+	m.MemoryHead = 40
+	return m
+}
+
+func segfaultAt(err error) (uint64, bool) {
+	var f *Fault
+	if !errors.As(err, &f) || f.Kind != FaultSegmentation {
+		return 0, false
+	}
+	return f.Address, true
+}
+
+func TestMemory_BlockBoundaries(t *testing.T) {
+	m := newTestMemory()
+
+	// One past the end of a block is not part of it.
+	for _, addr := range []uint64{20, 31, 40} {
+		_, err := m.ReadAt(addr, make([]byte, 1))
+		if a, ok := segfaultAt(err); !ok || a != addr {
+			t.Fatalf("ReadAt(%d): err = %v", addr, err)
+		}
+	}
+
+	// Reads and writes span adjacent blocks.
+	buf := make([]byte, 10)
+	if n, err := m.ReadAt(5, buf); err != nil || n != 10 {
+		t.Fatalf("ReadAt() = %d, %v", n, err)
+	}
+	if !bytes.Equal(buf, []byte{5, 6, 7, 8, 9, 10, 11, 12, 13, 14}) {
+		t.Fatalf("buf = %v", buf)
+	}
+	if n, err := m.WriteAt(8, []byte{0xA, 0xB, 0xC, 0xD}); err != nil || n != 4 {
+		t.Fatalf("WriteAt() = %d, %v", n, err)
+	}
+	m.ReadAt(8, buf[:4])
+	if !bytes.Equal(buf[:4], []byte{0xA, 0xB, 0xC, 0xD}) {
+		t.Fatalf("buf = %v", buf[:4])
+	}
+
+	// Ranges running into the gap fault at its first address.
+	_, err := m.ReadAt(15, buf)
+	if a, ok := segfaultAt(err); !ok || a != 20 {
+		t.Fatalf("ReadAt(15): err = %v", err)
+	}
+	err = m.GetMemoryFunc(15, 10, PermRead, func(addr uint64, b []byte) error { return nil })
+	if a, ok := segfaultAt(err); !ok || a != 20 {
+		t.Fatalf("GetMemoryFunc(15): err = %v", err)
+	}
+
+	// Empty ranges touch nothing.
+	if n, err := m.ReadAt(25, nil); err != nil || n != 0 {
+		t.Fatalf("ReadAt(nil) = %d, %v", n, err)
+	}
+	err = m.GetMemoryFunc(25, 0, PermRead, func(addr uint64, b []byte) error {
+		t.Fatal("iterf called for an empty range")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A block shorter than its range faults instead of copying nothing.
+	m.insertBlock(MemoryBlock{Start: 48, End: 56, Block: make([]byte, 4), Perm: PermRW})
+	_, err = m.WriteAt(50, make([]byte, 4))
+	if a, ok := segfaultAt(err); !ok || a != 52 {
+		t.Fatalf("WriteAt(50): err = %v", err)
+	}
+}
+
+func TestMemory_CacheInvalidation(t *testing.T) {
+	m := NewMemory()
+	a, _ := m.Allocate(8)
+	b, _ := m.Allocate(8)
+	m.WriteAt(b, []byte{1, 2, 3, 4, 5, 6, 7, 8})
+
+	// Cache b, then shift it down by freeing a.
+	var buf [8]byte
+	m.ReadAt(b, buf[:])
+	if err := m.Free(a); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.ReadAt(b, buf[:]); err != nil || buf != [8]byte{1, 2, 3, 4, 5, 6, 7, 8} {
+		t.Fatalf("ReadAt(b) = %v, %v", buf, err)
+	}
+	if _, err := m.ReadAt(a, buf[:]); err == nil {
+		t.Fatal("freed block still mapped")
+	}
+
+	// Cache b, free it and reuse its range.
+	m.ReadAt(b, buf[:])
+	m.Free(b)
+	if _, err := m.ReadAt(b, buf[:]); err == nil {
+		t.Fatal("freed block still mapped")
+	}
+	c, _ := m.Allocate(16)
+	if c != a {
+		t.Fatalf("c = %d, want %d", c, a)
+	}
+	var big [16]byte
+	if _, err := m.ReadAt(c, big[:]); err != nil || big != [16]byte{} {
+		t.Fatalf("ReadAt(c) = %v, %v", big, err)
+	}
+}
+
+// FuzzMemory runs random reads, writes, allocations and frees against
+// a byte-map model of the address space.
+func FuzzMemory(f *testing.F) {
+	f.Add([]byte{0, 5, 10, 1, 15, 10, 2, 30, 0, 0, 8, 4})
+	f.Add([]byte{2, 16, 0, 2, 16, 0, 3, 0, 0, 1, 40, 40, 0, 30, 40})
+	f.Add([]byte{1, 19, 2, 0, 39, 2, 2, 1, 0, 3, 1, 0, 2, 7, 0, 0, 60, 20})
+
+	f.Fuzz(func(t *testing.T, ops []byte) {
+		m := newTestMemory()
+		model := map[uint64]byte{}
+		for _, b := range m.Blocks {
+			for i, v := range b.Block {
+				model[b.Start+uint64(i)] = v
+			}
+		}
+		var allocs []uint64
+		sizes := map[uint64]uint64{}
+
+		for ; len(ops) >= 3; ops = ops[3:] {
+			op, addr, n := ops[0]%4, uint64(ops[1]), uint64(ops[2]%48)
+			switch op {
+			case 0:
+				buf := make([]byte, n)
+				_, err := m.ReadAt(addr, buf)
+				for i := uint64(0); i < n; i++ {
+					v, ok := model[addr+i]
+					if !ok {
+						if a, fault := segfaultAt(err); !fault || a != addr+i {
+							t.Fatalf("ReadAt(%d, %d): err = %v, want fault at %d", addr, n, err, addr+i)
+						}
+						break
+					}
+					if err == nil && buf[i] != v {
+						t.Fatalf("ReadAt(%d, %d): [%d] = %d, want %d", addr, n, i, buf[i], v)
+					}
+				}
+			case 1:
+				buf := bytes.Repeat([]byte{byte(addr) ^ 0x5A}, int(n))
+				_, err := m.WriteAt(addr, buf)
+				for i := uint64(0); i < n; i++ {
+					if _, ok := model[addr+i]; !ok {
+						if a, fault := segfaultAt(err); !fault || a != addr+i {
+							t.Fatalf("WriteAt(%d, %d): err = %v, want fault at %d", addr, n, err, addr+i)
+						}
+						break
+					}
+					model[addr+i] = buf[i]
+				}
+			case 2:
+				if n == 0 {
+					continue
+				}
+				p, err := m.Allocate(n)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for i := uint64(0); i < n; i++ {
+					if _, ok := model[p+i]; ok {
+						t.Fatalf("Allocate(%d) = %d overlaps mapped memory", n, p)
+					}
+					model[p+i] = 0
+				}
+				allocs = append(allocs, p)
+				sizes[p] = n
+			case 3:
+				if len(allocs) == 0 {
+					continue
+				}
+				i := int(addr) % len(allocs)
+				p := allocs[i]
+				if err := m.Free(p); err != nil {
+					t.Fatal(err)
+				}
+				for j := uint64(0); j < sizes[p]; j++ {
+					delete(model, p+j)
+				}
+				allocs = append(allocs[:i], allocs[i+1:]...)
+				delete(sizes, p)
+			}
+		}
+	})
+}
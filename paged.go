@@ -0,0 +1,577 @@
+package lvm2
+
+import "sort"
+
+// Page is a PAGE_SIZE page of a PagedMemory.
+type Page struct {
+	// Page contents (nil: not written yet, reads as zero)
+	Data *[PAGE_SIZE]byte
+	Perm Perm
+
+	// Data is shared with a clone and copied on write
+	shared bool
+
+	// Shared region Data belongs to (nil: private memory)
+	region *SharedRegion
+}
+
+// writable returns the page contents for writing. They are allocated on
+// first write and copied if shared with a clone.
+func (p *Page) writable() *[PAGE_SIZE]byte {
+	if p.Data == nil {
+		p.Data = new([PAGE_SIZE]byte)
+	} else if p.shared {
+		data := new([PAGE_SIZE]byte)
+		*data = *p.Data
+		p.Data = data
+	}
+	p.shared = false
+	return p.Data
+}
+
+// zeroPage is passed to read-only accesses of pages without contents.
+// It is never written.
+var zeroPage [PAGE_SIZE]byte
+
+// PAGED_TLB_SIZE is the number of recently used pages a PagedMemory
+// remembers, so loops touching a few pages skip the page table lookup.
+const PAGED_TLB_SIZE = 8
+
+type tlbEntry struct {
+	Number uint64
+	Page   *Page
+}
+
+// PagedMemory is a VMMemory backed by a sparse page table of PAGE_SIZE pages.
+//
+// Program pages are mapped by SetProgram. Heap allocations are kept as
+// address ranges: their pages, like stack pages, are mapped on first
+// access, and contents are allocated on first write. Permissions are
+// per page.
+type PagedMemory struct {
+	// Page Table (page number -> page)
+	Pages map[uint64]*Page
+
+	MemoryHead uint64
+
+	// Released heap address space, reused by Allocate
+	FreeList FreeList
+	// Heap Allocations (start -> size)
+	Allocations map[uint64]uint64
+	// Starts of the heap allocations, sorted
+	starts []uint64
+	// Unmapped bytes reserved below allocations (start -> size, see
+	// AllocateStack)
+	guards map[uint64]uint64
+
+	// Resource Limits
+	Config MemoryConfig
+	// Bytes and number of heap allocations in use
+	HeapBytes    uint64
+	HeapBlocks   int
+	ProgramBytes uint64
+
+	// Stack [StackStart, StackEnd), page aligned.
+	// Stack pages are mapped read-write on first access.
+	StackStart uint64
+	StackEnd   uint64
+
+	// Shared Regions (start -> region)
+	Mappings map[uint64]*SharedRegion
+
+	tlb [PAGED_TLB_SIZE]tlbEntry
+}
+
+func NewPagedMemory() *PagedMemory {
+	return NewPagedMemoryWithConfig(DefaultMemoryConfig())
+}
+
+// NewPagedMemoryWithConfig returns an empty PagedMemory.
+// The stack size is rounded up to a multiple of PAGE_SIZE.
+func NewPagedMemoryWithConfig(config MemoryConfig) *PagedMemory {
+	m := &PagedMemory{
+		Pages:       make(map[uint64]*Page),
+		Allocations: make(map[uint64]uint64),
+		Mappings:    make(map[uint64]*SharedRegion),
+	}
+
+	if config.StackSize == 0 {
+		config.StackSize = DEFAULT_STACK_SIZE
+	}
+	config.StackSize = alignUp(config.StackSize, PAGE_SIZE)
+	m.Config = config
+
+	m.StackEnd = 0xFFFFFFFFFFFFFFFF &^ (PAGE_SIZE - 1)
+	m.StackStart = m.StackEnd - config.StackSize
+
+	return m
+}
+
+// StackTop returns the address one past the top of the stack.
+func (m *PagedMemory) StackTop() uint64 {
+	return m.StackEnd
+}
+
+// StackGuard returns the lowest address of the guard region below the stack.
+func (m *PagedMemory) StackGuard() uint64 {
+	if m.StackStart < STACK_GUARD_SIZE {
+		return 0
+	}
+	return m.StackStart - STACK_GUARD_SIZE
+}
+
+func (m *PagedMemory) Usage() MemoryUsage {
+	u := MemoryUsage{
+		ProgramBytes: m.ProgramBytes,
+		HeapBytes:    m.HeapBytes,
+		HeapBlocks:   m.HeapBlocks,
+		StackBytes:   m.StackEnd - m.StackStart,
+	}
+	for _, r := range m.Mappings {
+		u.SharedBytes += r.Size()
+	}
+	return u
+}
+
+// pageAt returns the page containing address.
+func (m *PagedMemory) pageAt(address uint64) (*Page, error) {
+	number := address / PAGE_SIZE
+	e := &m.tlb[number%PAGED_TLB_SIZE]
+	if e.Page != nil && e.Number == number {
+		return e.Page, nil
+	}
+
+	p := m.Pages[number]
+	if p == nil {
+		switch {
+		case address >= m.StackStart && address < m.StackEnd, m.allocated(number):
+			p = &Page{Perm: PermRW}
+			m.Pages[number] = p
+		case address >= m.StackGuard() && address < m.StackStart:
+			return nil, &Fault{Kind: FaultStackOverflow, Address: address}
+		case address >= m.StackEnd:
+			return nil, &Fault{Kind: FaultStackUnderflow, Address: address}
+		default:
+			return nil, &Fault{Kind: FaultSegmentation, Address: address}
+		}
+	}
+
+	e.Number = number
+	e.Page = p
+	return p, nil
+}
+
+// flushTLB forgets cached pages. It must be called when pages are unmapped.
+func (m *PagedMemory) flushTLB() {
+	m.tlb = [PAGED_TLB_SIZE]tlbEntry{}
+}
+
+// allocated reports whether a heap allocation overlaps page number n.
+func (m *PagedMemory) allocated(n uint64) bool {
+	last := n*PAGE_SIZE + PAGE_SIZE - 1
+	i := sort.Search(len(m.starts), func(i int) bool { return m.starts[i] > last })
+	if i == 0 {
+		return false
+	}
+	start := m.starts[i-1]
+	return start+m.Allocations[start] > n*PAGE_SIZE
+}
+
+// mappedPages returns the numbers of the mapped pages overlapping
+// [start, start+size). Large ranges are not walked page by page.
+func (m *PagedMemory) mappedPages(start, size uint64) []uint64 {
+	if size == 0 {
+		return nil
+	}
+	first, last := start/PAGE_SIZE, (start+size-1)/PAGE_SIZE
+	var numbers []uint64
+	if last-first < uint64(len(m.Pages)) {
+		for n := first; n <= last; n++ {
+			if m.Pages[n] != nil {
+				numbers = append(numbers, n)
+			}
+		}
+		return numbers
+	}
+	for n := range m.Pages {
+		if n >= first && n <= last {
+			numbers = append(numbers, n)
+		}
+	}
+	return numbers
+}
+
+// release unmaps the pages overlapping [start, start+size) that no heap
+// allocation overlaps anymore.
+func (m *PagedMemory) release(start, size uint64) {
+	for _, n := range m.mappedPages(start, size) {
+		if !m.allocated(n) {
+			delete(m.Pages, n)
+		}
+	}
+	m.flushTLB()
+}
+
+// zeroRange clears [start, start+size) in pages that have contents.
+func (m *PagedMemory) zeroRange(start, size uint64) {
+	for _, n := range m.mappedPages(start, size) {
+		p := m.Pages[n]
+		if p.Data == nil {
+			continue
+		}
+		lo, hi := n*PAGE_SIZE, n*PAGE_SIZE+PAGE_SIZE
+		if lo < start {
+			lo = start
+		}
+		if hi > start+size {
+			hi = start + size
+		}
+		b := p.writable()[lo%PAGE_SIZE : lo%PAGE_SIZE+(hi-lo)]
+		for i := range b {
+			b[i] = 0
+		}
+	}
+}
+
+func (m *PagedMemory) Allocate(size uint64) (uint64, error) {
+	if size == 0 {
+		return m.MemoryHead, nil
+	}
+	err := m.Config.checkQuota(m.HeapBytes, m.HeapBlocks, size, 1)
+	if err != nil {
+		return 0, err
+	}
+	return m.allocate(size, 0)
+}
+
+// AllocateStack allocates size bytes like Allocate, above an unmapped
+// guard of STACK_GUARD_SIZE bytes. Free releases the guard too.
+func (m *PagedMemory) AllocateStack(size uint64) (uint64, error) {
+	err := m.Config.checkQuota(m.HeapBytes, m.HeapBlocks, size, 1)
+	if err != nil {
+		return 0, err
+	}
+	return m.allocate(size, STACK_GUARD_SIZE)
+}
+
+// allocate allocates size bytes above guard unmapped bytes.
+func (m *PagedMemory) allocate(size, guard uint64) (uint64, error) {
+	reserved := allocationSize(size) + guard
+	if reserved < size {
+		return 0, ErrNoMemory
+	}
+
+	start, ok := m.FreeList.Alloc(&m.MemoryHead, reserved, m.StackGuard())
+	if !ok {
+		return 0, ErrNoMemory
+	}
+
+	start += guard
+	if guard != 0 {
+		if m.guards == nil {
+			m.guards = make(map[uint64]uint64)
+		}
+		m.guards[start] = guard
+	}
+	m.zeroRange(start, size)
+	m.Allocations[start] = size
+	i := sort.Search(len(m.starts), func(i int) bool { return m.starts[i] > start })
+	m.starts = append(m.starts, 0)
+	copy(m.starts[i+1:], m.starts[i:])
+	m.starts[i] = start
+	m.HeapBytes += size
+	m.HeapBlocks++
+	return start, nil
+}
+
+// allocationError returns the error for freeing start, which is not allocated.
+func (m *PagedMemory) allocationError(start uint64) error {
+	if m.FreeList.Contains(start) {
+		return ErrDoubleFree
+	}
+	return ErrInvalidFree
+}
+
+func (m *PagedMemory) Free(start uint64) error {
+	size, ok := m.Allocations[start]
+	if !ok {
+		return m.allocationError(start)
+	}
+
+	delete(m.Allocations, start)
+	i := sort.Search(len(m.starts), func(i int) bool { return m.starts[i] >= start })
+	m.starts = append(m.starts[:i], m.starts[i+1:]...)
+	m.release(start, size)
+	guard := m.guards[start]
+	delete(m.guards, start)
+	m.FreeList.Put(start-guard, allocationSize(size)+guard)
+	m.HeapBytes -= size
+	m.HeapBlocks--
+	return nil
+}
+
+// Realloc resizes the allocation starting at start and returns its new address.
+// Moved allocations keep the permissions of their pages.
+func (m *PagedMemory) Realloc(start uint64, size uint64) (uint64, error) {
+	oldSize, ok := m.Allocations[start]
+	if !ok {
+		return 0, m.allocationError(start)
+	}
+	if size == 0 {
+		return 0, ErrInvalidSize
+	}
+	if m.Config.MaxAllocation != 0 && size > m.Config.MaxAllocation {
+		return 0, ErrNoMemory
+	}
+	if size > oldSize {
+		err := m.Config.checkQuota(m.HeapBytes, m.HeapBlocks, size-oldSize, 0)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if allocationSize(size) <= allocationSize(oldSize) {
+		// Shrink (or grow within the reserved size) in place.
+		m.Allocations[start] = size
+		if size > oldSize {
+			m.zeroRange(start+oldSize, size-oldSize)
+		} else {
+			m.release(start+size, oldSize-size)
+		}
+		m.HeapBytes = m.HeapBytes - oldSize + size
+		m.FreeList.Put(start+allocationSize(size), allocationSize(oldSize)-allocationSize(size))
+		return start, nil
+	}
+
+	address, err := m.allocate(size, m.guards[start])
+	if err != nil {
+		return 0, err
+	}
+	// Untouched pages read as zero and keep the default permissions,
+	// copy the contents of the others. Permissions are copied only between
+	// pages the allocation owns whole; shared pages belong to neighbours too.
+	for _, n := range m.mappedPages(start, oldSize) {
+		p := m.Pages[n]
+		lo, hi := n*PAGE_SIZE, n*PAGE_SIZE+PAGE_SIZE
+		if lo < start {
+			lo = start
+		}
+		if hi > start+oldSize {
+			hi = start + oldSize
+		}
+		if p.Data != nil {
+			m.writeAt(address+lo-start, p.Data[lo%PAGE_SIZE:lo%PAGE_SIZE+(hi-lo)], PermNone)
+		}
+		if lo%PAGE_SIZE != 0 || hi-lo != PAGE_SIZE {
+			continue
+		}
+		for a := address + lo - start; a < address+hi-start; a = a - a%PAGE_SIZE + PAGE_SIZE {
+			if page := a - a%PAGE_SIZE; page >= address && page+PAGE_SIZE <= address+size {
+				m.Protect(a, p.Perm)
+			}
+		}
+	}
+
+	err = m.Free(start)
+	if err != nil {
+		return 0, err
+	}
+	return address, nil
+}
+
+// Protect sets the permissions of the page containing address.
+func (m *PagedMemory) Protect(address uint64, perm Perm) error {
+	p, err := m.pageAt(address)
+	if err != nil {
+		return err
+	}
+	p.Perm = perm
+	return nil
+}
+
+func (m *PagedMemory) ReadAt(address uint64, p []byte) (int, error) {
+	return m.readAt(address, p, PermRead)
+}
+
+// Fetch reads an instruction at address. The memory must be executable.
+func (m *PagedMemory) Fetch(address uint64, p []byte) (int, error) {
+	return m.readAt(address, p, PermExec)
+}
+
+func (m *PagedMemory) readAt(address uint64, p []byte, perm Perm) (int, error) {
+	var read int
+	for len(p) > 0 {
+		page, err := m.pageAt(address)
+		if err != nil {
+			return 0, err
+		}
+		if page.Perm&perm != perm {
+			return 0, &Fault{Kind: FaultProtection, Address: address, Access: perm}
+		}
+
+		offset := address % PAGE_SIZE
+		var n int
+		if page.Data == nil {
+			n = int(PAGE_SIZE - offset)
+			if n > len(p) {
+				n = len(p)
+			}
+			for i := range p[:n] {
+				p[i] = 0
+			}
+		} else {
+			page.region.lock(perm)
+			n = copy(p, page.Data[offset:])
+			page.region.unlock(perm)
+		}
+		read += n
+		p = p[n:]
+		address += uint64(n)
+	}
+	return read, nil
+}
+
+// WriteAt writes p to memory at address. Pages are written in order,
+// so a fault leaves the bytes before the faulting address written.
+func (m *PagedMemory) WriteAt(address uint64, p []byte) (int, error) {
+	return m.writeAt(address, p, PermWrite)
+}
+
+func (m *PagedMemory) writeAt(address uint64, p []byte, perm Perm) (int, error) {
+	var written int
+	for len(p) > 0 {
+		page, err := m.pageAt(address)
+		if err != nil {
+			return 0, err
+		}
+		if page.Perm&perm != perm {
+			return 0, &Fault{Kind: FaultProtection, Address: address, Access: perm}
+		}
+
+		page.region.lock(PermWrite)
+		n := copy(page.writable()[address%PAGE_SIZE:], p)
+		page.region.unlock(PermWrite)
+		written += n
+		p = p[n:]
+		address += uint64(n)
+	}
+	return written, nil
+}
+
+// GetMemoryFunc calls iterf with the memory in [address, address+size),
+// one page at a time. perm is the access iterf needs.
+func (m *PagedMemory) GetMemoryFunc(address uint64, size uint64, perm Perm, iterf func(addr uint64, b []byte) error) error {
+	var r uint64 = size
+	for r > 0 {
+		page, err := m.pageAt(address)
+		if err != nil {
+			return err
+		}
+		if page.Perm&perm != perm {
+			return &Fault{Kind: FaultProtection, Address: address, Access: perm}
+		}
+
+		var b []byte
+		switch {
+		case perm&PermWrite != 0:
+			b = page.writable()[address%PAGE_SIZE:]
+		case page.Data == nil:
+			b = zeroPage[address%PAGE_SIZE:]
+		default:
+			b = page.Data[address%PAGE_SIZE:]
+		}
+		if r < uint64(len(b)) {
+			b = b[:r]
+		}
+		err = page.region.iterate(address, b, perm, iterf)
+		if err != nil {
+			return err
+		}
+
+		r -= uint64(len(b))
+		address += uint64(len(b))
+	}
+	return nil
+}
+
+// SetProgram maps p read-execute at address 0.
+// The heap starts at the next page boundary.
+func (m *PagedMemory) SetProgram(p []byte) {
+	m.ProgramBytes = uint64(len(p))
+	m.MemoryHead = alignUp(uint64(len(p)), PAGE_SIZE)
+	for n := uint64(0); n*PAGE_SIZE < uint64(len(p)); n++ {
+		page := &Page{Perm: PermRX}
+		copy(page.writable()[:], p[n*PAGE_SIZE:])
+		m.Pages[n] = page
+	}
+	m.flushTLB()
+}
+
+// SetProgramData maps text read-execute at address 0 and data read-write
+// at DataAddress(len(text)). The heap starts at the next page boundary.
+func (m *PagedMemory) SetProgramData(text, data []byte) {
+	m.SetProgram(text)
+	if len(data) == 0 {
+		return
+	}
+	start := DataAddress(uint64(len(text)))
+	m.ProgramBytes = start + uint64(len(data))
+	m.MemoryHead = alignUp(m.ProgramBytes, PAGE_SIZE)
+	for n := uint64(0); n*PAGE_SIZE < uint64(len(data)); n++ {
+		page := &Page{Perm: PermRW}
+		copy(page.writable()[:], data[n*PAGE_SIZE:])
+		m.Pages[start/PAGE_SIZE+n] = page
+	}
+	m.flushTLB()
+}
+
+func (m *PagedMemory) Reset() {
+	for n := range m.Pages {
+		delete(m.Pages, n)
+	}
+	for a := range m.Allocations {
+		delete(m.Allocations, a)
+	}
+	m.starts = m.starts[:0]
+	m.guards = nil
+	for a := range m.Mappings {
+		delete(m.Mappings, a)
+	}
+	m.flushTLB()
+	m.MemoryHead = 0
+	m.FreeList = m.FreeList[:0]
+	m.HeapBytes = 0
+	m.HeapBlocks = 0
+	m.ProgramBytes = 0
+}
+
+// Clone returns a copy of m. Page contents are shared with m until
+// either side writes to them. Shared regions stay mapped into both.
+func (m *PagedMemory) Clone() VMMemory {
+	c := *m
+	c.Pages = make(map[uint64]*Page, len(m.Pages))
+	for n, p := range m.Pages {
+		// Only write when needed, so cloning a snapshot is read-only.
+		if p.Data != nil && !p.shared && p.region == nil {
+			p.shared = true
+		}
+		page := *p
+		c.Pages[n] = &page
+	}
+	c.Allocations = make(map[uint64]uint64, len(m.Allocations))
+	for a, size := range m.Allocations {
+		c.Allocations[a] = size
+	}
+	c.starts = append([]uint64(nil), m.starts...)
+	c.guards = make(map[uint64]uint64, len(m.guards))
+	for a, guard := range m.guards {
+		c.guards[a] = guard
+	}
+	c.Mappings = make(map[uint64]*SharedRegion, len(m.Mappings))
+	for a, r := range m.Mappings {
+		c.Mappings[a] = r
+	}
+	c.FreeList = append(FreeList(nil), m.FreeList...)
+	c.flushTLB()
+	return &c
+}
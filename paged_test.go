@@ -0,0 +1,276 @@
+package lvm2
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func faultKind(err error) FaultKind {
+	var f *Fault
+	if !errors.As(err, &f) {
+		return 0
+	}
+	return f.Kind
+}
+
+func TestPagedMemory(t *testing.T) {
+	m := NewPagedMemoryWithConfig(MemoryConfig{StackSize: PAGE_SIZE})
+
+	prog := make([]byte, PAGE_SIZE+100)
+	for i := range prog {
+		prog[i] = byte(i)
+	}
+	m.SetProgram(prog)
+	if m.MemoryHead != 2*PAGE_SIZE {
+		t.Fatalf("head = %d", m.MemoryHead)
+	}
+
+	// Program pages are read-execute.
+	buf := make([]byte, 8)
+	if _, err := m.Fetch(PAGE_SIZE-4, buf); err != nil || !bytes.Equal(buf, prog[PAGE_SIZE-4:PAGE_SIZE+4]) {
+		t.Fatalf("Fetch() = %v, %v", buf, err)
+	}
+	if _, err := m.WriteAt(0, buf); faultKind(err) != FaultProtection {
+		t.Fatalf("write to program: err = %v", err)
+	}
+
+	// Allocations span pages and start zeroed.
+	a, err := m.Allocate(2 * PAGE_SIZE)
+	if err != nil || a != 2*PAGE_SIZE {
+		t.Fatalf("Allocate() = %d, %v", a, err)
+	}
+	if _, err := m.WriteAt(a+PAGE_SIZE-4, []byte{1, 2, 3, 4, 5, 6, 7, 8}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.ReadAt(a+PAGE_SIZE-4, buf); err != nil || !bytes.Equal(buf, []byte{1, 2, 3, 4, 5, 6, 7, 8}) {
+		t.Fatalf("ReadAt() = %v, %v", buf, err)
+	}
+	if _, err := m.ReadAt(a, buf); err != nil || !bytes.Equal(buf, make([]byte, 8)) {
+		t.Fatalf("ReadAt() = %v, %v", buf, err)
+	}
+
+	// Freed pages are unmapped and the range is reused zeroed.
+	if err := m.Free(a); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.ReadAt(a, buf); faultKind(err) != FaultSegmentation {
+		t.Fatalf("read of freed page: err = %v", err)
+	}
+	if err := m.Free(a); err != ErrDoubleFree {
+		t.Fatalf("double free: err = %v", err)
+	}
+	b, _ := m.Allocate(PAGE_SIZE + 8)
+	if b != a {
+		t.Fatalf("b = %d, want %d", b, a)
+	}
+	if _, err := m.ReadAt(a+PAGE_SIZE-4, buf); err != nil || !bytes.Equal(buf, make([]byte, 8)) {
+		t.Fatalf("ReadAt() = %v, %v", buf, err)
+	}
+	if _, err := m.ReadAt(a+PAGE_SIZE+8, buf); err != nil {
+		t.Fatalf("rest of the page: err = %v", err)
+	}
+	if _, err := m.ReadAt(a+2*PAGE_SIZE, buf); faultKind(err) != FaultSegmentation {
+		t.Fatalf("past the last page: err = %v", err)
+	}
+
+	// Stack pages are mapped on first use, guarded on both sides.
+	pages := len(m.Pages)
+	if _, err := m.WriteAt(m.StackTop()-8, buf); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Pages) != pages+1 {
+		t.Fatalf("pages = %d, want %d", len(m.Pages), pages+1)
+	}
+	if _, err := m.WriteAt(m.StackStart-8, buf); faultKind(err) != FaultStackOverflow {
+		t.Fatalf("write below the stack: err = %v", err)
+	}
+	if _, err := m.ReadAt(m.StackTop(), buf); faultKind(err) != FaultStackUnderflow {
+		t.Fatalf("read above the stack: err = %v", err)
+	}
+
+	m.Reset()
+	if len(m.Pages) != 0 || m.HeapBytes != 0 || m.MemoryHead != 0 {
+		t.Fatalf("Reset() left %d pages, %d heap bytes", len(m.Pages), m.HeapBytes)
+	}
+}
+
+func TestPagedMemory_Sparse(t *testing.T) {
+	// Allocations map no pages until they are touched.
+	m := NewPagedMemory()
+	const size = 1 << 40
+	a, err := m.Allocate(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Pages) != 0 {
+		t.Fatalf("pages = %d after Allocate(%d)", len(m.Pages), uint64(size))
+	}
+	buf := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	if _, err := m.WriteAt(a+size-8, buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.ReadAt(a+size/2, buf); err != nil || !bytes.Equal(buf, make([]byte, 8)) {
+		t.Fatalf("ReadAt() = %v, %v", buf, err)
+	}
+	err = m.GetMemoryFunc(a, 16, PermRead, func(_ uint64, b []byte) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Pages) != 3 || m.Pages[a/PAGE_SIZE].Data != nil || m.Pages[(a+size/2)/PAGE_SIZE].Data != nil {
+		t.Fatalf("pages = %d, reads allocated contents", len(m.Pages))
+	}
+
+	// Moving keeps the contents and permissions, freeing unmaps the
+	// touched pages.
+	if err := m.Protect(a+size-8, PermRead); err != nil {
+		t.Fatal(err)
+	}
+	b, err := m.Realloc(a, size+PAGE_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.ReadAt(b+size-8, buf); err != nil || !bytes.Equal(buf, []byte{1, 2, 3, 4, 5, 6, 7, 8}) {
+		t.Fatalf("ReadAt() = %v, %v after Realloc", buf, err)
+	}
+	if _, err := m.WriteAt(b+size-8, buf); faultKind(err) != FaultProtection {
+		t.Fatalf("write to read-only moved page: err = %v", err)
+	}
+	if _, err := m.WriteAt(b, buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Free(b); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Pages) != 0 {
+		t.Fatalf("pages = %d after Free", len(m.Pages))
+	}
+}
+
+func TestPagedMemory_ReallocSharedPage(t *testing.T) {
+	// A moved allocation does not copy the permissions of pages it shares
+	// with its neighbours.
+	m := NewPagedMemory()
+	a, err := m.Allocate(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Allocate(2 * PAGE_SIZE); err != nil {
+		t.Fatal(err)
+	}
+	n, err := m.Allocate(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := []byte{1, 2, 3, 4}
+	if _, err := m.WriteAt(n, buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Protect(a, PermRead); err != nil {
+		t.Fatal(err)
+	}
+	b, err := m.Realloc(a, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b/PAGE_SIZE != n/PAGE_SIZE {
+		t.Fatalf("Realloc() = %#x, want the page of %#x", b, n)
+	}
+	if _, err := m.WriteAt(n, buf); err != nil {
+		t.Fatalf("write to neighbour after Realloc: err = %v", err)
+	}
+}
+
+func TestPagedMemory_VM(t *testing.T) {
+	prog := []testInstruction{
+		inst(InstructionType_MOV, cnst(REGISTER_SYS32), cnst(100)),
+		inst(InstructionType_SYSCALL, cnst(REGISTER_R0), cnst(SYS_ALLOCATE), cnst(0)),
+		inst(InstructionType_MOV, cnst(REGISTER_R1), reg(REGISTER_SYS33)),
+		inst(InstructionType_STORE, cnst(42), reg(REGISTER_R1), cnst(0)),
+		inst(InstructionType_CALL, cnst(7*InstructionBytecodeSize)),
+		inst(InstructionType_MOV, cnst(REGISTER_SYS32), reg(REGISTER_R2)),
+		inst(InstructionType_SYSCALL, cnst(REGISTER_R0), cnst(SYS_EXIT), cnst(0)),
+
+		inst(InstructionType_LOAD, cnst(REGISTER_R2), reg(REGISTER_R1), cnst(0)),
+		inst(InstructionType_PUSH, reg(REGISTER_R2)),
+		inst(InstructionType_POP, cnst(REGISTER_R3)),
+		inst(InstructionType_ADD, cnst(REGISTER_R2), reg(REGISTER_R3), cnst(1)),
+		inst(InstructionType_RET),
+	}
+
+	m := NewPagedMemory()
+	vm := &VM{Memory: m}
+	vm.SetProgram(assemble(prog...))
+	vm.Registers[REGISTER_SP] = m.StackTop()
+	vm.Registers[REGISTER_SB] = m.StackTop()
+	code, err := vm.Run()
+	if err != nil || code != 43 {
+		t.Fatalf("Run() = %d, %v", code, err)
+	}
+}
+
+func stackTop(m VMMemory) uint64 {
+	return m.(interface{ StackTop() uint64 }).StackTop()
+}
+
+// benchmarkMemories runs f against both memory backends.
+func benchmarkMemories(b *testing.B, f func(b *testing.B, m VMMemory)) {
+	b.Run("Blocks", func(b *testing.B) { f(b, NewMemory()) })
+	b.Run("Paged", func(b *testing.B) { f(b, NewPagedMemory()) })
+}
+
+func BenchmarkMemory_ReadAt(b *testing.B) {
+	benchmarkMemories(b, func(b *testing.B, m VMMemory) {
+		const size = 1 << 16
+		a, _ := m.Allocate(size)
+		var buf [8]byte
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			m.ReadAt(a+uint64(i*8)%size, buf[:])
+		}
+	})
+}
+
+// BenchmarkMemory_PingPong alternates between two of many allocations.
+func BenchmarkMemory_PingPong(b *testing.B) {
+	benchmarkMemories(b, func(b *testing.B, m VMMemory) {
+		x, _ := m.Allocate(64)
+		for i := 0; i < 1024; i++ {
+			m.Allocate(64)
+		}
+		y, _ := m.Allocate(64)
+		var buf [8]byte
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			m.ReadAt(x, buf[:])
+			m.WriteAt(y, buf[:])
+		}
+	})
+}
+
+func BenchmarkMemory_VM(b *testing.B) {
+	loop := []testInstruction{
+		inst(InstructionType_STORE, reg(REGISTER_R3), reg(REGISTER_R1), reg(REGISTER_R4)),
+		inst(InstructionType_LOAD, cnst(REGISTER_R5), reg(REGISTER_R2), reg(REGISTER_R4)),
+		inst(InstructionType_ADD, cnst(REGISTER_R4), reg(REGISTER_R4), cnst(8)),
+		inst(InstructionType_AND, cnst(REGISTER_R4), reg(REGISTER_R4), cnst(0xFF8)),
+		inst(InstructionType_PUSH, reg(REGISTER_R5)),
+		inst(InstructionType_POP, cnst(REGISTER_R3)),
+		inst(InstructionType_JMP, cnst(0)),
+	}
+	benchmarkMemories(b, func(b *testing.B, m VMMemory) {
+		vm := &VM{Memory: m}
+		vm.SetProgram(assemble(loop...))
+		vm.Registers[REGISTER_SP] = stackTop(m)
+		vm.Registers[REGISTER_R1], _ = m.Allocate(PAGE_SIZE)
+		for i := 0; i < 1024; i++ {
+			m.Allocate(64)
+		}
+		vm.Registers[REGISTER_R2], _ = m.Allocate(PAGE_SIZE)
+		vm.InstructionLimit = uint64(b.N)
+		b.ResetTimer()
+		if _, err := vm.Run(); err != ErrBudgetExhausted {
+			b.Fatal(err)
+		}
+	})
+}
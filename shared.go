@@ -0,0 +1,307 @@
+package lvm2
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// SharedRegion is memory that can be mapped into several memories at once,
+// also of VMs running on different goroutines.
+//
+// Every access to the region, from guests or the host, holds its lock,
+// so a single load or store is never torn by a concurrent writer.
+// GetMemoryFunc is the exception: it copies the region through a buffer
+// of SHARED_BUFFER_SIZE bytes, so its callback runs without the lock, and
+// copies back only the bytes the callback changed.
+type SharedRegion struct {
+	Name string
+
+	mu   sync.RWMutex
+	data []byte
+}
+
+var (
+	ErrSharedRegionExists   = errors.New("Shared Region Exists")
+	ErrSharedRegionNotFound = errors.New("Shared Region Not Found")
+)
+
+// NewSharedRegion returns a zeroed region of size bytes,
+// rounded up to a multiple of PAGE_SIZE.
+func NewSharedRegion(name string, size uint64) (*SharedRegion, error) {
+	if size == 0 || alignUp(size, PAGE_SIZE) < size {
+		return nil, ErrInvalidSize
+	}
+	return &SharedRegion{
+		Name: name,
+		data: make([]byte, alignUp(size, PAGE_SIZE)),
+	}, nil
+}
+
+// Size returns the size of r in bytes.
+func (r *SharedRegion) Size() uint64 {
+	return uint64(len(r.data))
+}
+
+// lock locks r for an access with perm.
+// A nil region is private memory and needs no lock.
+func (r *SharedRegion) lock(perm Perm) {
+	switch {
+	case r == nil:
+	case perm&PermWrite != 0:
+		r.mu.Lock()
+	default:
+		r.mu.RLock()
+	}
+}
+
+func (r *SharedRegion) unlock(perm Perm) {
+	switch {
+	case r == nil:
+	case perm&PermWrite != 0:
+		r.mu.Unlock()
+	default:
+		r.mu.RUnlock()
+	}
+}
+
+// SHARED_BUFFER_SIZE is the number of bytes of a shared region
+// GetMemoryFunc passes to its callback at a time.
+const SHARED_BUFFER_SIZE = PAGE_SIZE
+
+// iterate calls iterf with b, the memory of r at address, for an access
+// with perm. b is copied into a buffer under the lock, so iterf can block,
+// on file I/O for example, without stalling other users of r. For writes,
+// only the bytes iterf changed are copied back, so the rest of b (past a
+// short read, for example) keeps what others stored meanwhile.
+// A nil region passes b itself.
+func (r *SharedRegion) iterate(address uint64, b []byte, perm Perm, iterf func(addr uint64, b []byte) error) error {
+	if r == nil {
+		return iterf(address, b)
+	}
+	var buffer, old [SHARED_BUFFER_SIZE]byte
+	for len(b) > 0 {
+		chunk := buffer[:]
+		if len(b) < len(chunk) {
+			chunk = chunk[:len(b)]
+		}
+		r.lock(PermRead)
+		copy(chunk, b)
+		r.unlock(PermRead)
+		copy(old[:], chunk)
+
+		err := iterf(address, chunk)
+		if perm&PermWrite != 0 {
+			r.lock(PermWrite)
+			for i := range chunk {
+				if chunk[i] != old[i] {
+					b[i] = chunk[i]
+				}
+			}
+			r.unlock(PermWrite)
+		}
+		if err != nil {
+			return err
+		}
+		address += uint64(len(chunk))
+		b = b[len(chunk):]
+	}
+	return nil
+}
+
+// ReadAt reads len(p) bytes at offset into r.
+func (r *SharedRegion) ReadAt(offset uint64, p []byte) (int, error) {
+	if offset > r.Size() || uint64(len(p)) > r.Size()-offset {
+		return 0, ErrInvalidAddress
+	}
+	r.lock(PermRead)
+	defer r.unlock(PermRead)
+	return copy(p, r.data[offset:]), nil
+}
+
+// WriteAt writes p at offset into r.
+func (r *SharedRegion) WriteAt(offset uint64, p []byte) (int, error) {
+	if offset > r.Size() || uint64(len(p)) > r.Size()-offset {
+		return 0, ErrInvalidAddress
+	}
+	r.lock(PermWrite)
+	defer r.unlock(PermWrite)
+	return copy(r.data[offset:], p), nil
+}
+
+// SharedRegions is a set of named shared regions. It is safe for
+// concurrent use, and the zero value is an empty set.
+type SharedRegions struct {
+	mu      sync.Mutex
+	regions map[string]*SharedRegion
+}
+
+// Create adds a new region of size bytes named name.
+func (s *SharedRegions) Create(name string, size uint64) (*SharedRegion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.regions[name]; ok {
+		return nil, ErrSharedRegionExists
+	}
+	r, err := NewSharedRegion(name, size)
+	if err != nil {
+		return nil, err
+	}
+	if s.regions == nil {
+		s.regions = make(map[string]*SharedRegion)
+	}
+	s.regions[name] = r
+	return r, nil
+}
+
+// Open returns the region named name.
+func (s *SharedRegions) Open(name string) (*SharedRegion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.regions[name]
+	if !ok {
+		return nil, ErrSharedRegionNotFound
+	}
+	return r, nil
+}
+
+// Remove removes the region named name from s.
+// Memories it is mapped into keep using it.
+func (s *SharedRegions) Remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.regions[name]; !ok {
+		return ErrSharedRegionNotFound
+	}
+	delete(s.regions, name)
+	return nil
+}
+
+// SharedMapping is a shared region mapped into a memory.
+type SharedMapping struct {
+	Region *SharedRegion
+	Start  uint64
+	Perm   Perm
+}
+
+// VMMemoryMapper is implemented by memories that can map shared regions.
+type VMMemoryMapper interface {
+	// MapShared maps r at address with perm. address must be a multiple
+	// of PAGE_SIZE, and the range must be unused heap address space:
+	// above the heap or released by Free.
+	MapShared(r *SharedRegion, address uint64, perm Perm) error
+	// UnmapShared unmaps the region mapped at address.
+	UnmapShared(address uint64) error
+	// SharedMappings returns the mapped regions sorted by address.
+	SharedMappings() []SharedMapping
+}
+
+var (
+	_ VMMemoryMapper = (*Memory)(nil)
+	_ VMMemoryMapper = (*PagedMemory)(nil)
+)
+
+// reserveShared reserves [address, address+size) for a shared mapping in a
+// heap growing from *head, and moves *head past it if needed.
+func reserveShared(head *uint64, free *FreeList, guard, address, size uint64) error {
+	if address%PAGE_SIZE != 0 || address+size < address || address+size > guard {
+		return ErrInvalidAddress
+	}
+	if address >= *head {
+		// Address space skipped by the heap can still be allocated.
+		free.Put(*head, address-*head)
+		*head = address + size
+		return nil
+	}
+	if !free.Reserve(address, size) {
+		return ErrInvalidAddress
+	}
+	return nil
+}
+
+func (m *Memory) MapShared(r *SharedRegion, address uint64, perm Perm) error {
+	err := reserveShared(&m.MemoryHead, &m.FreeList, m.StackGuard(), address, r.Size())
+	if err != nil {
+		return err
+	}
+	m.insertBlock(MemoryBlock{
+		Start:  address,
+		End:    address + r.Size(),
+		Block:  r.data,
+		Perm:   perm,
+		region: r,
+	})
+	return nil
+}
+
+func (m *Memory) UnmapShared(address uint64) error {
+	for i := range m.Blocks {
+		b := &m.Blocks[i]
+		if b.Start != address || b.region == nil {
+			continue
+		}
+		m.FreeList.Put(b.Start, b.End-b.Start)
+		copy(m.Blocks[i:], m.Blocks[i+1:])
+		m.Blocks[len(m.Blocks)-1] = MemoryBlock{}
+		m.Blocks = m.Blocks[:len(m.Blocks)-1]
+		m.CacheIndex = -1
+		return nil
+	}
+	return ErrInvalidAddress
+}
+
+func (m *Memory) SharedMappings() []SharedMapping {
+	var mappings []SharedMapping
+	for i := range m.Blocks {
+		if b := &m.Blocks[i]; b.region != nil {
+			mappings = append(mappings, SharedMapping{Region: b.region, Start: b.Start, Perm: b.Perm})
+		}
+	}
+	return mappings
+}
+
+func (m *PagedMemory) MapShared(r *SharedRegion, address uint64, perm Perm) error {
+	first := address / PAGE_SIZE
+	for n := first; n < first+r.Size()/PAGE_SIZE; n++ {
+		if m.Pages[n] != nil {
+			return ErrInvalidAddress
+		}
+	}
+	err := reserveShared(&m.MemoryHead, &m.FreeList, m.StackGuard(), address, r.Size())
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < r.Size()/PAGE_SIZE; i++ {
+		m.Pages[first+i] = &Page{
+			Data:   (*[PAGE_SIZE]byte)(r.data[i*PAGE_SIZE:]),
+			Perm:   perm,
+			region: r,
+		}
+	}
+	m.Mappings[address] = r
+	return nil
+}
+
+func (m *PagedMemory) UnmapShared(address uint64) error {
+	r, ok := m.Mappings[address]
+	if !ok {
+		return ErrInvalidAddress
+	}
+	delete(m.Mappings, address)
+	for n := address / PAGE_SIZE; n < (address+r.Size())/PAGE_SIZE; n++ {
+		delete(m.Pages, n)
+	}
+	m.flushTLB()
+	m.FreeList.Put(address, r.Size())
+	return nil
+}
+
+func (m *PagedMemory) SharedMappings() []SharedMapping {
+	var mappings []SharedMapping
+	for address, r := range m.Mappings {
+		// Protect may have changed single pages, report the first.
+		mappings = append(mappings, SharedMapping{Region: r, Start: address, Perm: m.Pages[address/PAGE_SIZE].Perm})
+	}
+	sort.Slice(mappings, func(i, j int) bool { return mappings[i].Start < mappings[j].Start })
+	return mappings
+}
@@ -0,0 +1,283 @@
+package lvm2
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSharedRegions(t *testing.T) {
+	var s SharedRegions
+	r, err := s.Create("queue", 100)
+	if err != nil || r.Size() != PAGE_SIZE {
+		t.Fatalf("Create() = %v, %v", r, err)
+	}
+	if _, err := s.Create("queue", 100); err != ErrSharedRegionExists {
+		t.Fatalf("duplicate Create(): err = %v", err)
+	}
+	if _, err := s.Create("empty", 0); err != ErrInvalidSize {
+		t.Fatalf("empty Create(): err = %v", err)
+	}
+	if o, err := s.Open("queue"); err != nil || o != r {
+		t.Fatalf("Open() = %v, %v", o, err)
+	}
+	if err := s.Remove("queue"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Open("queue"); err != ErrSharedRegionNotFound {
+		t.Fatalf("Open() after Remove(): err = %v", err)
+	}
+	if _, err := r.WriteAt(PAGE_SIZE-4, make([]byte, 8)); err != ErrInvalidAddress {
+		t.Fatalf("WriteAt() past the end: err = %v", err)
+	}
+}
+
+// newMappers returns fresh memories of both backends with a small program
+// and one heap allocation.
+func newMappers() map[string]VMMemory {
+	memories := map[string]VMMemory{
+		"Blocks": NewMemoryWithConfig(MemoryConfig{StackSize: PAGE_SIZE}),
+		"Paged":  NewPagedMemoryWithConfig(MemoryConfig{StackSize: PAGE_SIZE}),
+	}
+	for _, m := range memories {
+		m.SetProgram(make([]byte, 100))
+		m.Allocate(64)
+	}
+	return memories
+}
+
+func TestMemory_MapShared(t *testing.T) {
+	for name, m := range newMappers() {
+		t.Run(name, func(t *testing.T) {
+			mapper := m.(VMMemoryMapper)
+			r, _ := NewSharedRegion("r", 2*PAGE_SIZE)
+
+			if err := mapper.MapShared(r, 16*PAGE_SIZE+8, PermRW); err != ErrInvalidAddress {
+				t.Fatalf("unaligned: err = %v", err)
+			}
+			if err := mapper.MapShared(r, 0, PermRW); err != ErrInvalidAddress {
+				t.Fatalf("over the program: err = %v", err)
+			}
+			if err := mapper.MapShared(r, stackTop(m)-PAGE_SIZE, PermRW); err != ErrInvalidAddress {
+				t.Fatalf("over the stack: err = %v", err)
+			}
+
+			const address = 16 * PAGE_SIZE
+			if err := mapper.MapShared(r, address, PermRW); err != nil {
+				t.Fatal(err)
+			}
+			if err := mapper.MapShared(r, address+PAGE_SIZE, PermRW); err != ErrInvalidAddress {
+				t.Fatalf("overlapping: err = %v", err)
+			}
+
+			// Guest and host see the same bytes, across the page boundary.
+			if _, err := m.WriteAt(address+PAGE_SIZE-4, []byte{1, 2, 3, 4, 5, 6, 7, 8}); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 8)
+			if _, err := r.ReadAt(PAGE_SIZE-4, buf); err != nil || !bytes.Equal(buf, []byte{1, 2, 3, 4, 5, 6, 7, 8}) {
+				t.Fatalf("ReadAt() = %v, %v", buf, err)
+			}
+
+			// The heap skips the mapping and reuses the space below it.
+			for i := 0; i < 64; i++ {
+				a, err := m.Allocate(PAGE_SIZE)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if a < address+2*PAGE_SIZE && a+PAGE_SIZE > address {
+					t.Fatalf("allocation at %#x overlaps the mapping", a)
+				}
+			}
+
+			// A fork keeps sharing the region.
+			c := m.(VMMemoryCloner).Clone()
+			if _, err := c.WriteAt(address, []byte{42}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := m.ReadAt(address, buf[:1]); err != nil || buf[0] != 42 {
+				t.Fatalf("ReadAt() = %v, %v", buf[0], err)
+			}
+
+			if got := mapper.SharedMappings(); len(got) != 1 || got[0] != (SharedMapping{r, address, PermRW}) {
+				t.Fatalf("SharedMappings() = %v", got)
+			}
+			if err := mapper.UnmapShared(address); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := m.ReadAt(address, buf); faultKind(err) != FaultSegmentation {
+				t.Fatalf("read after unmap: err = %v", err)
+			}
+			if err := mapper.UnmapShared(address); err != ErrInvalidAddress {
+				t.Fatalf("double unmap: err = %v", err)
+			}
+			if _, err := c.ReadAt(address, buf[:1]); err != nil || buf[0] != 42 {
+				t.Fatalf("fork after unmap: ReadAt() = %v, %v", buf[0], err)
+			}
+
+			// Released address space can be mapped again.
+			if err := mapper.MapShared(r, address, PermRead); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := m.WriteAt(address, buf); faultKind(err) != FaultProtection {
+				t.Fatalf("write to read-only mapping: err = %v", err)
+			}
+			if err := (&VM{Memory: m}).WriteCheckpoint(&bytes.Buffer{}); err != ErrCheckpointNotSupported {
+				t.Fatalf("WriteCheckpoint() err = %v", err)
+			}
+		})
+	}
+}
+
+func TestMemory_SharedGetMemoryFunc(t *testing.T) {
+	for name, m := range newMappers() {
+		t.Run(name, func(t *testing.T) {
+			r, _ := NewSharedRegion("r", PAGE_SIZE)
+			const address = 16 * PAGE_SIZE
+			if err := m.(VMMemoryMapper).MapShared(r, address, PermRW); err != nil {
+				t.Fatal(err)
+			}
+
+			// The callback blocks without holding the region lock, and its
+			// writes land in the region afterwards.
+			err := m.GetMemoryFunc(address, 8, PermWrite, func(_ uint64, b []byte) error {
+				done := make(chan struct{})
+				go func() {
+					r.WriteAt(100, []byte{7})
+					close(done)
+				}()
+				select {
+				case <-done:
+				case <-time.After(5 * time.Second):
+					t.Fatal("region locked during the callback")
+				}
+				copy(b, []byte{1, 2, 3, 4, 5, 6, 7, 8})
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 8)
+			if _, err := r.ReadAt(0, buf); err != nil || !bytes.Equal(buf, []byte{1, 2, 3, 4, 5, 6, 7, 8}) {
+				t.Fatalf("ReadAt() = %v, %v", buf, err)
+			}
+			if _, err := m.ReadAt(address+100, buf[:1]); err != nil || buf[0] != 7 {
+				t.Fatalf("ReadAt() = %v, %v", buf[0], err)
+			}
+		})
+	}
+}
+
+// shortReader is a VMFile whose reads return two bytes after calling wait.
+type shortReader struct {
+	wait func()
+}
+
+func (f shortReader) Read(p []byte) (int, error) {
+	f.wait()
+	return copy(p, "xy"), nil
+}
+
+func (shortReader) Write(p []byte) (int, error)    { return len(p), nil }
+func (shortReader) Seek(int64, int) (int64, error) { return 0, nil }
+func (shortReader) Close() error                   { return nil }
+
+func TestVM_SharedShortRead(t *testing.T) {
+	const address = 16 * PAGE_SIZE
+	prog := append([]testInstruction{
+		inst(InstructionType_MOV, cnst(REGISTER_SYS32), cnst(3)),
+		inst(InstructionType_MOV, cnst(REGISTER_SYS33), cnst(address)),
+		inst(InstructionType_MOV, cnst(REGISTER_SYS34), cnst(16)),
+		inst(InstructionType_SYSCALL, cnst(REGISTER_R0), cnst(SYS_READ), cnst(0)),
+	}, exitInst(0)...)
+	for name, m := range map[string]VMMemory{
+		"Blocks": NewMemoryWithConfig(MemoryConfig{StackSize: PAGE_SIZE}),
+		"Paged":  NewPagedMemoryWithConfig(MemoryConfig{StackSize: PAGE_SIZE}),
+	} {
+		t.Run(name, func(t *testing.T) {
+			r, _ := NewSharedRegion("r", PAGE_SIZE)
+			if err := m.(VMMemoryMapper).MapShared(r, address, PermRW); err != nil {
+				t.Fatal(err)
+			}
+
+			// Another writer stores past the two bytes read while the
+			// read blocks, and its store must survive the read.
+			file := shortReader{wait: func() {
+				done := make(chan struct{})
+				go func() {
+					r.WriteAt(8, []byte{7})
+					close(done)
+				}()
+				<-done
+			}}
+			vm := &VM{Memory: m, Files: map[uint64]VMFile{3: file}}
+			m.SetProgram(assemble(prog...))
+			if _, err := vm.Run(); err != nil {
+				t.Fatal(err)
+			}
+			if vm.Registers[REGISTER_R0] != 0 || vm.Registers[REGISTER_SYS35] != 2 {
+				t.Fatalf("errno = %d, read = %d", vm.Registers[REGISTER_R0], vm.Registers[REGISTER_SYS35])
+			}
+			buf := make([]byte, 16)
+			r.ReadAt(0, buf)
+			if want := []byte{'x', 'y', 0, 0, 0, 0, 0, 0, 7, 0, 0, 0, 0, 0, 0, 0}; !bytes.Equal(buf, want) {
+				t.Fatalf("region = %v, want %v", buf, want)
+			}
+		})
+	}
+}
+
+// TestVM_SharedMemory runs a producer and a consumer VM on different
+// goroutines. The producer stores a value and then sets a flag, the
+// consumer spins on the flag and exits with the value.
+func TestVM_SharedMemory(t *testing.T) {
+	const address = 64 * PAGE_SIZE
+	producer := []testInstruction{
+		inst(InstructionType_STORE, cnst(1234), cnst(address), cnst(8)),
+		inst(InstructionType_STORE, cnst(1), cnst(address), cnst(0)),
+	}
+	producer = append(producer, exitInst(0)...)
+	consumer := []testInstruction{
+		inst(InstructionType_LOAD, cnst(REGISTER_R0), cnst(address), cnst(0)),
+		inst(InstructionType_JE, reg(REGISTER_R0), cnst(0)),
+		inst(InstructionType_LOAD, cnst(REGISTER_SYS32), cnst(address), cnst(8)),
+		inst(InstructionType_SYSCALL, cnst(REGISTER_R0), cnst(SYS_EXIT), cnst(0)),
+	}
+
+	var s SharedRegions
+	r, _ := s.Create("channel", PAGE_SIZE)
+	for name, newMemory := range map[string]func() VMMemory{
+		"Blocks": func() VMMemory { return NewMemoryWithConfig(MemoryConfig{StackSize: PAGE_SIZE}) },
+		"Paged":  func() VMMemory { return NewPagedMemoryWithConfig(MemoryConfig{StackSize: PAGE_SIZE}) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			r.WriteAt(0, make([]byte, 16))
+
+			vms := make([]*VM, 2)
+			for i, prog := range [][]testInstruction{consumer, producer} {
+				m := newMemory()
+				vms[i] = &VM{Memory: m}
+				vms[i].SetProgram(assemble(prog...))
+				if err := m.(VMMemoryMapper).MapShared(r, address, PermRW); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var wg sync.WaitGroup
+			codes := make([]uint64, 2)
+			errs := make([]error, 2)
+			for i := range vms {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					codes[i], errs[i] = vms[i].Run()
+				}(i)
+			}
+			wg.Wait()
+			if errs[0] != nil || errs[1] != nil || codes[0] != 1234 {
+				t.Fatalf("Run() = %v, %v", codes, errs)
+			}
+		})
+	}
+}
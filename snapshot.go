@@ -0,0 +1,147 @@
+package lvm2
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// VMMemoryCloner is implemented by memories supporting VM.Snapshot,
+// VM.Restore and VM.Fork.
+type VMMemoryCloner interface {
+	// Clone returns a copy of the memory, including its allocator state.
+	// Unchanged contents may be shared copy-on-write with the original.
+	Clone() VMMemory
+}
+
+var (
+	_ VMMemoryCloner = (*Memory)(nil)
+	_ VMMemoryCloner = (*PagedMemory)(nil)
+)
+
+var ErrCloneNotSupported = errors.New("Clone Not Supported")
+
+// Snapshot is a saved VM state. It can be restored any number of times,
+// also concurrently into different VMs.
+type Snapshot struct {
+	Registers [REGISTER_COUNT]uint64
+
+	// Copy-on-write copy of the memory
+	Memory VMMemory
+
+	// File Descriptor Table
+	//
+	// Host files are shared, not duplicated: their offsets and open state
+	// are not part of the snapshot.
+	Files       map[uint64]VMFile
+	FileCounter uint64
+
+	TrapHandler      uint64
+	CallDepth        uint64
+	InstructionCount uint64
+
+	InterruptTable     uint64
+	InterruptsDisabled bool
+
+	fibers *fiberTable
+}
+
+func cloneMemory(m VMMemory) (VMMemory, error) {
+	c, ok := m.(VMMemoryCloner)
+	if !ok {
+		return nil, ErrCloneNotSupported
+	}
+	return c.Clone(), nil
+}
+
+func cloneFiles(files map[uint64]VMFile) map[uint64]VMFile {
+	c := make(map[uint64]VMFile, len(files))
+	for fd, f := range files {
+		c[fd] = f
+	}
+	return c
+}
+
+// Snapshot saves the state of v. v must not be running.
+func (v *VM) Snapshot() (*Snapshot, error) {
+	if v.multithreaded() {
+		return nil, ErrThreadsNotSupported
+	}
+	memory, err := cloneMemory(v.Memory)
+	if err != nil {
+		return nil, err
+	}
+	return &Snapshot{
+		Registers:          v.Registers,
+		Memory:             memory,
+		Files:              cloneFiles(v.Files),
+		FileCounter:        v.FileCounter,
+		TrapHandler:        v.TrapHandler,
+		InterruptTable:     v.InterruptTable,
+		InterruptsDisabled: v.InterruptsDisabled,
+		CallDepth:          v.CallDepth,
+		InstructionCount:   v.InstructionCount,
+		fibers:             v.fibers.clone(),
+	}, nil
+}
+
+// Restore sets the state of v to s. v must not be running.
+// Timers started by the guest are stopped and pending IRQs dropped,
+// they belong to the state being replaced.
+func (v *VM) Restore(s *Snapshot) error {
+	memory, err := cloneMemory(s.Memory)
+	if err != nil {
+		return err
+	}
+	v.Registers = s.Registers
+	v.Memory = memory
+	v.Files = cloneFiles(s.Files)
+	v.FileCounter = s.FileCounter
+	v.TrapHandler = s.TrapHandler
+	v.InterruptTable = s.InterruptTable
+	v.InterruptsDisabled = s.InterruptsDisabled
+	v.CallDepth = s.CallDepth
+	v.InstructionCount = s.InstructionCount
+	v.threads = nil
+	v.thread = nil
+	v.fibers = s.fibers.clone()
+	v.stopTimers()
+	atomic.StoreUint64(&v.pendingInterrupts, 0)
+	return nil
+}
+
+// Fork returns a copy of v sharing unchanged memory copy-on-write.
+// Both VMs can then run independently, also on different goroutines.
+// The syscall table and host files are shared. v must not be running,
+// but IRQs may be raised on it meanwhile.
+//
+// Memory is copied at the granularity of its Clone: a Memory copies a
+// whole block on the first write to it, so the first push of either VM
+// copies the stack (DEFAULT_STACK_SIZE, 16MB, by default). A PagedMemory
+// copies single pages, which makes forking cheaper for large stacks and
+// heaps.
+func (v *VM) Fork() (*VM, error) {
+	if v.multithreaded() {
+		return nil, ErrThreadsNotSupported
+	}
+	memory, err := cloneMemory(v.Memory)
+	if err != nil {
+		return nil, err
+	}
+	// Pending IRQs and timers stay with v.
+	return &VM{
+		Memory:             memory,
+		Registers:          v.Registers,
+		Files:              cloneFiles(v.Files),
+		FileCounter:        v.FileCounter,
+		Syscalls:           v.Syscalls,
+		TrapHandler:        v.TrapHandler,
+		InterruptTable:     v.InterruptTable,
+		InterruptsDisabled: v.InterruptsDisabled,
+		InstructionCount:   v.InstructionCount,
+		InstructionLimit:   v.InstructionLimit,
+		CallDepth:          v.CallDepth,
+		ThreadQuantum:      v.ThreadQuantum,
+		ParallelThreads:    v.ParallelThreads,
+		fibers:             v.fibers.clone(),
+	}, nil
+}
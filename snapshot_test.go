@@ -0,0 +1,158 @@
+package lvm2
+
+import (
+	"sync"
+	"testing"
+)
+
+// newSnapshotVM returns a VM on m that stores R1 to the heap word at R2,
+// adds 1 to R1 and exits with the old word.
+func newSnapshotVM(m VMMemory) *VM {
+	prog := []testInstruction{
+		inst(InstructionType_LOAD, cnst(REGISTER_SYS32), reg(REGISTER_R2), cnst(0)),
+		inst(InstructionType_STORE, reg(REGISTER_R1), reg(REGISTER_R2), cnst(0)),
+		inst(InstructionType_PUSH, reg(REGISTER_R1)),
+		inst(InstructionType_ADD, cnst(REGISTER_R1), reg(REGISTER_R1), cnst(1)),
+		inst(InstructionType_SYSCALL, cnst(REGISTER_R0), cnst(SYS_EXIT), cnst(0)),
+	}
+	vm := &VM{Memory: m, Files: map[uint64]VMFile{}}
+	vm.SetProgram(assemble(prog...))
+	vm.Registers[REGISTER_SP] = stackTop(m)
+	vm.Registers[REGISTER_R1] = 7
+	vm.Registers[REGISTER_R2], _ = m.Allocate(8)
+	return vm
+}
+
+func runSnapshotVM(t *testing.T, vm *VM) uint64 {
+	vm.Registers[REGISTER_PC] = 0
+	code, err := vm.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestVM_Snapshot(t *testing.T) {
+	for _, m := range []VMMemory{NewMemory(), NewPagedMemory()} {
+		vm := newSnapshotVM(m)
+		s, err := vm.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		runSnapshotVM(t, vm)
+		if code := runSnapshotVM(t, vm); code != 7 || vm.Registers[REGISTER_R1] != 9 {
+			t.Fatalf("%T: exit code = %d, R1 = %d", m, code, vm.Registers[REGISTER_R1])
+		}
+
+		for i := 0; i < 2; i++ {
+			if err := vm.Restore(s); err != nil {
+				t.Fatal(err)
+			}
+			if code := runSnapshotVM(t, vm); code != 0 || vm.Registers[REGISTER_R1] != 8 {
+				t.Fatalf("%T: restored exit code = %d, R1 = %d", m, code, vm.Registers[REGISTER_R1])
+			}
+			if vm.Registers[REGISTER_SP] != stackTop(m)-8 {
+				t.Fatalf("%T: restored SP = %#x", m, vm.Registers[REGISTER_SP])
+			}
+		}
+	}
+
+	vm := &VM{Memory: &countingMemory{VMMemory: NewMemory()}}
+	if _, err := vm.Snapshot(); err != ErrCloneNotSupported {
+		t.Fatalf("err = %v, want ErrCloneNotSupported", err)
+	}
+}
+
+func TestVM_Fork(t *testing.T) {
+	for _, m := range []VMMemory{NewMemory(), NewPagedMemory()} {
+		parent := newSnapshotVM(m)
+		runSnapshotVM(t, parent)
+
+		children := make([]*VM, 4)
+		for i := range children {
+			child, err := parent.Fork()
+			if err != nil {
+				t.Fatal(err)
+			}
+			child.Registers[REGISTER_R1] = uint64(100 + i)
+			children[i] = child
+		}
+
+		// Children and parent write the shared heap word concurrently.
+		var wg sync.WaitGroup
+		codes := make([]uint64, len(children))
+		for i, child := range children {
+			wg.Add(1)
+			go func(i int, child *VM) {
+				defer wg.Done()
+				child.Registers[REGISTER_PC] = 0
+				codes[i], _ = child.Run()
+				child.Registers[REGISTER_PC] = 0
+				codes[i], _ = child.Run()
+			}(i, child)
+		}
+		if code := runSnapshotVM(t, parent); code != 7 {
+			t.Fatalf("%T: parent exit code = %d, want 7", m, code)
+		}
+		wg.Wait()
+
+		for i, code := range codes {
+			if code != uint64(100+i) {
+				t.Fatalf("%T: child %d exit code = %d, want %d", m, i, code, 100+i)
+			}
+		}
+	}
+}
+
+func TestVM_ForkRaise(t *testing.T) {
+	// Forking while the host raises IRQs on the parent neither races
+	// nor hands the IRQs to the child.
+	parent := newSnapshotVM(NewPagedMemory())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			parent.Raise(uint64(i % INTERRUPT_COUNT))
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		child, err := parent.Fork()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if child.PendingInterrupts() != 0 {
+			t.Fatalf("child pending %b", child.PendingInterrupts())
+		}
+	}
+	<-done
+	if parent.PendingInterrupts() == 0 {
+		t.Fatal("parent lost its pending IRQs")
+	}
+}
+
+func TestPagedMemory_Clone(t *testing.T) {
+	m := NewPagedMemory()
+	a, _ := m.Allocate(2 * PAGE_SIZE)
+	m.WriteAt(a, []byte{1})
+	m.WriteAt(a+PAGE_SIZE, []byte{2})
+
+	c := m.Clone().(*PagedMemory)
+	c.WriteAt(a, []byte{3})
+	if m.Pages[a/PAGE_SIZE].Data == c.Pages[a/PAGE_SIZE].Data {
+		t.Fatal("written page still shared")
+	}
+	if m.Pages[a/PAGE_SIZE+1].Data != c.Pages[a/PAGE_SIZE+1].Data {
+		t.Fatal("unchanged page not shared")
+	}
+
+	var buf [1]byte
+	m.ReadAt(a, buf[:])
+	if buf[0] != 1 {
+		t.Fatalf("parent byte = %d, want 1", buf[0])
+	}
+	c.Free(a)
+	if _, err := m.ReadAt(a+PAGE_SIZE, buf[:]); err != nil || buf[0] != 2 {
+		t.Fatalf("parent after child free: %d, %v", buf[0], err)
+	}
+}
@@ -3,24 +3,166 @@ package lvm2
 import (
 	"errors"
 	"os"
+	"sync"
 
 	"github.com/lemon-mint/lvm2/errs"
 )
 
 const (
-	SYS_READ  = 0
-	SYS_WRITE = 1
-	SYS_OPEN  = 2
-	SYS_CLOSE = 3
-	SYS_EXIT  = 60
+	SYS_READ     = 0
+	SYS_WRITE    = 1
+	SYS_OPEN     = 2
+	SYS_CLOSE    = 3
+	SYS_MPROTECT = 10
+	SYS_EXIT     = 60
 
 	SYS_ALLOCATE = 100
 	SYS_FREE     = 101
+	SYS_REALLOC  = 102
+
+	SYS_TRAP = 200
+
+	SYS_THREAD_SPAWN = 300
+	SYS_THREAD_EXIT  = 301
+	SYS_THREAD_JOIN  = 302
+	SYS_THREAD_YIELD = 303
+	SYS_THREAD_SELF  = 304
+
+	SYS_FIBER_CREATE = 310
+	SYS_FIBER_RESUME = 311
+	SYS_FIBER_YIELD  = 312
+	SYS_FIBER_EXIT   = 313
+	SYS_FIBER_FREE   = 314
+
+	SYS_INTERRUPT_TABLE = 320
+	SYS_INTERRUPT_MASK  = 321
+	SYS_INTERRUPT_TIMER = 322
 )
 
 type SYSCALLFunc func(vm *VM, R0, R1, R2 uint64) (errno uint64, err error)
 
-var syscall_Function_Table map[uint64]SYSCALLFunc = make(map[uint64]SYSCALLFunc)
+type syscallEntry struct {
+	Name string
+	Func SYSCALLFunc
+}
+
+// SyscallTable maps syscall numbers and names to handlers.
+// It is safe for concurrent use.
+type SyscallTable struct {
+	mu      sync.RWMutex
+	numbers map[uint64]syscallEntry
+	names   map[string]uint64
+}
+
+func NewSyscallTable() *SyscallTable {
+	return &SyscallTable{
+		numbers: make(map[uint64]syscallEntry),
+		names:   make(map[string]uint64),
+	}
+}
+
+// DefaultSyscallTable returns a new table holding the built-in syscalls.
+func DefaultSyscallTable() *SyscallTable {
+	return defaultSyscallTable.Clone()
+}
+
+// SyscallTable returns the syscall table of v to register custom syscalls
+// on. If v.Syscalls is nil, it is set to a new DefaultSyscallTable first.
+func (v *VM) SyscallTable() *SyscallTable {
+	if v.Syscalls == nil {
+		v.Syscalls = DefaultSyscallTable()
+	}
+	return v.Syscalls
+}
+
+// Register installs fn as syscall number with the given name,
+// replacing any handler previously registered under the number or the name.
+func (t *SyscallTable) Register(number uint64, name string, fn SYSCALLFunc) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.remove(number)
+	if n, ok := t.names[name]; ok {
+		t.remove(n)
+	}
+	t.numbers[number] = syscallEntry{Name: name, Func: fn}
+	if name != "" {
+		t.names[name] = number
+	}
+}
+
+// Unregister removes the syscall with the given number.
+func (t *SyscallTable) Unregister(number uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.remove(number)
+}
+
+// UnregisterName removes the syscall with the given name.
+func (t *SyscallTable) UnregisterName(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if n, ok := t.names[name]; ok {
+		t.remove(n)
+	}
+}
+
+func (t *SyscallTable) remove(number uint64) {
+	e, ok := t.numbers[number]
+	if !ok {
+		return
+	}
+	delete(t.numbers, number)
+	if e.Name != "" {
+		delete(t.names, e.Name)
+	}
+}
+
+// Lookup returns the handler of the syscall with the given number.
+func (t *SyscallTable) Lookup(number uint64) (SYSCALLFunc, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	e, ok := t.numbers[number]
+	return e.Func, ok
+}
+
+// LookupName returns the number and handler of the syscall with the given name.
+func (t *SyscallTable) LookupName(name string) (uint64, SYSCALLFunc, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	n, ok := t.names[name]
+	if !ok {
+		return 0, nil, false
+	}
+	return n, t.numbers[n].Func, true
+}
+
+// Name returns the name of the syscall with the given number.
+func (t *SyscallTable) Name(number uint64) (string, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	e, ok := t.numbers[number]
+	return e.Name, ok
+}
+
+func (t *SyscallTable) Clone() *SyscallTable {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	c := NewSyscallTable()
+	for n, e := range t.numbers {
+		c.numbers[n] = e
+	}
+	for name, n := range t.names {
+		c.names[name] = n
+	}
+	return c
+}
 
 func _syscall_write(vm *VM, _, _, _ uint64) (errno uint64, err error) {
 	// func Write(fd uintptr, p uintptr, n uint64) (written uint64, errno uint64)
@@ -40,7 +182,7 @@ func _syscall_write(vm *VM, _, _, _ uint64) (errno uint64, err error) {
 
 	vm.Registers[REGISTER_SYS35] = 0
 
-	err = vm.Memory.GetMemoryFunc(p, n, func(_ uint64, b []byte) error {
+	err = vm.Memory.GetMemoryFunc(p, n, PermRead, func(_ uint64, b []byte) error {
 		written, err := file.Write(b)
 		if err != nil {
 			return err
@@ -74,7 +216,7 @@ func _syscall_read(vm *VM, _, _, _ uint64) (errno uint64, err error) {
 
 	vm.Registers[REGISTER_SYS35] = 0
 
-	err = vm.Memory.GetMemoryFunc(p, n, func(_ uint64, b []byte) error {
+	err = vm.Memory.GetMemoryFunc(p, n, PermWrite, func(_ uint64, b []byte) error {
 		read, err := file.Read(b)
 		if err != nil {
 			return err
@@ -107,7 +249,7 @@ func _syscall_open(vm *VM, _, _, _ uint64) (errno uint64, err error) {
 	mode := vm.Registers[REGISTER_SYS34]
 
 	var filename []byte
-	err = vm.Memory.GetMemoryFunc(path, vm.Memory.MaxAddress-path, func(_ uint64, b []byte) error {
+	err = vm.Memory.GetMemoryFunc(path, ^uint64(0)-path, PermRead, func(_ uint64, b []byte) error {
 		for _, c := range b {
 			if c == 0 {
 				return errBreak
@@ -170,7 +312,11 @@ func _syscall_allocate(vm *VM, _, _, _ uint64) (errno uint64, err error) {
 	// SYS33[out]: address
 
 	size := vm.Registers[REGISTER_SYS32]
-	address := vm.Memory.Allocate(size)
+	address, err := vm.Memory.Allocate(size)
+	if err != nil {
+		vm.Registers[REGISTER_SYS33] = 0
+		return allocErrno(err), nil
+	}
 
 	vm.Registers[REGISTER_SYS33] = address
 	return 0, nil
@@ -181,19 +327,116 @@ func _syscall_free(vm *VM, _, _, _ uint64) (errno uint64, err error) {
 	// SYS32[in]: address
 
 	address := vm.Registers[REGISTER_SYS32]
-	vm.Memory.Free(address)
+	err = vm.Memory.Free(address)
+	if err != nil {
+		return allocErrno(err), nil
+	}
+	return 0, nil
+}
+
+func _syscall_realloc(vm *VM, _, _, _ uint64) (errno uint64, err error) {
+	// func Realloc(address uint64, size uint64) (address uint64, errno uint64)
+	// SYS32[in]: address
+	// SYS33[in]: size
+	// SYS34[out]: new address
+
+	address := vm.Registers[REGISTER_SYS32]
+	size := vm.Registers[REGISTER_SYS33]
+	reallocator, ok := vm.Memory.(VMMemoryReallocator)
+	if !ok {
+		vm.Registers[REGISTER_SYS34] = 0
+		return errs.ENOSYS.Errno(), nil
+	}
+	address, err = reallocator.Realloc(address, size)
+	if err == errUnsupported {
+		vm.Registers[REGISTER_SYS34] = 0
+		return errs.ENOSYS.Errno(), nil
+	}
+	if err != nil {
+		vm.Registers[REGISTER_SYS34] = 0
+		return allocErrno(err), nil
+	}
+
+	vm.Registers[REGISTER_SYS34] = address
+	return 0, nil
+}
+
+func allocErrno(err error) uint64 {
+	switch err {
+	case ErrNoMemory:
+		return errs.ENOMEM.Errno()
+	case ErrInvalidSize:
+		return errs.EINVALIDSIZE.Errno()
+	case ErrDoubleFree:
+		return errs.EDOUBLEFREE.Errno()
+	}
+	return errs.EINVALIDFREE.Errno()
+}
+
+func _syscall_mprotect(vm *VM, _, _, _ uint64) (errno uint64, err error) {
+	// func Mprotect(address uint64, perm uint64) (errno uint64)
+	// SYS32[in]: address (any address inside the block)
+	// SYS33[in]: perm (1: read, 2: write, 4: execute)
+
+	address := vm.Registers[REGISTER_SYS32]
+	perm := vm.Registers[REGISTER_SYS33]
+	if perm&^uint64(PermRWX) != 0 {
+		return errs.EINVALIDPERM.Errno(), nil
+	}
+
+	protector, ok := vm.Memory.(VMMemoryProtector)
+	if !ok {
+		return errs.ENOSYS.Errno(), nil
+	}
+	err = protector.Protect(address, Perm(perm))
+	if err == errUnsupported {
+		return errs.ENOSYS.Errno(), nil
+	}
+	if err != nil {
+		return errs.EINVALIDADDRESS.Errno(), nil
+	}
+	return 0, nil
+}
+
+func _syscall_trap(vm *VM, _, _, _ uint64) (errno uint64, err error) {
+	// func Trap(handler uint64) (previous uint64, errno uint64)
+	// SYS32[in]: handler (0: disable)
+	// SYS33[out]: previous handler
+
+	vm.Registers[REGISTER_SYS33] = vm.TrapHandler
+	vm.TrapHandler = vm.Registers[REGISTER_SYS32]
 	return 0, nil
 }
 
 var ErrExited = errors.New("exited")
 
-var _ = func() bool {
-	syscall_Function_Table[SYS_WRITE] = _syscall_write
-	syscall_Function_Table[SYS_READ] = _syscall_read
-	syscall_Function_Table[SYS_OPEN] = _syscall_open
-	syscall_Function_Table[SYS_CLOSE] = _syscall_close
-	syscall_Function_Table[SYS_EXIT] = _syscall_exit
-	syscall_Function_Table[SYS_ALLOCATE] = _syscall_allocate
-	syscall_Function_Table[SYS_FREE] = _syscall_free
-	return true
-}()
+// defaultSyscallTable is filled in init, as the thread syscalls
+// run the interpreter, which refers back to it.
+var defaultSyscallTable = NewSyscallTable()
+
+func init() {
+	t := defaultSyscallTable
+	t.Register(SYS_WRITE, "write", _syscall_write)
+	t.Register(SYS_READ, "read", _syscall_read)
+	t.Register(SYS_OPEN, "open", _syscall_open)
+	t.Register(SYS_CLOSE, "close", _syscall_close)
+	t.Register(SYS_EXIT, "exit", _syscall_exit)
+	t.Register(SYS_ALLOCATE, "allocate", _syscall_allocate)
+	t.Register(SYS_FREE, "free", _syscall_free)
+	t.Register(SYS_REALLOC, "realloc", _syscall_realloc)
+	t.Register(SYS_MPROTECT, "mprotect", _syscall_mprotect)
+	t.Register(SYS_TRAP, "trap", _syscall_trap)
+	t.Register(SYS_THREAD_SPAWN, "thread_spawn", _syscall_thread_spawn)
+	t.Register(SYS_THREAD_EXIT, "thread_exit", _syscall_thread_exit)
+	t.Register(SYS_THREAD_JOIN, "thread_join", _syscall_thread_join)
+	t.Register(SYS_THREAD_YIELD, "thread_yield", _syscall_thread_yield)
+	t.Register(SYS_THREAD_SELF, "thread_self", _syscall_thread_self)
+	t.Register(SYS_FIBER_CREATE, "fiber_create", _syscall_fiber_create)
+	t.Register(SYS_FIBER_RESUME, "fiber_resume", _syscall_fiber_resume)
+	t.Register(SYS_FIBER_YIELD, "fiber_yield", _syscall_fiber_yield)
+	t.Register(SYS_FIBER_EXIT, "fiber_exit", _syscall_fiber_exit)
+	t.Register(SYS_FIBER_FREE, "fiber_free", _syscall_fiber_free)
+	t.Register(SYS_INTERRUPT_TABLE, "interrupt_table", _syscall_interrupt_table)
+	t.Register(SYS_INTERRUPT_MASK, "interrupt_mask", _syscall_interrupt_mask)
+	t.Register(SYS_INTERRUPT_TIMER, "interrupt_timer", _syscall_interrupt_timer)
+}
@@ -0,0 +1,101 @@
+package lvm2
+
+import (
+	"testing"
+
+	"github.com/lemon-mint/lvm2/errs"
+)
+
+func TestSyscallTable_PerVM(t *testing.T) {
+	const SYS_DOUBLE = 1000
+
+	prog := append([]testInstruction{
+		inst(InstructionType_MOV, cnst(REGISTER_SYS32), cnst(21)),
+		inst(InstructionType_SYSCALL, cnst(REGISTER_R0), cnst(SYS_DOUBLE), cnst(0)),
+		inst(InstructionType_MOV, cnst(REGISTER_R1), reg(REGISTER_SYS33)),
+	}, exitInst(0)...)
+
+	// Registering before the first run seeds the table.
+	vm := newTestVM(prog...)
+	vm.SyscallTable().Register(SYS_DOUBLE, "double", func(vm *VM, _, _, _ uint64) (uint64, error) {
+		vm.Registers[REGISTER_SYS33] = vm.Registers[REGISTER_SYS32] * 2
+		return 0, nil
+	})
+	if _, err := vm.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if vm.Registers[REGISTER_R1] != 42 {
+		t.Fatalf("R1 = %d, want 42", vm.Registers[REGISTER_R1])
+	}
+
+	if _, _, ok := defaultSyscallTable.LookupName("double"); ok {
+		t.Fatal("registration leaked into the default table")
+	}
+	other := newTestVM(prog...)
+	if _, err := other.Run(); err == nil {
+		t.Fatal("expected unknown syscall error")
+	}
+	if other.Syscalls != nil {
+		t.Fatal("Run set Syscalls")
+	}
+
+	vm.Syscalls.UnregisterName("double")
+	if _, ok := vm.Syscalls.Lookup(SYS_DOUBLE); ok {
+		t.Fatal("syscall still registered")
+	}
+	if n, _, ok := vm.Syscalls.LookupName("write"); !ok || n != SYS_WRITE {
+		t.Fatal("default syscall missing")
+	}
+}
+
+func TestSyscall_Errno(t *testing.T) {
+	const (
+		SYS_FAIL = 1000
+		SYS_OK   = 1001
+	)
+
+	prog := append([]testInstruction{
+		inst(InstructionType_SYSCALL, cnst(REGISTER_R1), cnst(SYS_FAIL), cnst(0)),
+		inst(InstructionType_SYSCALL, cnst(REGISTER_R2), cnst(SYS_OK), cnst(0)),
+	}, exitInst(0)...)
+
+	vm := newTestVM(prog...)
+	vm.Syscalls = DefaultSyscallTable()
+	vm.Syscalls.Register(SYS_FAIL, "fail", func(*VM, uint64, uint64, uint64) (uint64, error) {
+		return 7, nil
+	})
+	vm.Syscalls.Register(SYS_OK, "ok", func(*VM, uint64, uint64, uint64) (uint64, error) {
+		return 0, nil
+	})
+	vm.Registers[REGISTER_R2] = 99
+	if _, err := vm.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if vm.Registers[REGISTER_R1] != 7 {
+		t.Fatalf("R1 = %d, want errno 7", vm.Registers[REGISTER_R1])
+	}
+	if vm.Registers[REGISTER_R2] != 0 {
+		t.Fatalf("R2 = %d, want 0", vm.Registers[REGISTER_R2])
+	}
+}
+
+func TestSyscall_FreeErrno(t *testing.T) {
+	prog := []testInstruction{
+		inst(InstructionType_MOV, cnst(REGISTER_SYS32), cnst(16)),
+		inst(InstructionType_SYSCALL, cnst(REGISTER_R0), cnst(SYS_ALLOCATE), cnst(0)),
+		inst(InstructionType_MOV, cnst(REGISTER_SYS32), reg(REGISTER_SYS33)),
+		inst(InstructionType_SYSCALL, cnst(REGISTER_R1), cnst(SYS_FREE), cnst(0)),
+		inst(InstructionType_SYSCALL, cnst(REGISTER_R2), cnst(SYS_FREE), cnst(0)),
+	}
+	vm := newTestVM(append(prog, exitInst(0)...)...)
+	vm.Registers[REGISTER_R0] = 99
+	if _, err := vm.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if vm.Registers[REGISTER_R0] != 0 || vm.Registers[REGISTER_R1] != 0 {
+		t.Fatalf("R0 = %d, R1 = %d, want 0", vm.Registers[REGISTER_R0], vm.Registers[REGISTER_R1])
+	}
+	if vm.Registers[REGISTER_R2] != errs.EDOUBLEFREE.Errno() {
+		t.Fatalf("R2 = %d, want EDOUBLEFREE", vm.Registers[REGISTER_R2])
+	}
+}
@@ -0,0 +1,571 @@
+package lvm2
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/lemon-mint/lvm2/errs"
+)
+
+// DEFAULT_THREAD_STACK_SIZE is the stack size of threads spawned
+// without one.
+const DEFAULT_THREAD_STACK_SIZE = 64 * 1024 // 64KB
+
+// ThreadState is the scheduling state of a guest thread.
+type ThreadState uint8
+
+const (
+	ThreadRunnable ThreadState = iota
+	// Waiting in SYS_THREAD_JOIN
+	ThreadBlocked
+	ThreadExited
+)
+
+// Thread is a guest thread.
+//
+// Every thread runs on its own VM with its own registers, call depth
+// and trap handler. Memory, files, the syscall table and the instruction
+// budget are shared with the VM that spawned the first thread, which
+// is the main thread (ID 0).
+type Thread struct {
+	ID uint64
+	VM *VM
+
+	State    ThreadState
+	ExitCode uint64
+
+	// Heap allocation holding the stack (0: main thread, on the memory's stack)
+	Stack uint64
+
+	// Thread waited for (ThreadBlocked)
+	joining uint64
+	// Set by SYS_THREAD_YIELD
+	yield bool
+}
+
+var (
+	ErrDeadlock = errors.New("all threads are blocked")
+	// ErrThreadsNotSupported is returned when saving the state of a VM
+	// running several threads.
+	ErrThreadsNotSupported = errors.New("Threads Not Supported")
+
+	// errThreadStopped ends threads blocked in SYS_THREAD_JOIN
+	// when another thread stops the VM.
+	errThreadStopped = errors.New("thread stopped")
+	// errUnsupported is returned by lockedMemory for optional methods
+	// the wrapped memory does not implement.
+	errUnsupported = errors.New("unsupported")
+)
+
+// threadGroup holds the threads of a VM and schedules them.
+//
+// In parallel mode syscalls, and so every method here, run with mu held.
+type threadGroup struct {
+	main *VM
+
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	// Threads not joined yet, in spawn order
+	threads []*Thread
+	nextID  uint64
+	// Running thread (interleaved mode)
+	current *Thread
+
+	// Parallel Mode
+	parallel bool
+	ctx      context.Context
+	wg       sync.WaitGroup
+	memory   *lockedMemory
+	blocked  int
+	stopped  uint32
+	exitCode uint64
+	err      error
+}
+
+// threadGroup returns the thread group of v, making v the main thread
+// of a new one if needed.
+func (v *VM) threadGroup() *threadGroup {
+	if v.threads == nil {
+		g := &threadGroup{main: v, nextID: 1}
+		g.cond = sync.NewCond(&g.mu)
+		v.thread = &Thread{VM: v}
+		g.threads = []*Thread{v.thread}
+		g.current = v.thread
+		v.threads = g
+	}
+	return v.threads
+}
+
+// multithreaded reports whether v runs more than one thread.
+func (v *VM) multithreaded() bool {
+	return v.threads != nil && len(v.threads.threads) > 1
+}
+
+// Threads returns the threads of v that have not been joined yet.
+// v must not be running.
+func (v *VM) Threads() []*Thread {
+	if v.threads == nil {
+		return nil
+	}
+	return append([]*Thread(nil), v.threads.threads...)
+}
+
+func (g *threadGroup) find(id uint64) *Thread {
+	for _, t := range g.threads {
+		if t.ID == id {
+			return t
+		}
+	}
+	return nil
+}
+
+func (g *threadGroup) remove(t *Thread) {
+	for i := range g.threads {
+		if g.threads[i] == t {
+			copy(g.threads[i:], g.threads[i+1:])
+			g.threads[len(g.threads)-1] = nil
+			g.threads = g.threads[:len(g.threads)-1]
+			return
+		}
+	}
+}
+
+// live returns the number of threads that have not exited.
+func (g *threadGroup) live() int {
+	n := 0
+	for _, t := range g.threads {
+		if t.State != ThreadExited {
+			n++
+		}
+	}
+	return n
+}
+
+// spawn starts a thread at entry with R0 set to arg and the stack
+// [stack, stack+size).
+func (g *threadGroup) spawn(parent *VM, entry, arg, stack, size uint64) *Thread {
+	t := &Thread{ID: g.nextID, Stack: stack}
+	g.nextID++
+	t.VM = &VM{
+		Memory:      parent.Memory,
+		Files:       parent.Files,
+		FileCounter: parent.FileCounter,
+		Syscalls:    parent.Syscalls,
+		TrapHandler: parent.TrapHandler,
+		threads:     g,
+		thread:      t,
+	}
+	t.VM.Registers[REGISTER_PC] = entry
+	t.VM.Registers[REGISTER_SP] = stack + size
+	t.VM.Registers[REGISTER_SB] = stack + size
+	t.VM.Registers[REGISTER_R0] = arg
+	g.threads = append(g.threads, t)
+	if g.parallel {
+		g.start(t)
+	}
+	return t
+}
+
+// exit frees the stack of t, ends t and wakes the threads joining it.
+// It reports whether t was the last thread. t keeps running if its
+// stack cannot be freed.
+func (g *threadGroup) exit(t *Thread, code uint64) (bool, error) {
+	if t.Stack != 0 {
+		if err := t.VM.Memory.Free(t.Stack); err != nil {
+			return false, err
+		}
+		t.Stack = 0
+	}
+	t.State = ThreadExited
+	t.ExitCode = code
+
+	joined := false
+	for _, w := range g.threads {
+		if w.State == ThreadBlocked && w.joining == t.ID {
+			w.State = ThreadRunnable
+			w.VM.Registers[REGISTER_SYS33] = code
+			g.blocked--
+			joined = true
+		}
+	}
+	if joined {
+		g.remove(t)
+	}
+
+	if g.parallel {
+		g.cond.Broadcast()
+		g.checkDeadlock()
+	}
+	return g.live() == 0, nil
+}
+
+// join blocks w until t exits. In interleaved mode it only marks w blocked,
+// the scheduler switches threads after the syscall.
+func (g *threadGroup) join(w *Thread, t *Thread) error {
+	w.State = ThreadBlocked
+	w.joining = t.ID
+	g.blocked++
+	if !g.parallel {
+		return nil
+	}
+
+	g.checkDeadlock()
+	for w.State == ThreadBlocked {
+		if atomic.LoadUint32(&g.stopped) != 0 {
+			// Join again when the VM is resumed.
+			w.State = ThreadRunnable
+			g.blocked--
+			w.VM.Registers[REGISTER_PC] -= InstructionBytecodeSize
+			return errThreadStopped
+		}
+		g.cond.Wait()
+	}
+	return nil
+}
+
+// enterSyscall prepares v to run a syscall on state shared by all threads.
+func (g *threadGroup) enterSyscall(v *VM) {
+	if g.parallel {
+		g.mu.Lock()
+	}
+	if v != g.main {
+		v.Files = g.main.Files
+		v.FileCounter = g.main.FileCounter
+	}
+}
+
+func (g *threadGroup) exitSyscall(v *VM) {
+	if v != g.main {
+		g.main.Files = v.Files
+		g.main.FileCounter = v.FileCounter
+	}
+	if g.parallel {
+		g.mu.Unlock()
+	}
+}
+
+// run schedules the threads until the last one exits, a thread stops
+// the VM with SYS_EXIT or an error, or ctx is done.
+func (g *threadGroup) run(ctx context.Context) (uint64, error) {
+	if g.main.ParallelThreads {
+		return g.runParallel(ctx)
+	}
+	return g.runInterleaved(ctx)
+}
+
+// next returns the first runnable thread after t, round robin.
+func (g *threadGroup) next(t *Thread) *Thread {
+	i := -1
+	for j := range g.threads {
+		if g.threads[j] == t {
+			i = j
+		}
+	}
+	for k := 1; k <= len(g.threads); k++ {
+		c := g.threads[(i+k)%len(g.threads)]
+		if c.State == ThreadRunnable {
+			return c
+		}
+	}
+	return nil
+}
+
+func (g *threadGroup) runInterleaved(ctx context.Context) (uint64, error) {
+	done := ctx.Done()
+	quantum := g.main.ThreadQuantum
+	t := g.current
+	var slice uint64
+	for i := 0; ; i++ {
+		if done != nil && i%cancelCheckInterval == 0 {
+			select {
+			case <-done:
+				return 1, &cancelError{err: ctx.Err()}
+			default:
+			}
+		}
+
+		if t.State != ThreadRunnable || t.yield || (quantum != 0 && slice >= quantum) {
+			t.yield = false
+			next := g.next(t)
+			if next == nil {
+				return 1, ErrDeadlock
+			}
+			t = next
+			g.current = t
+			slice = 0
+		}
+
+		result, err := t.VM.Step()
+		slice++
+		if err != nil || result.Halted {
+			return result.ExitCode, err
+		}
+	}
+}
+
+func (g *threadGroup) runParallel(ctx context.Context) (uint64, error) {
+	g.mu.Lock()
+	g.memory = &lockedMemory{VMMemory: g.main.Memory}
+	for _, t := range g.threads {
+		t.VM.Memory = g.memory
+	}
+	g.parallel = true
+	g.ctx = ctx
+	g.stopped = 0
+	g.exitCode, g.err = 0, nil
+	for _, t := range g.threads {
+		if t.State == ThreadRunnable {
+			g.start(t)
+		}
+	}
+	g.checkDeadlock()
+	g.mu.Unlock()
+
+	g.wg.Wait()
+
+	g.parallel = false
+	for _, t := range g.threads {
+		t.VM.Memory = g.memory.VMMemory
+	}
+	g.main.Memory = g.memory.VMMemory
+	g.memory = nil
+	return g.exitCode, g.err
+}
+
+// start runs t on a new goroutine.
+func (g *threadGroup) start(t *Thread) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		done := g.ctx.Done()
+		for i := 0; atomic.LoadUint32(&g.stopped) == 0; i++ {
+			if done != nil && i%cancelCheckInterval == 0 {
+				select {
+				case <-done:
+					g.stop(1, &cancelError{err: g.ctx.Err()})
+					return
+				default:
+				}
+			}
+
+			result, err := t.VM.Step()
+			if err == errThreadStopped {
+				return
+			}
+			if err != nil || result.Halted {
+				g.stop(result.ExitCode, err)
+				return
+			}
+			if t.State == ThreadExited {
+				return
+			}
+			if t.yield {
+				t.yield = false
+				runtime.Gosched()
+			}
+		}
+	}()
+}
+
+// stop stops all threads. Only the first call sets the result of Run.
+func (g *threadGroup) stop(code uint64, err error) {
+	g.mu.Lock()
+	g.stopLocked(code, err)
+	g.mu.Unlock()
+}
+
+func (g *threadGroup) stopLocked(code uint64, err error) {
+	if g.stopped != 0 {
+		return
+	}
+	atomic.StoreUint32(&g.stopped, 1)
+	g.exitCode, g.err = code, err
+	g.cond.Broadcast()
+}
+
+// checkDeadlock stops the VM if every live thread is blocked.
+func (g *threadGroup) checkDeadlock() {
+	if live := g.live(); live > 0 && g.blocked == live {
+		g.stopLocked(1, ErrDeadlock)
+	}
+}
+
+// lockedMemory serializes all accesses to a memory shared by threads
+// running on several goroutines.
+type lockedMemory struct {
+	VMMemory
+	mu sync.Mutex
+}
+
+func (m *lockedMemory) ReadAt(address uint64, p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.VMMemory.ReadAt(address, p)
+}
+
+func (m *lockedMemory) WriteAt(address uint64, p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.VMMemory.WriteAt(address, p)
+}
+
+func (m *lockedMemory) GetMemoryFunc(address uint64, size uint64, perm Perm, iterf func(addr uint64, b []byte) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.VMMemory.GetMemoryFunc(address, size, perm, iterf)
+}
+
+func (m *lockedMemory) Allocate(size uint64) (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.VMMemory.Allocate(size)
+}
+
+func (m *lockedMemory) Free(address uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.VMMemory.Free(address)
+}
+
+func (m *lockedMemory) Fetch(address uint64, p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if f, ok := m.VMMemory.(VMMemoryFetcher); ok {
+		return f.Fetch(address, p)
+	}
+	return m.VMMemory.ReadAt(address, p)
+}
+
+func (m *lockedMemory) Realloc(address uint64, size uint64) (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if r, ok := m.VMMemory.(VMMemoryReallocator); ok {
+		return r.Realloc(address, size)
+	}
+	return 0, errUnsupported
+}
+
+func (m *lockedMemory) Protect(address uint64, perm Perm) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if p, ok := m.VMMemory.(VMMemoryProtector); ok {
+		return p.Protect(address, perm)
+	}
+	return errUnsupported
+}
+
+func (m *lockedMemory) AllocateStack(size uint64) (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return allocateStack(m.VMMemory, size)
+}
+
+func (m *lockedMemory) Atomic(address, size uint64, perm Perm, f func(b []byte)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if a, ok := m.VMMemory.(VMMemoryAtomic); ok {
+		return a.Atomic(address, size, perm, f)
+	}
+	return accessWhole(m.VMMemory, address, size, perm, f)
+}
+
+// allocateStack allocates a stack of size bytes, guarded if m supports it.
+func allocateStack(m VMMemory, size uint64) (uint64, error) {
+	if s, ok := m.(VMMemoryStackAllocator); ok {
+		return s.AllocateStack(size)
+	}
+	return m.Allocate(size)
+}
+
+func _syscall_thread_spawn(vm *VM, _, _, _ uint64) (errno uint64, err error) {
+	// func ThreadSpawn(entry uint64, arg uint64, stackSize uint64) (id uint64, errno uint64)
+	// SYS32[in]: entry (the thread ends with SYS_THREAD_EXIT)
+	// SYS33[in]: arg (R0 of the new thread)
+	// SYS34[in]: stack size (0: DEFAULT_THREAD_STACK_SIZE)
+	// SYS35[out]: thread ID
+
+	entry := vm.Registers[REGISTER_SYS32]
+	arg := vm.Registers[REGISTER_SYS33]
+	size := vm.Registers[REGISTER_SYS34]
+	if size == 0 {
+		size = DEFAULT_THREAD_STACK_SIZE
+	}
+	vm.Registers[REGISTER_SYS35] = 0
+	if alignUp(size, WORD_SIZE) < size {
+		return errs.EINVALIDSIZE.Errno(), nil
+	}
+	size = alignUp(size, WORD_SIZE)
+
+	stack, err := allocateStack(vm.Memory, size)
+	if err != nil {
+		return allocErrno(err), nil
+	}
+	t := vm.threadGroup().spawn(vm, entry, arg, stack, size)
+	vm.Registers[REGISTER_SYS35] = t.ID
+	return 0, nil
+}
+
+func _syscall_thread_exit(vm *VM, _, _, _ uint64) (errno uint64, err error) {
+	// func ThreadExit(code uint64) (errno uint64)
+	// SYS32[in]: code (the VM exits with the code of the last thread)
+	//
+	// Returns only on error.
+
+	code := vm.Registers[REGISTER_SYS32]
+	last, err := vm.threadGroup().exit(vm.thread, code)
+	if err != nil {
+		return allocErrno(err), nil
+	}
+	if last {
+		return code, ErrExited
+	}
+	return 0, nil
+}
+
+func _syscall_thread_join(vm *VM, _, _, _ uint64) (errno uint64, err error) {
+	// func ThreadJoin(id uint64) (code uint64, errno uint64)
+	// SYS32[in]: thread ID (each thread can be joined once)
+	// SYS33[out]: exit code
+
+	id := vm.Registers[REGISTER_SYS32]
+	g := vm.threads
+	if g == nil {
+		return errs.EINVALIDTHREAD.Errno(), nil
+	}
+	t := g.find(id)
+	if t == nil || t == vm.thread {
+		return errs.EINVALIDTHREAD.Errno(), nil
+	}
+
+	if t.State != ThreadExited {
+		// SYS33 is set when t exits.
+		return 0, g.join(vm.thread, t)
+	}
+	vm.Registers[REGISTER_SYS33] = t.ExitCode
+	g.remove(t)
+	return 0, nil
+}
+
+func _syscall_thread_yield(vm *VM, _, _, _ uint64) (errno uint64, err error) {
+	// func ThreadYield()
+
+	if vm.thread != nil {
+		vm.thread.yield = true
+	}
+	return 0, nil
+}
+
+func _syscall_thread_self(vm *VM, _, _, _ uint64) (errno uint64, err error) {
+	// func ThreadSelf() (id uint64)
+	// SYS33[out]: thread ID
+
+	vm.Registers[REGISTER_SYS33] = 0
+	if vm.thread != nil {
+		vm.Registers[REGISTER_SYS33] = vm.thread.ID
+	}
+	return 0, nil
+}
@@ -0,0 +1,297 @@
+package lvm2
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/lemon-mint/lvm2/errs"
+)
+
+// at returns the address of the i-th instruction.
+func at(i uint64) uint64 { return i * InstructionBytecodeSize }
+
+func sys(number uint64) testInstruction {
+	return inst(InstructionType_SYSCALL, cnst(REGISTER_R4), cnst(number), cnst(0))
+}
+
+// threadProgram returns a program whose main thread allocates a word,
+// runs worker on two threads with R0 set to its address, joins them and
+// exits with the word. worker starts at instruction 16.
+func threadProgram(worker ...testInstruction) []testInstruction {
+	prog := []testInstruction{
+		inst(InstructionType_MOV, cnst(REGISTER_SYS32), cnst(8)),
+		sys(SYS_ALLOCATE),
+		inst(InstructionType_MOV, cnst(REGISTER_R5), reg(REGISTER_SYS33)),
+		inst(InstructionType_MOV, cnst(REGISTER_SYS32), cnst(at(16))),
+		inst(InstructionType_MOV, cnst(REGISTER_SYS33), reg(REGISTER_R5)),
+		inst(InstructionType_MOV, cnst(REGISTER_SYS34), cnst(0)),
+		sys(SYS_THREAD_SPAWN),
+		inst(InstructionType_MOV, cnst(REGISTER_R6), reg(REGISTER_SYS35)),
+		sys(SYS_THREAD_SPAWN),
+		inst(InstructionType_MOV, cnst(REGISTER_R7), reg(REGISTER_SYS35)),
+		inst(InstructionType_MOV, cnst(REGISTER_SYS32), reg(REGISTER_R6)),
+		sys(SYS_THREAD_JOIN),
+		inst(InstructionType_MOV, cnst(REGISTER_SYS32), reg(REGISTER_R7)),
+		sys(SYS_THREAD_JOIN),
+		inst(InstructionType_LOAD, cnst(REGISTER_SYS32), reg(REGISTER_R5), cnst(0)),
+		sys(SYS_EXIT),
+	}
+	return append(prog, worker...)
+}
+
+func TestVM_Threads(t *testing.T) {
+	// Each thread appends its ID to the decimal digits of the word
+	// three times, yielding after each.
+	prog := threadProgram(
+		sys(SYS_THREAD_SELF),
+		inst(InstructionType_MOV, cnst(REGISTER_R3), reg(REGISTER_SYS33)),
+		inst(InstructionType_MOV, cnst(REGISTER_R1), cnst(3)),
+		inst(InstructionType_LOAD, cnst(REGISTER_R2), reg(REGISTER_R0), cnst(0)),
+		inst(InstructionType_MUL, cnst(REGISTER_R2), reg(REGISTER_R2), cnst(10)),
+		inst(InstructionType_ADD, cnst(REGISTER_R2), reg(REGISTER_R2), reg(REGISTER_R3)),
+		inst(InstructionType_STORE, reg(REGISTER_R2), reg(REGISTER_R0), cnst(0)),
+		sys(SYS_THREAD_YIELD),
+		inst(InstructionType_SUB, cnst(REGISTER_R1), reg(REGISTER_R1), cnst(1)),
+		inst(InstructionType_JNE, reg(REGISTER_R1), cnst(at(16+3))),
+		inst(InstructionType_MOV, cnst(REGISTER_SYS32), reg(REGISTER_R3)),
+		sys(SYS_THREAD_EXIT),
+	)
+
+	vm := newTestVM(prog...)
+	code, err := vm.Run()
+	if err != nil || code != 121212 {
+		t.Fatalf("Run() = %d, %v", code, err)
+	}
+	if threads := vm.Threads(); len(threads) != 1 || threads[0].VM != vm {
+		t.Fatalf("Threads() = %v", threads)
+	}
+
+	// Without yields every thread runs until it exits.
+	prog[16+7] = inst(InstructionType_NOP)
+	vm = newTestVM(prog...)
+	code, err = vm.Run()
+	if err != nil || code != 111222 {
+		t.Fatalf("cooperative: Run() = %d, %v", code, err)
+	}
+}
+
+func TestVM_ThreadsPreemptive(t *testing.T) {
+	// The first thread spins until the second one sets the word.
+	prog := threadProgram(
+		sys(SYS_THREAD_SELF),
+		inst(InstructionType_SUB, cnst(REGISTER_R1), reg(REGISTER_SYS33), cnst(1)),
+		inst(InstructionType_JNE, reg(REGISTER_R1), cnst(at(16+6))),
+		inst(InstructionType_LOAD, cnst(REGISTER_R2), reg(REGISTER_R0), cnst(0)),
+		inst(InstructionType_JE, reg(REGISTER_R2), cnst(at(16+3))),
+		inst(InstructionType_JMP, cnst(at(16+7))),
+		inst(InstructionType_STORE, cnst(42), reg(REGISTER_R0), cnst(0)),
+		sys(SYS_THREAD_EXIT),
+	)
+
+	vm := newTestVM(prog...)
+	vm.InstructionLimit = 10000
+	if _, err := vm.Run(); err != ErrBudgetExhausted {
+		t.Fatalf("cooperative: err = %v, want %v", err, ErrBudgetExhausted)
+	}
+
+	vm = newTestVM(prog...)
+	vm.InstructionLimit = 10000
+	vm.ThreadQuantum = 100
+	if code, err := vm.Run(); err != nil || code != 42 {
+		t.Fatalf("preemptive: Run() = %d, %v", code, err)
+	}
+}
+
+func TestVM_ThreadsParallel(t *testing.T) {
+	const iterations = 1000
+	prog := threadProgram(
+		inst(InstructionType_MOV, cnst(REGISTER_R1), cnst(iterations)),
+		inst(InstructionType_XADD, cnst(REGISTER_R2), reg(REGISTER_R0), cnst(1)),
+		inst(InstructionType_SUB, cnst(REGISTER_R1), reg(REGISTER_R1), cnst(1)),
+		inst(InstructionType_JNE, reg(REGISTER_R1), cnst(at(16+1))),
+		sys(SYS_THREAD_YIELD),
+		sys(SYS_THREAD_EXIT),
+	)
+
+	for name, m := range map[string]VMMemory{
+		"Blocks": NewMemoryWithConfig(MemoryConfig{StackSize: PAGE_SIZE}),
+		"Paged":  NewPagedMemoryWithConfig(MemoryConfig{StackSize: PAGE_SIZE}),
+	} {
+		t.Run(name, func(t *testing.T) {
+			vm := &VM{Memory: m, Files: map[uint64]VMFile{}, ParallelThreads: true}
+			vm.SetProgram(assemble(prog...))
+			vm.Registers[REGISTER_SP] = stackTop(m)
+			code, err := vm.Run()
+			if err != nil || code != 2*iterations {
+				t.Fatalf("Run() = %d, %v", code, err)
+			}
+			if vm.Memory != m {
+				t.Fatalf("Memory = %T, want %T", vm.Memory, m)
+			}
+		})
+	}
+}
+
+func TestVM_ThreadsBudget(t *testing.T) {
+	const iterations = 1000
+	prog := threadProgram(
+		inst(InstructionType_MOV, cnst(REGISTER_R1), cnst(iterations)),
+		inst(InstructionType_XADD, cnst(REGISTER_R2), reg(REGISTER_R0), cnst(1)),
+		inst(InstructionType_SUB, cnst(REGISTER_R1), reg(REGISTER_R1), cnst(1)),
+		inst(InstructionType_JNE, reg(REGISTER_R1), cnst(at(16+1))),
+		sys(SYS_THREAD_EXIT),
+	)
+	for _, parallel := range []bool{false, true} {
+		// The workers run out of the main thread's budget, and raising
+		// it lets them finish.
+		vm := newTestVM(prog...)
+		vm.ParallelThreads = parallel
+		vm.InstructionLimit = iterations
+		if _, err := vm.Run(); err != ErrBudgetExhausted {
+			t.Fatalf("parallel %v: err = %v, want %v", parallel, err, ErrBudgetExhausted)
+		}
+		if vm.InstructionCount < iterations || vm.InstructionCount > iterations+2 {
+			t.Fatalf("parallel %v: InstructionCount = %d, want %d", parallel, vm.InstructionCount, iterations)
+		}
+		for _, th := range vm.Threads() {
+			if th.VM != vm && th.VM.InstructionCount != 0 {
+				t.Fatalf("parallel %v: thread %d has its own count", parallel, th.ID)
+			}
+		}
+		vm.InstructionLimit = 10 * iterations
+		if code, err := vm.Run(); err != nil || code != 2*iterations {
+			t.Fatalf("parallel %v: resumed Run() = %d, %v", parallel, code, err)
+		}
+		if vm.InstructionCount < 6*iterations {
+			t.Fatalf("parallel %v: InstructionCount = %d, want all threads counted", parallel, vm.InstructionCount)
+		}
+	}
+}
+
+func TestVM_ThreadsStackFree(t *testing.T) {
+	// A thread freeing its own stack cannot exit, and is told so.
+	prog := []testInstruction{
+		inst(InstructionType_MOV, cnst(REGISTER_SYS32), cnst(at(6))),
+		inst(InstructionType_MOV, cnst(REGISTER_SYS34), cnst(0)),
+		sys(SYS_THREAD_SPAWN),
+		inst(InstructionType_MOV, cnst(REGISTER_SYS32), reg(REGISTER_SYS35)),
+		sys(SYS_THREAD_JOIN),
+		sys(SYS_EXIT),
+
+		// 6: thread
+		inst(InstructionType_SUB, cnst(REGISTER_SYS32), reg(REGISTER_SB), cnst(DEFAULT_THREAD_STACK_SIZE)),
+		sys(SYS_FREE),
+		sys(SYS_THREAD_EXIT),
+		inst(InstructionType_MOV, cnst(REGISTER_SYS32), reg(REGISTER_R4)),
+		sys(SYS_EXIT),
+	}
+	vm := newTestVM(prog...)
+	code, err := vm.Run()
+	if err != nil || code != errs.EDOUBLEFREE.Errno() {
+		t.Fatalf("Run() = %d, %v, want EDOUBLEFREE", code, err)
+	}
+	if threads := vm.Threads(); len(threads) != 2 || threads[1].State != ThreadRunnable {
+		t.Fatalf("Threads() = %v, want the thread still running", threads)
+	}
+}
+
+func TestVM_ThreadsDeadlock(t *testing.T) {
+	// The thread joins the main thread, which joins it.
+	prog := threadProgram(
+		inst(InstructionType_MOV, cnst(REGISTER_SYS32), cnst(0)),
+		sys(SYS_THREAD_JOIN),
+		sys(SYS_THREAD_EXIT),
+	)
+	for _, parallel := range []bool{false, true} {
+		vm := newTestVM(prog...)
+		vm.ParallelThreads = parallel
+		if _, err := vm.Run(); err != ErrDeadlock {
+			t.Fatalf("parallel %v: err = %v, want %v", parallel, err, ErrDeadlock)
+		}
+	}
+}
+
+func TestVM_ThreadsJoin(t *testing.T) {
+	prog := []testInstruction{
+		inst(InstructionType_MOV, cnst(REGISTER_SYS32), cnst(at(12))),
+		sys(SYS_THREAD_SPAWN),
+		inst(InstructionType_MOV, cnst(REGISTER_SYS32), reg(REGISTER_SYS35)),
+		sys(SYS_THREAD_JOIN),
+		inst(InstructionType_MOV, cnst(REGISTER_R8), reg(REGISTER_SYS33)),
+		sys(SYS_THREAD_JOIN),
+		inst(InstructionType_MOV, cnst(REGISTER_R9), reg(REGISTER_R4)),
+		inst(InstructionType_MOV, cnst(REGISTER_SYS32), cnst(0)),
+		sys(SYS_THREAD_JOIN),
+		inst(InstructionType_MOV, cnst(REGISTER_R10), reg(REGISTER_R4)),
+		inst(InstructionType_MOV, cnst(REGISTER_SYS32), cnst(0)),
+		sys(SYS_THREAD_EXIT),
+
+		// 12: thread
+		inst(InstructionType_MOV, cnst(REGISTER_SYS32), cnst(7)),
+		sys(SYS_THREAD_EXIT),
+	}
+	vm := newTestVM(prog...)
+	if code, err := vm.Run(); err != nil || code != 0 {
+		t.Fatalf("Run() = %d, %v", code, err)
+	}
+	if vm.Registers[REGISTER_R8] != 7 {
+		t.Errorf("exit code = %d, want 7", vm.Registers[REGISTER_R8])
+	}
+	if vm.Registers[REGISTER_R9] != errs.EINVALIDTHREAD.Errno() || vm.Registers[REGISTER_R10] != errs.EINVALIDTHREAD.Errno() {
+		t.Errorf("second join, self join: errno = %d, %d", vm.Registers[REGISTER_R9], vm.Registers[REGISTER_R10])
+	}
+}
+
+func TestVM_ThreadsFault(t *testing.T) {
+	prog := threadProgram(
+		inst(InstructionType_DIV, cnst(REGISTER_R1), cnst(1), cnst(0)),
+	)
+	for _, parallel := range []bool{false, true} {
+		vm := newTestVM(prog...)
+		vm.ParallelThreads = parallel
+		_, err := vm.Run()
+		var f *Fault
+		if !errors.As(err, &f) || f.Kind != FaultDivideByZero || f.PC != at(16) {
+			t.Fatalf("parallel %v: err = %v, want divide by zero", parallel, err)
+		}
+		if _, err := vm.Snapshot(); err != ErrThreadsNotSupported {
+			t.Fatalf("Snapshot() err = %v", err)
+		}
+	}
+}
+
+func TestVM_ThreadsStackOverflow(t *testing.T) {
+	// The threads push until they run into the guard below their stacks,
+	// which keeps them off the word allocated right before.
+	prog := threadProgram(
+		inst(InstructionType_PUSH, reg(REGISTER_R0)),
+		inst(InstructionType_JMP, cnst(at(16))),
+	)
+	for name, m := range map[string]VMMemory{"Blocks": NewMemory(), "Paged": NewPagedMemory()} {
+		vm := &VM{Memory: m}
+		vm.Registers[REGISTER_SP] = stackTop(m)
+		vm.Registers[REGISTER_SB] = stackTop(m)
+		m.SetProgram(assemble(prog...))
+		_, err := vm.Run()
+		var f *Fault
+		if !errors.As(err, &f) || f.Kind != FaultStackOverflow || f.PC != at(16) {
+			t.Fatalf("%s: err = %v, want stack overflow", name, err)
+		}
+		word := make([]byte, 8)
+		if _, err := m.ReadAt(vm.Registers[REGISTER_R5], word); err != nil || !bytes.Equal(word, make([]byte, 8)) {
+			t.Fatalf("%s: word = %v, %v", name, word, err)
+		}
+
+		// Free releases the guard with the stack.
+		m.Reset()
+		a, err := m.(VMMemoryStackAllocator).AllocateStack(64)
+		if err != nil || a != STACK_GUARD_SIZE {
+			t.Fatalf("%s: AllocateStack() = %#x, %v", name, a, err)
+		}
+		m.Free(a)
+		if b, err := m.Allocate(STACK_GUARD_SIZE + 64); err != nil || b != 0 {
+			t.Fatalf("%s: Allocate() = %#x, %v after Free", name, b, err)
+		}
+	}
+}
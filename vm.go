@@ -1,8 +1,14 @@
 package lvm2
 
 import (
+	"context"
 	"encoding/binary"
-	"fmt"
+	"errors"
+	"math"
+	"math/bits"
+	"strconv"
+	"sync/atomic"
+	"time"
 )
 
 type VMFile interface {
@@ -12,8 +18,78 @@ type VMFile interface {
 	Close() error
 }
 
+// VMMemory is the guest address space of a VM.
+//
+// *Memory (sorted block list) is the default implementation and
+// *PagedMemory (sparse page table) an alternative. The interpreter and
+// syscalls only depend on VMMemory and the optional VMMemoryFetcher,
+// VMMemoryReallocator and VMMemoryProtector interfaces.
+type VMMemory interface {
+	ReadAt(address uint64, p []byte) (int, error)
+	WriteAt(address uint64, p []byte) (int, error)
+	// GetMemoryFunc calls iterf with the memory in [address, address+size)
+	// in contiguous chunks. perm is the access iterf needs.
+	GetMemoryFunc(address uint64, size uint64, perm Perm, iterf func(addr uint64, b []byte) error) error
+
+	Allocate(size uint64) (uint64, error)
+	Free(address uint64) error
+
+	SetProgram(p []byte)
+	Reset()
+}
+
+// VMMemoryFetcher is implemented by memories that check execute permission
+// on instruction fetch. Other memories are fetched from with ReadAt.
+type VMMemoryFetcher interface {
+	Fetch(address uint64, p []byte) (int, error)
+}
+
+// VMMemoryReallocator is implemented by memories supporting SYS_REALLOC.
+type VMMemoryReallocator interface {
+	Realloc(address uint64, size uint64) (uint64, error)
+}
+
+// VMMemoryProtector is implemented by memories supporting SYS_MPROTECT.
+type VMMemoryProtector interface {
+	Protect(address uint64, perm Perm) error
+}
+
+// VMMemoryStackAllocator is implemented by memories that guard the stacks
+// of threads and fibers. Other memories allocate them with Allocate.
+type VMMemoryStackAllocator interface {
+	// AllocateStack allocates size bytes above an unmapped guard of
+	// STACK_GUARD_SIZE bytes, so overflowing stacks fault instead of
+	// overwriting the allocation below. Free releases both.
+	AllocateStack(size uint64) (uint64, error)
+}
+
+// VMMemoryDataLoader is implemented by memories that map the data of a
+// program writable. VM.SetProgramData maps it read-execute with the text
+// on other memories.
+type VMMemoryDataLoader interface {
+	// SetProgramData maps text read-execute at address 0 and data
+	// read-write at DataAddress(len(text)).
+	SetProgramData(text, data []byte)
+}
+
+var (
+	_ VMMemory               = (*Memory)(nil)
+	_ VMMemoryFetcher        = (*Memory)(nil)
+	_ VMMemoryReallocator    = (*Memory)(nil)
+	_ VMMemoryProtector      = (*Memory)(nil)
+	_ VMMemoryStackAllocator = (*Memory)(nil)
+	_ VMMemoryDataLoader     = (*Memory)(nil)
+
+	_ VMMemory               = (*PagedMemory)(nil)
+	_ VMMemoryFetcher        = (*PagedMemory)(nil)
+	_ VMMemoryReallocator    = (*PagedMemory)(nil)
+	_ VMMemoryProtector      = (*PagedMemory)(nil)
+	_ VMMemoryStackAllocator = (*PagedMemory)(nil)
+	_ VMMemoryDataLoader     = (*PagedMemory)(nil)
+)
+
 type VM struct {
-	Memory *Memory
+	Memory VMMemory
 
 	// # Registers
 	//
@@ -30,12 +106,77 @@ type VM struct {
 	// Program Counter (PC) (Register ID: 64)
 	// Stack Pointer (SP)   (Register ID: 65)
 	// Stack Base (SB)      (Register ID: 66)
-	Registers [32 + 32 + 3]uint64
+	// Carry Flag (CF)      (Register ID: 67)
+	Registers [REGISTER_COUNT]uint64
 
 	// File Descriptor Table
 	Files map[uint64]VMFile
 	// File Descriptor Counter
 	FileCounter uint64
+
+	// Syscall Table (nil: the built-in syscalls, see SyscallTable)
+	Syscalls *SyscallTable
+
+	// Guest Trap Handler (0: disabled)
+	//
+	// Recoverable faults (invalid opcode, invalid register, divide by zero,
+	// table index out of range) are delivered to the handler instead of stopping the VM:
+	// the address of the next instruction is pushed like CALL does,
+	// SYS62 is set to the FaultKind and SYS63 to the faulting PC.
+	// The handler returns with RET.
+	TrapHandler uint64
+
+	// Guest Interrupt Table (0: disabled)
+	//
+	// IRQs raised with Raise or SYS_INTERRUPT_TIMER are delivered at
+	// instruction boundaries to the handler at their index in the table
+	// (jump table format, see JTAB). The address of the next instruction
+	// is pushed like CALL does and InterruptsDisabled is set; the handler
+	// saves the registers it uses and returns with IRET. IRQs stay pending
+	// while no table is installed or interrupts are disabled, and are
+	// dropped if the table has no handler for them.
+	InterruptTable     uint64
+	InterruptsDisabled bool
+
+	// Raised IRQs, one bit each (accessed atomically)
+	pendingInterrupts uint64
+	// Timers started with SYS_INTERRUPT_TIMER by IRQ
+	timers map[uint64]*time.Timer
+
+	// Executed Instruction Counter
+	InstructionCount uint64
+	// Instruction Budget (0: unlimited)
+	//
+	// Execution stops with ErrBudgetExhausted once InstructionCount reaches
+	// InstructionLimit. Raise the limit to resume.
+	//
+	// Threads count their instructions against the InstructionCount and
+	// InstructionLimit of the main thread. Threads running in parallel
+	// can overshoot the limit by one instruction each.
+	InstructionLimit uint64
+
+	// Call Depth
+	//
+	// Incremented by CALL, CALLT and trap delivery, decremented by RET.
+	// Reported in stack faults.
+	CallDepth uint64
+
+	// Thread Scheduling
+	//
+	// Threads started with SYS_THREAD_SPAWN are scheduled by Run. By default
+	// they run interleaved on the calling goroutine, switching when a thread
+	// yields, blocks or exits, or after ThreadQuantum instructions
+	// (0: cooperative). With ParallelThreads set each thread runs on its own
+	// goroutine, and memory accesses and syscalls are serialized.
+	ThreadQuantum   uint64
+	ParallelThreads bool
+
+	threads *threadGroup
+	// Thread running on this VM (nil: no threads spawned)
+	thread *Thread
+
+	// Fibers created with SYS_FIBER_CREATE (nil: none created)
+	fibers *fiberTable
 }
 
 const (
@@ -106,12 +247,17 @@ const (
 	REGISTER_PC    = 64
 	REGISTER_SP    = 65
 	REGISTER_SB    = 66
+	REGISTER_CF    = 67
 )
 
+// REGISTER_COUNT is the number of registers of a VM.
+const REGISTER_COUNT = 32 + 32 + 4
+
 var Registers = map[string]uint64{
 	"PC":    REGISTER_PC,
 	"SP":    REGISTER_SP,
 	"SB":    REGISTER_SB,
+	"CF":    REGISTER_CF,
 	"R0":    REGISTER_R0,
 	"R1":    REGISTER_R1,
 	"R2":    REGISTER_R2,
@@ -178,6 +324,16 @@ var Registers = map[string]uint64{
 	"SYS63": REGISTER_SYS63,
 }
 
+// RegisterName returns the assembler name of the register with the given ID.
+func RegisterName(id uint64) string {
+	for name, v := range Registers {
+		if v == id {
+			return name
+		}
+	}
+	return strconv.FormatUint(id, 10)
+}
+
 /*
 Bytecode Format:
 
@@ -237,17 +393,47 @@ const (
 )
 
 func (v *VM) SetProgram(p []byte) {
+	v.SetProgramData(p, nil)
+}
+
+// SetProgramData loads a program with read-only text and writable data,
+// see VMMemoryDataLoader.
+func (v *VM) SetProgramData(text, data []byte) {
 	v.Memory.Reset()
-	v.Memory.SetProgram(p)
+	if l, ok := v.Memory.(VMMemoryDataLoader); ok {
+		l.SetProgramData(text, data)
+	} else if len(data) == 0 {
+		v.Memory.SetProgram(text)
+	} else {
+		p := make([]byte, DataAddress(uint64(len(text)))+uint64(len(data)))
+		copy(p, text)
+		copy(p[DataAddress(uint64(len(text))):], data)
+		v.Memory.SetProgram(p)
+	}
+	v.CallDepth = 0
+	v.threads = nil
+	v.thread = nil
+	v.fibers = nil
+	v.InterruptTable = 0
+	v.InterruptsDisabled = false
+	v.stopTimers()
 }
 
 func (v *VM) SetProgramCounter(pc uint64) {
 	v.Registers[REGISTER_PC] = pc
 }
 
+// fetch reads instruction bytes at address.
+func (v *VM) fetch(address uint64, p []byte) (int, error) {
+	if f, ok := v.Memory.(VMMemoryFetcher); ok {
+		return f.Fetch(address, p)
+	}
+	return v.Memory.ReadAt(address, p)
+}
+
 func (v *VM) parseOpcode() (instructionType InstructionType, op0Type OpType, op1Type OpType, op2Type OpType, op0Value uint64, op1Value uint64, op2Value uint64, err error) {
 	var buffer [InstructionBytecodeSize]byte
-	_, err = v.Memory.ReadAt(v.Registers[REGISTER_PC], buffer[:])
+	_, err = v.fetch(v.Registers[REGISTER_PC], buffer[:])
 	if err != nil {
 		return
 	}
@@ -266,233 +452,760 @@ func (v *VM) parseOpcode() (instructionType InstructionType, op0Type OpType, op1
 	return
 }
 
-var ErrInvalidInstruction = fmt.Errorf("invalid instruction")
+var ErrInvalidInstruction = errors.New("invalid instruction")
 
-func (v *VM) Run() (uint64, error) {
-	for {
-		instructionType, op0Type, op1Type, op2Type, op0Value, op1Value, op2Value, err := v.parseOpcode()
+// StepResult describes an instruction executed by Step.
+type StepResult struct {
+	Instruction Instruction
+
+	// Program Counter before and after the instruction
+	PC     uint64
+	NextPC uint64
+
+	// Halted is set when the program exited, ExitCode holds its exit code.
+	// If Step returns an error, ExitCode holds the code Run reports.
+	Halted   bool
+	ExitCode uint64
+
+	// Trap is the fault delivered to the guest trap handler, if any.
+	Trap *Fault
+
+	// Interrupted is set when IRQ was delivered before the instruction.
+	// PC is then the address of the interrupt handler.
+	Interrupted bool
+	IRQ         uint64
+}
+
+var (
+	ErrCanceled        = errors.New("execution canceled")
+	ErrBudgetExhausted = errors.New("instruction budget exhausted")
+)
+
+type cancelError struct {
+	err error
+}
+
+func (e *cancelError) Error() string {
+	return ErrCanceled.Error() + ": " + e.err.Error()
+}
+
+func (e *cancelError) Is(target error) bool {
+	return target == ErrCanceled
+}
+
+func (e *cancelError) Unwrap() error {
+	return e.err
+}
+
+// Step decodes and executes exactly one instruction.
+func (v *VM) Step() (StepResult, error) {
+	var result StepResult
+	result.PC = v.Registers[REGISTER_PC]
+	result.NextPC = result.PC
+	if v.overBudget(0) {
+		result.ExitCode = 1
+		return result, ErrBudgetExhausted
+	}
+	if atomic.LoadUint64(&v.pendingInterrupts) != 0 {
+		irq, ok, err := v.interrupt()
 		if err != nil {
-			return 1, err
+			var f *Fault
+			if errors.As(err, &f) {
+				f.PC = result.PC
+				f.CallDepth = v.CallDepth
+			}
+			result.ExitCode = 1
+			return result, err
+		}
+		if ok {
+			result.Interrupted, result.IRQ = true, irq
+			result.PC = v.Registers[REGISTER_PC]
 		}
-		//log.Println(instructionType, op0Type, op1Type, op2Type, op0Value, op1Value, op2Value, "pc:", v.Registers[REGISTER_PC])
+	}
 
-		if op0Type == OpTypeRegister {
-			if op0Value >= uint64(len(v.Registers)) {
-				return 1, fmt.Errorf("invalid register: %d", op0Value)
-			}
-			op0Value = v.Registers[op0Value]
+	code, err := v.step(&result)
+	var f *Fault
+	if errors.As(err, &f) {
+		f.PC = result.PC
+		f.Instruction = result.Instruction
+		f.CallDepth = v.CallDepth
+		if v.trap(f) {
+			result.Trap = f
+			code, err = 0, nil
 		}
-		if op1Type == OpTypeRegister {
-			if op1Value >= uint64(len(v.Registers)) {
-				return 1, fmt.Errorf("invalid register: %d", op1Value)
-			}
-			op1Value = v.Registers[op1Value]
+	}
+	result.NextPC = v.Registers[REGISTER_PC]
+	if err != nil || result.Halted {
+		result.ExitCode = code
+	}
+	if err == nil {
+		v.charge(1)
+	}
+	return result, err
+}
+
+// budget returns the VM whose InstructionCount and InstructionLimit v
+// runs against. All threads share the budget of the main thread.
+func (v *VM) budget() *VM {
+	if v.threads != nil {
+		return v.threads.main
+	}
+	return v
+}
+
+// overBudget reports whether the budget of v is exhausted, or would be
+// by n instructions on top of the next one.
+func (v *VM) overBudget(n uint64) bool {
+	b := v.budget()
+	if b.InstructionLimit == 0 {
+		return false
+	}
+	var count uint64
+	if v.threads != nil && v.threads.parallel {
+		count = atomic.LoadUint64(&b.InstructionCount)
+	} else {
+		count = b.InstructionCount
+	}
+	return count >= b.InstructionLimit || n >= b.InstructionLimit-count
+}
+
+// charge counts n executed instructions against the budget of v.
+func (v *VM) charge(n uint64) {
+	b := v.budget()
+	if v.threads != nil && v.threads.parallel {
+		atomic.AddUint64(&b.InstructionCount, n)
+	} else {
+		b.InstructionCount += n
+	}
+}
+
+func (v *VM) Run() (uint64, error) {
+	return v.RunContext(context.Background())
+}
+
+// cancelCheckInterval is the number of instructions executed between
+// checks of the context passed to RunContext.
+const cancelCheckInterval = 1024
+
+// RunContext is like Run but stops with an error matching ErrCanceled when ctx
+// is done. Registers and memory are left intact, so the VM can be resumed.
+func (v *VM) RunContext(ctx context.Context) (uint64, error) {
+	done := ctx.Done()
+	for i := 0; ; i++ {
+		if v.threads != nil {
+			return v.threads.run(ctx)
 		}
-		if op2Type == OpTypeRegister {
-			if op2Value >= uint64(len(v.Registers)) {
-				return 1, fmt.Errorf("invalid register: %d", op2Value)
+		if done != nil && i%cancelCheckInterval == 0 {
+			select {
+			case <-done:
+				return 1, &cancelError{err: ctx.Err()}
+			default:
 			}
-			op2Value = v.Registers[op2Value]
 		}
 
-		switch instructionType {
-		case InstructionType_NOP:
-			// NOP
-		case InstructionType_ADD:
-			// ADD
-			v.Registers[op0Value] = op1Value + op2Value
-		case InstructionType_SUB:
-			// SUB
-			v.Registers[op0Value] = op1Value - op2Value
-		case InstructionType_MUL:
-			// MUL
-			v.Registers[op0Value] = op1Value * op2Value
-		case InstructionType_DIV:
-			// DIV
-			v.Registers[op0Value] = op1Value / op2Value
-		case InstructionType_MOD:
-			// MOD
-			v.Registers[op0Value] = op1Value % op2Value
-
-		case InstructionType_AND:
-			// AND
-			v.Registers[op0Value] = op1Value & op2Value
-		case InstructionType_OR:
-			// OR
-			v.Registers[op0Value] = op1Value | op2Value
-		case InstructionType_XOR:
-			// XOR
-			v.Registers[op0Value] = op1Value ^ op2Value
-		case InstructionType_NOT:
-			// NOT
-			v.Registers[op0Value] = ^op1Value
-
-		case InstructionType_SHL:
-			// SHL
-			v.Registers[op0Value] = op1Value << op2Value
-		case InstructionType_SHR:
-			// SHR
-			v.Registers[op0Value] = op1Value >> op2Value
-
-		case InstructionType_CMP:
-			// CMP
-			diff := op1Value - op2Value
-			if diff < 0 {
-				v.Registers[op0Value] = ^uint64(0)
-			} else if diff > 0 {
-				v.Registers[op0Value] = 1
-			} else {
-				v.Registers[op0Value] = 0
-			}
+		result, err := v.Step()
+		if err != nil || result.Halted {
+			return result.ExitCode, err
+		}
+	}
+}
 
-		case InstructionType_JMP:
-			// JMP
-			v.Registers[REGISTER_PC] = op0Value
-		case InstructionType_JG:
-			// JG
-			if int64(op0Value) > 0 {
-				v.Registers[REGISTER_PC] = op1Value
-			}
-		case InstructionType_JL:
-			// JL
-			if int64(op0Value) < 0 {
-				v.Registers[REGISTER_PC] = op1Value
-			}
-		case InstructionType_JE:
-			// JE
-			if int64(op0Value) == 0 {
-				v.Registers[REGISTER_PC] = op1Value
-			}
-		case InstructionType_JNE:
-			// JNE
-			if int64(op0Value) != 0 {
-				v.Registers[REGISTER_PC] = op1Value
-			}
-		case InstructionType_JGE:
-			// JGE
-			if int64(op0Value) >= 0 {
-				v.Registers[REGISTER_PC] = op1Value
-			}
-		case InstructionType_JLE:
-			// JLE
-			if int64(op0Value) <= 0 {
-				v.Registers[REGISTER_PC] = op1Value
-			}
+// trap delivers a recoverable fault to the guest trap handler.
+// It reports whether the fault was delivered.
+func (v *VM) trap(f *Fault) bool {
+	if v.TrapHandler == 0 || !f.Kind.trappable() {
+		return false
+	}
 
-		case InstructionType_LOAD:
-			// LOAD
-			var buffer [8]byte
-			_, err = v.Memory.ReadAt(op1Value+op2Value, buffer[:])
-			if err != nil {
-				return 1, err
-			}
-			v.Registers[op0Value] = binary.LittleEndian.Uint64(buffer[:])
-		case InstructionType_LOADH:
-			// LOADH
-			var buffer [4]byte
-			_, err = v.Memory.ReadAt(op1Value+op2Value, buffer[:])
-			if err != nil {
-				return 1, err
-			}
-			v.Registers[op0Value] = uint64(binary.LittleEndian.Uint32(buffer[:]))
-		case InstructionType_LOADB:
-			// LOADB
-			var buffer [1]byte
-			_, err = v.Memory.ReadAt(op1Value+op2Value, buffer[:])
-			if err != nil {
-				return 1, err
-			}
-			v.Registers[op0Value] = uint64(buffer[0])
-
-		case InstructionType_STORE:
-			// STORE
-			var buffer [8]byte
-			binary.LittleEndian.PutUint64(buffer[:], op0Value)
-			_, err = v.Memory.WriteAt(op1Value+op2Value, buffer[:])
-			if err != nil {
-				return 1, err
-			}
-		case InstructionType_STOREH:
-			// STOREH
-			var buffer [4]byte
-			binary.LittleEndian.PutUint32(buffer[:], uint32(op0Value))
-			_, err = v.Memory.WriteAt(op1Value+op2Value, buffer[:])
-			if err != nil {
-				return 1, err
-			}
-		case InstructionType_STOREB:
-			// STOREB
-			var buffer [1]byte
-			buffer[0] = byte(op0Value)
-			_, err = v.Memory.WriteAt(op1Value+op2Value, buffer[:])
-			if err != nil {
-				return 1, err
-			}
+	var buffer [8]byte
+	binary.LittleEndian.PutUint64(buffer[:], f.PC+InstructionBytecodeSize)
+	_, err := v.Memory.WriteAt(v.Registers[REGISTER_SP]-8, buffer[:])
+	if err != nil {
+		return false
+	}
+	v.Registers[REGISTER_SP] -= 8
+	v.Registers[REGISTER_SYS62] = uint64(f.Kind)
+	v.Registers[REGISTER_SYS63] = f.PC
+	v.Registers[REGISTER_PC] = v.TrapHandler
+	v.CallDepth++
+	return true
+}
+
+// tableEntry returns the index-th entry of the jump table at address table.
+//
+// Jump Table Format:
+//
+//	[table]                 Number of entries (WORD_SIZE)
+//	[table + 8 + index * 8] Entry (WORD_SIZE)
+func (v *VM) tableEntry(table, index uint64) (uint64, error) {
+	var buffer [8]byte
+	_, err := v.Memory.ReadAt(table, buffer[:])
+	if err != nil {
+		return 0, err
+	}
+	if index >= binary.LittleEndian.Uint64(buffer[:]) {
+		return 0, &Fault{Kind: FaultTableIndex, Address: index}
+	}
+	_, err = v.Memory.ReadAt(table+WORD_SIZE+index*WORD_SIZE, buffer[:])
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(buffer[:]), nil
+}
+
+// stackFault reports a failed push onto the stack as a stack overflow.
+func stackFault(err error) error {
+	var f *Fault
+	if errors.As(err, &f) && f.Kind == FaultSegmentation {
+		f.Kind = FaultStackOverflow
+	}
+	return err
+}
+
+func (v *VM) step(result *StepResult) (uint64, error) {
+	instructionType, op0Type, op1Type, op2Type, op0Value, op1Value, op2Value, err := v.parseOpcode()
+	if err != nil {
+		return 1, err
+	}
+	//log.Println(instructionType, op0Type, op1Type, op2Type, op0Value, op1Value, op2Value, "pc:", v.Registers[REGISTER_PC])
+	result.Instruction = Instruction{
+		Type:     instructionType,
+		Op0Type:  op0Type,
+		Op1Type:  op1Type,
+		Op2Type:  op2Type,
+		Op0Value: op0Value,
+		Op1Value: op1Value,
+		Op2Value: op2Value,
+	}
+
+	if op0Type == OpTypeRegister {
+		if op0Value >= uint64(len(v.Registers)) {
+			return 1, &Fault{Kind: FaultInvalidRegister, Address: op0Value}
+		}
+		op0Value = v.Registers[op0Value]
+	}
+	if op1Type == OpTypeRegister {
+		if op1Value >= uint64(len(v.Registers)) {
+			return 1, &Fault{Kind: FaultInvalidRegister, Address: op1Value}
+		}
+		op1Value = v.Registers[op1Value]
+	}
+	if op2Type == OpTypeRegister {
+		if op2Value >= uint64(len(v.Registers)) {
+			return 1, &Fault{Kind: FaultInvalidRegister, Address: op2Value}
+		}
+		op2Value = v.Registers[op2Value]
+	}
+	if instructionType.WritesRegister() && op0Value >= uint64(len(v.Registers)) {
+		return 1, &Fault{Kind: FaultInvalidRegister, Address: op0Value}
+	}
+
+	switch instructionType {
+	case InstructionType_NOP:
+		// NOP
+	case InstructionType_ADD:
+		// ADD
+		v.Registers[op0Value] = op1Value + op2Value
+	case InstructionType_SUB:
+		// SUB
+		v.Registers[op0Value] = op1Value - op2Value
+	case InstructionType_MUL:
+		// MUL
+		v.Registers[op0Value] = op1Value * op2Value
+	case InstructionType_DIV:
+		// DIV
+		if op2Value == 0 {
+			return 1, &Fault{Kind: FaultDivideByZero}
+		}
+		v.Registers[op0Value] = op1Value / op2Value
+	case InstructionType_MOD:
+		// MOD
+		if op2Value == 0 {
+			return 1, &Fault{Kind: FaultDivideByZero}
+		}
+		v.Registers[op0Value] = op1Value % op2Value
+	case InstructionType_IDIV:
+		// IDIV
+		if op2Value == 0 {
+			return 1, &Fault{Kind: FaultDivideByZero}
+		}
+		v.Registers[op0Value] = uint64(int64(op1Value) / int64(op2Value))
+	case InstructionType_IMOD:
+		// IMOD
+		if op2Value == 0 {
+			return 1, &Fault{Kind: FaultDivideByZero}
+		}
+		v.Registers[op0Value] = uint64(int64(op1Value) % int64(op2Value))
+
+	case InstructionType_AND:
+		// AND
+		v.Registers[op0Value] = op1Value & op2Value
+	case InstructionType_OR:
+		// OR
+		v.Registers[op0Value] = op1Value | op2Value
+	case InstructionType_XOR:
+		// XOR
+		v.Registers[op0Value] = op1Value ^ op2Value
+	case InstructionType_NOT:
+		// NOT
+		v.Registers[op0Value] = ^op1Value
+
+	case InstructionType_SHL:
+		// SHL
+		v.Registers[op0Value] = op1Value << op2Value
+	case InstructionType_SHR:
+		// SHR
+		v.Registers[op0Value] = op1Value >> op2Value
+	case InstructionType_SAR:
+		// SAR
+		v.Registers[op0Value] = uint64(int64(op1Value) >> op2Value)
+
+	case InstructionType_CMP:
+		// CMP
+		if int64(op1Value) < int64(op2Value) {
+			v.Registers[op0Value] = ^uint64(0)
+		} else if int64(op1Value) > int64(op2Value) {
+			v.Registers[op0Value] = 1
+		} else {
+			v.Registers[op0Value] = 0
+		}
+	case InstructionType_UCMP:
+		// UCMP
+		if op1Value < op2Value {
+			v.Registers[op0Value] = ^uint64(0)
+		} else if op1Value > op2Value {
+			v.Registers[op0Value] = 1
+		} else {
+			v.Registers[op0Value] = 0
+		}
+
+	case InstructionType_POPCNT:
+		// POPCNT
+		v.Registers[op0Value] = uint64(bits.OnesCount64(op1Value))
+	case InstructionType_CLZ:
+		// CLZ
+		v.Registers[op0Value] = uint64(bits.LeadingZeros64(op1Value))
+	case InstructionType_CTZ:
+		// CTZ
+		v.Registers[op0Value] = uint64(bits.TrailingZeros64(op1Value))
+	case InstructionType_ROL:
+		// ROL
+		v.Registers[op0Value] = bits.RotateLeft64(op1Value, int(op2Value&63))
+	case InstructionType_ROR:
+		// ROR
+		v.Registers[op0Value] = bits.RotateLeft64(op1Value, -int(op2Value&63))
+	case InstructionType_BSWAP:
+		// BSWAP
+		v.Registers[op0Value] = bits.ReverseBytes64(op1Value)
+
+	case InstructionType_MULH:
+		// MULH
+		hi, _ := bits.Mul64(op1Value, op2Value)
+		if int64(op1Value) < 0 {
+			hi -= op2Value
+		}
+		if int64(op2Value) < 0 {
+			hi -= op1Value
+		}
+		v.Registers[op0Value] = hi
+	case InstructionType_UMULH:
+		// UMULH
+		hi, _ := bits.Mul64(op1Value, op2Value)
+		v.Registers[op0Value] = hi
+	case InstructionType_ADC:
+		// ADC
+		sum, carry := bits.Add64(op1Value, op2Value, v.Registers[REGISTER_CF]&1)
+		v.Registers[op0Value] = sum
+		v.Registers[REGISTER_CF] = carry
+
+	case InstructionType_FADD:
+		// FADD
+		v.Registers[op0Value] = f64bits(f64(op1Value) + f64(op2Value))
+	case InstructionType_FSUB:
+		// FSUB
+		v.Registers[op0Value] = f64bits(f64(op1Value) - f64(op2Value))
+	case InstructionType_FMUL:
+		// FMUL
+		v.Registers[op0Value] = f64bits(f64(op1Value) * f64(op2Value))
+	case InstructionType_FDIV:
+		// FDIV
+		v.Registers[op0Value] = f64bits(f64(op1Value) / f64(op2Value))
+	case InstructionType_FCMP:
+		// FCMP
+		result, unordered := fcmp(f64(op1Value), f64(op2Value))
+		v.Registers[op0Value] = result
+		v.Registers[REGISTER_CF] = unordered
+	case InstructionType_FSQRT:
+		// FSQRT
+		v.Registers[op0Value] = f64bits(math.Sqrt(f64(op1Value)))
+	case InstructionType_FABS:
+		// FABS
+		v.Registers[op0Value] = f64bits(math.Abs(f64(op1Value)))
+	case InstructionType_FNEG:
+		// FNEG
+		v.Registers[op0Value] = f64bits(-f64(op1Value))
+
+	case InstructionType_FTOI:
+		// FTOI
+		v.Registers[op0Value] = ftoi(f64(op1Value))
+	case InstructionType_FTOU:
+		// FTOU
+		v.Registers[op0Value] = ftou(f64(op1Value))
+	case InstructionType_ITOF:
+		// ITOF
+		v.Registers[op0Value] = f64bits(float64(int64(op1Value)))
+	case InstructionType_UTOF:
+		// UTOF
+		v.Registers[op0Value] = f64bits(float64(op1Value))
+	case InstructionType_FTOF32:
+		// FTOF32
+		v.Registers[op0Value] = uint64(math.Float32bits(float32(f64(op1Value))))
+	case InstructionType_F32TOF:
+		// F32TOF
+		v.Registers[op0Value] = f64bits(float64(math.Float32frombits(uint32(op1Value))))
+
+	case InstructionType_JMP:
+		// JMP
+		v.Registers[REGISTER_PC] = op0Value
+	case InstructionType_JG:
+		// JG
+		if int64(op0Value) > 0 {
+			v.Registers[REGISTER_PC] = op1Value
+		}
+	case InstructionType_JL:
+		// JL
+		if int64(op0Value) < 0 {
+			v.Registers[REGISTER_PC] = op1Value
+		}
+	case InstructionType_JE:
+		// JE
+		if int64(op0Value) == 0 {
+			v.Registers[REGISTER_PC] = op1Value
+		}
+	case InstructionType_JNE:
+		// JNE
+		if int64(op0Value) != 0 {
+			v.Registers[REGISTER_PC] = op1Value
+		}
+	case InstructionType_JGE:
+		// JGE
+		if int64(op0Value) >= 0 {
+			v.Registers[REGISTER_PC] = op1Value
+		}
+	case InstructionType_JLE:
+		// JLE
+		if int64(op0Value) <= 0 {
+			v.Registers[REGISTER_PC] = op1Value
+		}
+
+	case InstructionType_LOAD:
+		// LOAD
+		var buffer [8]byte
+		_, err = v.Memory.ReadAt(op1Value+op2Value, buffer[:])
+		if err != nil {
+			return 1, err
+		}
+		v.Registers[op0Value] = binary.LittleEndian.Uint64(buffer[:])
+	case InstructionType_LOADH:
+		// LOADH
+		var buffer [4]byte
+		_, err = v.Memory.ReadAt(op1Value+op2Value, buffer[:])
+		if err != nil {
+			return 1, err
+		}
+		v.Registers[op0Value] = uint64(binary.LittleEndian.Uint32(buffer[:]))
+	case InstructionType_LOADB:
+		// LOADB
+		var buffer [1]byte
+		_, err = v.Memory.ReadAt(op1Value+op2Value, buffer[:])
+		if err != nil {
+			return 1, err
+		}
+		v.Registers[op0Value] = uint64(buffer[0])
+	case InstructionType_LOADSH:
+		// LOADSH
+		var buffer [4]byte
+		_, err = v.Memory.ReadAt(op1Value+op2Value, buffer[:])
+		if err != nil {
+			return 1, err
+		}
+		v.Registers[op0Value] = uint64(int32(binary.LittleEndian.Uint32(buffer[:])))
+	case InstructionType_LOADSB:
+		// LOADSB
+		var buffer [1]byte
+		_, err = v.Memory.ReadAt(op1Value+op2Value, buffer[:])
+		if err != nil {
+			return 1, err
+		}
+		v.Registers[op0Value] = uint64(int8(buffer[0]))
+
+	case InstructionType_STORE:
+		// STORE
+		var buffer [8]byte
+		binary.LittleEndian.PutUint64(buffer[:], op0Value)
+		_, err = v.Memory.WriteAt(op1Value+op2Value, buffer[:])
+		if err != nil {
+			return 1, err
+		}
+	case InstructionType_STOREH:
+		// STOREH
+		var buffer [4]byte
+		binary.LittleEndian.PutUint32(buffer[:], uint32(op0Value))
+		_, err = v.Memory.WriteAt(op1Value+op2Value, buffer[:])
+		if err != nil {
+			return 1, err
+		}
+	case InstructionType_STOREB:
+		// STOREB
+		var buffer [1]byte
+		buffer[0] = byte(op0Value)
+		_, err = v.Memory.WriteAt(op1Value+op2Value, buffer[:])
+		if err != nil {
+			return 1, err
+		}
+
+	case InstructionType_MOV:
+		// MOV
+		v.Registers[op0Value] = op1Value
+	case InstructionType_MOVH:
+		// MOVH
+		v.Registers[op0Value] = uint64(uint32(op1Value))
+	case InstructionType_MOVB:
+		// MOVB
+		v.Registers[op0Value] = uint64(uint8(op1Value))
 
-		case InstructionType_MOV:
-			// MOV
+	case InstructionType_CMOVG:
+		// CMOVG
+		if int64(op2Value) > 0 {
 			v.Registers[op0Value] = op1Value
-		case InstructionType_MOVH:
-			// MOVH
-			v.Registers[op0Value] = uint64(uint32(op1Value))
-		case InstructionType_MOVB:
-			// MOVB
-			v.Registers[op0Value] = uint64(uint8(op1Value))
-
-		case InstructionType_PUSH:
-			// PUSH
-			v.Registers[REGISTER_SP] -= 8
-			var buffer [8]byte
-			binary.LittleEndian.PutUint64(buffer[:], op0Value)
-			_, err = v.Memory.WriteAt(v.Registers[REGISTER_SP], buffer[:])
-			if err != nil {
-				return 1, err
-			}
-		case InstructionType_POP:
-			// POP
-			var buffer [8]byte
-			_, err = v.Memory.ReadAt(v.Registers[REGISTER_SP], buffer[:])
-			v.Registers[REGISTER_SP] += 8
-			if err != nil {
-				return 1, err
-			}
-			v.Registers[op0Value] = binary.LittleEndian.Uint64(buffer[:])
-
-		case InstructionType_CALL:
-			// CALL
-			v.Registers[REGISTER_SP] -= 8
-			var buffer [8]byte
-			binary.LittleEndian.PutUint64(buffer[:], v.Registers[REGISTER_PC])
-			_, err = v.Memory.WriteAt(v.Registers[REGISTER_SP], buffer[:])
-			if err != nil {
-				return 1, err
-			}
-			v.Registers[REGISTER_PC] = op0Value
-		case InstructionType_RET:
-			// RET
-			var buffer [8]byte
-			_, err = v.Memory.ReadAt(v.Registers[REGISTER_SP], buffer[:])
-			v.Registers[REGISTER_SP] += 8
-			if err != nil {
-				return 1, err
+		}
+	case InstructionType_CMOVL:
+		// CMOVL
+		if int64(op2Value) < 0 {
+			v.Registers[op0Value] = op1Value
+		}
+	case InstructionType_CMOVE:
+		// CMOVE
+		if int64(op2Value) == 0 {
+			v.Registers[op0Value] = op1Value
+		}
+	case InstructionType_CMOVNE:
+		// CMOVNE
+		if int64(op2Value) != 0 {
+			v.Registers[op0Value] = op1Value
+		}
+	case InstructionType_CMOVGE:
+		// CMOVGE
+		if int64(op2Value) >= 0 {
+			v.Registers[op0Value] = op1Value
+		}
+	case InstructionType_CMOVLE:
+		// CMOVLE
+		if int64(op2Value) <= 0 {
+			v.Registers[op0Value] = op1Value
+		}
+	case InstructionType_SELECT:
+		// SELECT
+		if v.Registers[op0Value] != 0 {
+			v.Registers[op0Value] = op1Value
+		} else {
+			v.Registers[op0Value] = op2Value
+		}
+
+	case InstructionType_PUSH:
+		// PUSH
+		var buffer [8]byte
+		binary.LittleEndian.PutUint64(buffer[:], op0Value)
+		_, err = v.Memory.WriteAt(v.Registers[REGISTER_SP]-8, buffer[:])
+		if err != nil {
+			return 1, stackFault(err)
+		}
+		v.Registers[REGISTER_SP] -= 8
+	case InstructionType_POP:
+		// POP
+		var buffer [8]byte
+		_, err = v.Memory.ReadAt(v.Registers[REGISTER_SP], buffer[:])
+		if err != nil {
+			return 1, err
+		}
+		v.Registers[REGISTER_SP] += 8
+		v.Registers[op0Value] = binary.LittleEndian.Uint64(buffer[:])
+
+	case InstructionType_CALL:
+		// CALL
+		var buffer [8]byte
+		binary.LittleEndian.PutUint64(buffer[:], v.Registers[REGISTER_PC])
+		_, err = v.Memory.WriteAt(v.Registers[REGISTER_SP]-8, buffer[:])
+		if err != nil {
+			return 1, stackFault(err)
+		}
+		v.Registers[REGISTER_SP] -= 8
+		v.Registers[REGISTER_PC] = op0Value
+		v.CallDepth++
+	case InstructionType_RET:
+		// RET
+		var buffer [8]byte
+		_, err = v.Memory.ReadAt(v.Registers[REGISTER_SP], buffer[:])
+		if err != nil {
+			return 1, err
+		}
+		v.Registers[REGISTER_SP] += 8
+		v.Registers[REGISTER_PC] = binary.LittleEndian.Uint64(buffer[:])
+		if v.CallDepth > 0 {
+			v.CallDepth--
+		}
+	case InstructionType_IRET:
+		// IRET
+		var buffer [8]byte
+		_, err = v.Memory.ReadAt(v.Registers[REGISTER_SP], buffer[:])
+		if err != nil {
+			return 1, err
+		}
+		v.Registers[REGISTER_SP] += 8
+		v.Registers[REGISTER_PC] = binary.LittleEndian.Uint64(buffer[:])
+		if v.CallDepth > 0 {
+			v.CallDepth--
+		}
+		v.InterruptsDisabled = false
+
+	case InstructionType_JTAB:
+		// JTAB
+		target, err := v.tableEntry(op0Value, op1Value)
+		if err != nil {
+			return 1, err
+		}
+		v.Registers[REGISTER_PC] = target
+	case InstructionType_CALLT:
+		// CALLT
+		target, err := v.tableEntry(op0Value, op1Value)
+		if err != nil {
+			return 1, err
+		}
+		var buffer [8]byte
+		binary.LittleEndian.PutUint64(buffer[:], v.Registers[REGISTER_PC])
+		_, err = v.Memory.WriteAt(v.Registers[REGISTER_SP]-8, buffer[:])
+		if err != nil {
+			return 1, stackFault(err)
+		}
+		v.Registers[REGISTER_SP] -= 8
+		v.Registers[REGISTER_PC] = target
+		v.CallDepth++
+
+	case InstructionType_MEMCPY, InstructionType_MEMSET, InstructionType_MEMCMP:
+		// MEMCPY, MEMSET, MEMCMP
+		// Check the budget first, so the instruction is retried once the
+		// limit is raised.
+		size := op2Value
+		if instructionType == InstructionType_MEMCMP {
+			size = v.Registers[op0Value]
+		}
+		chunks := size / BULK_CHUNK_SIZE
+		if v.overBudget(chunks) {
+			v.Registers[REGISTER_PC] = result.PC
+			return 1, ErrBudgetExhausted
+		}
+		switch instructionType {
+		case InstructionType_MEMCPY:
+			err = Memmove(v.Memory, op0Value, op1Value, op2Value)
+		case InstructionType_MEMSET:
+			err = Memset(v.Memory, op0Value, byte(op1Value), op2Value)
+		default:
+			var c int
+			c, err = Memcmp(v.Memory, op1Value, op2Value, size)
+			if err == nil {
+				v.Registers[op0Value] = uint64(int64(c))
 			}
-			v.Registers[REGISTER_PC] = binary.LittleEndian.Uint64(buffer[:])
+		}
+		if err != nil {
+			return 1, err
+		}
+		v.charge(chunks)
 
-		case InstructionType_SYSCALL:
-			// SYSCALL
-			sysfunc, ok := syscall_Function_Table[op1Value]
-			if !ok {
-				return 1, fmt.Errorf("ENOSYS")
+	case InstructionType_LOADA, InstructionType_LOADAH, InstructionType_LOADAB:
+		// LOADA
+		err = atomicAccess(v.Memory, op1Value+op2Value, atomicSize(instructionType), PermRead, func(b []byte) {
+			v.Registers[op0Value] = getUint(b)
+		})
+		if err != nil {
+			return 1, err
+		}
+	case InstructionType_STOREL, InstructionType_STORELH, InstructionType_STORELB:
+		// STOREL
+		err = atomicAccess(v.Memory, op1Value+op2Value, atomicSize(instructionType), PermWrite, func(b []byte) {
+			putUint(b, op0Value)
+		})
+		if err != nil {
+			return 1, err
+		}
+	case InstructionType_XADD, InstructionType_XADDH, InstructionType_XADDB:
+		// XADD
+		err = atomicAccess(v.Memory, op1Value, atomicSize(instructionType), PermRW, func(b []byte) {
+			old := getUint(b)
+			putUint(b, old+op2Value)
+			v.Registers[op0Value] = old
+		})
+		if err != nil {
+			return 1, err
+		}
+	case InstructionType_XCHG, InstructionType_XCHGH, InstructionType_XCHGB:
+		// XCHG
+		err = atomicAccess(v.Memory, op1Value, atomicSize(instructionType), PermRW, func(b []byte) {
+			old := getUint(b)
+			putUint(b, op2Value)
+			v.Registers[op0Value] = old
+		})
+		if err != nil {
+			return 1, err
+		}
+	case InstructionType_CAS, InstructionType_CASH, InstructionType_CASB:
+		// CAS
+		size := atomicSize(instructionType)
+		expected := v.Registers[op0Value]
+		if size < WORD_SIZE {
+			expected &= 1<<(size*8) - 1
+		}
+		err = atomicAccess(v.Memory, op1Value, size, PermRW, func(b []byte) {
+			old := getUint(b)
+			if old == expected {
+				putUint(b, op2Value)
 			}
-			errno, err := sysfunc(v, op0Value, op1Value, op2Value)
-			if err != nil {
-				if err == ErrExited {
-					return errno, nil
-				}
-				return errno, err
+			v.Registers[op0Value] = old
+		})
+		if err != nil {
+			return 1, err
+		}
+
+	case InstructionType_SYSCALL:
+		// SYSCALL
+		syscalls := v.Syscalls
+		if syscalls == nil {
+			syscalls = defaultSyscallTable
+		}
+		sysfunc, ok := syscalls.Lookup(op1Value)
+		if !ok {
+			return 1, &Fault{Kind: FaultUnknownSyscall, Address: op1Value}
+		}
+		g := v.threads
+		if g != nil {
+			g.enterSyscall(v)
+		}
+		errno, err := sysfunc(v, op0Value, op1Value, op2Value)
+		if g != nil {
+			g.exitSyscall(v)
+		}
+		if err != nil {
+			if err == ErrExited {
+				result.Halted = true
+				return errno, nil
 			}
-		default:
-			return 1, ErrInvalidInstruction
+			return errno, err
+		}
+		v.Registers[op0Value] = errno
+		if v.fibers != nil && v.fibers.next != nil {
+			v.switchFiber()
 		}
+	default:
+		return 1, &Fault{Kind: FaultInvalidOpcode}
 	}
+	return 0, nil
 }
@@ -0,0 +1,422 @@
+package lvm2
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/lemon-mint/lvm2/errs"
+)
+
+type testInstruction struct {
+	Type InstructionType
+	Ops  []testOperand
+}
+
+type testOperand struct {
+	Type  OpType
+	Value uint64
+}
+
+func reg(r uint64) testOperand  { return testOperand{OpTypeRegister, r} }
+func cnst(v uint64) testOperand { return testOperand{OpTypeConstant, v} }
+func inst(t InstructionType, ops ...testOperand) testInstruction {
+	return testInstruction{t, ops}
+}
+
+func assemble(insts ...testInstruction) []byte {
+	var code []byte
+	for _, in := range insts {
+		var ops [3]uint64
+		var opt byte
+		for i, op := range in.Ops {
+			opt |= byte(op.Type) << (6 - i*2)
+			ops[i] = op.Value
+		}
+		code = append(code, New_InstructionOpcode(uint8(in.Type), opt, ops[0], ops[1], ops[2])...)
+	}
+	return code
+}
+
+func newTestVM(insts ...testInstruction) *VM {
+	m := NewMemory()
+	vm := &VM{
+		Memory: m,
+		Files:  map[uint64]VMFile{},
+	}
+	vm.Registers[REGISTER_SP] = m.StackTop()
+	vm.Registers[REGISTER_SB] = m.StackTop()
+	vm.Memory.SetProgram(assemble(insts...))
+	return vm
+}
+
+func exitInst(code uint64) []testInstruction {
+	return []testInstruction{
+		inst(InstructionType_MOV, cnst(REGISTER_SYS32), cnst(code)),
+		inst(InstructionType_SYSCALL, cnst(REGISTER_R0), cnst(SYS_EXIT), cnst(0)),
+	}
+}
+
+func TestVM_Step(t *testing.T) {
+	vm := newTestVM(append([]testInstruction{
+		inst(InstructionType_MOV, cnst(REGISTER_R1), cnst(40)),
+		inst(InstructionType_ADD, cnst(REGISTER_R1), reg(REGISTER_R1), cnst(2)),
+	}, exitInst(7)...)...)
+
+	result, err := vm.Step()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Instruction.Type != InstructionType_MOV || result.PC != 0 || result.NextPC != InstructionBytecodeSize {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	if vm.Registers[REGISTER_R1] != 40 {
+		t.Fatalf("R1 = %d, want 40", vm.Registers[REGISTER_R1])
+	}
+
+	result, err = vm.Step()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Instruction.Op1Type != OpTypeRegister || result.Instruction.Op1Value != REGISTER_R1 {
+		t.Fatalf("unexpected operands: %+v", result.Instruction)
+	}
+	if vm.Registers[REGISTER_R1] != 42 {
+		t.Fatalf("R1 = %d, want 42", vm.Registers[REGISTER_R1])
+	}
+
+	for !result.Halted {
+		result, err = vm.Step()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if result.ExitCode != 7 {
+		t.Fatalf("exit code = %d, want 7", result.ExitCode)
+	}
+}
+
+func TestVM_Run(t *testing.T) {
+	vm := newTestVM(exitInst(3)...)
+	code, err := vm.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != 3 {
+		t.Fatalf("exit code = %d, want 3", code)
+	}
+}
+
+func TestVM_RunContext(t *testing.T) {
+	loop := []testInstruction{
+		inst(InstructionType_ADD, cnst(REGISTER_R1), reg(REGISTER_R1), cnst(1)),
+		inst(InstructionType_JMP, cnst(0)),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	vm := newTestVM(loop...)
+	_, err := vm.RunContext(ctx)
+	if !errors.Is(err, ErrCanceled) || !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want ErrCanceled", err)
+	}
+
+	vm = newTestVM(loop...)
+	vm.InstructionLimit = 101
+	_, err = vm.Run()
+	if err != ErrBudgetExhausted {
+		t.Fatalf("err = %v, want ErrBudgetExhausted", err)
+	}
+	if vm.Registers[REGISTER_R1] != 51 || vm.Registers[REGISTER_PC] != InstructionBytecodeSize {
+		t.Fatalf("R1 = %d, PC = %d", vm.Registers[REGISTER_R1], vm.Registers[REGISTER_PC])
+	}
+
+	// Resume with a larger budget.
+	vm.InstructionLimit += 10
+	_, err = vm.Run()
+	if err != ErrBudgetExhausted {
+		t.Fatalf("err = %v, want ErrBudgetExhausted", err)
+	}
+	if vm.Registers[REGISTER_R1] != 56 {
+		t.Fatalf("R1 = %d, want 56", vm.Registers[REGISTER_R1])
+	}
+}
+
+func TestVM_Fault(t *testing.T) {
+	vm := newTestVM(
+		inst(InstructionType_NOP),
+		inst(InstructionType_LOAD, cnst(REGISTER_R1), cnst(0x10000), cnst(8)),
+	)
+	_, err := vm.Run()
+
+	var f *Fault
+	if !errors.As(err, &f) {
+		t.Fatalf("err = %v, want *Fault", err)
+	}
+	if f.Kind != FaultSegmentation || f.PC != InstructionBytecodeSize || f.Address != 0x10008 {
+		t.Fatalf("unexpected fault: %+v", f)
+	}
+	if f.Instruction.Type != InstructionType_LOAD {
+		t.Fatalf("unexpected instruction: %v", f.Instruction)
+	}
+	if !errors.Is(err, ErrSegmentationFault) {
+		t.Fatal("fault does not match ErrSegmentationFault")
+	}
+
+	vm = newTestVM(inst(InstructionType_SYSCALL, cnst(REGISTER_R0), cnst(12345), cnst(0)))
+	_, err = vm.Run()
+	if !errors.As(err, &f) || f.Kind != FaultUnknownSyscall || f.Address != 12345 {
+		t.Fatalf("err = %v, want unknown syscall fault", err)
+	}
+}
+
+func TestVM_Trap(t *testing.T) {
+	prog := []testInstruction{
+		inst(InstructionType_MOV, cnst(REGISTER_R1), cnst(10)),
+		inst(InstructionType_DIV, cnst(REGISTER_R2), reg(REGISTER_R1), cnst(0)),
+		inst(InstructionType_MOV, cnst(500), cnst(1)),
+	}
+	prog = append(prog, exitInst(0)...)
+
+	vm := newTestVM(prog...)
+	_, err := vm.Run()
+	var f *Fault
+	if !errors.As(err, &f) || f.Kind != FaultDivideByZero || f.PC != InstructionBytecodeSize {
+		t.Fatalf("err = %v, want divide by zero fault", err)
+	}
+
+	// handler: R3 += 1; RET
+	handler := uint64(len(prog)) * InstructionBytecodeSize
+	prog = append(prog,
+		inst(InstructionType_ADD, cnst(REGISTER_R3), reg(REGISTER_R3), cnst(1)),
+		inst(InstructionType_RET),
+	)
+	vm = newTestVM(prog...)
+	vm.TrapHandler = handler
+	code, err := vm.Run()
+	if err != nil || code != 0 {
+		t.Fatalf("Run() = %d, %v", code, err)
+	}
+	if vm.Registers[REGISTER_R3] != 2 {
+		t.Fatalf("R3 = %d, want 2", vm.Registers[REGISTER_R3])
+	}
+	if vm.Registers[REGISTER_SYS62] != uint64(FaultInvalidRegister) || vm.Registers[REGISTER_SYS63] != 2*InstructionBytecodeSize {
+		t.Fatalf("SYS62 = %d, SYS63 = %d", vm.Registers[REGISTER_SYS62], vm.Registers[REGISTER_SYS63])
+	}
+}
+
+func TestVM_StackGuard(t *testing.T) {
+	// recurse forever: CALL 0
+	vm := newTestVM(inst(InstructionType_CALL, cnst(0)))
+	m := NewMemoryWithConfig(MemoryConfig{StackSize: PAGE_SIZE})
+	vm.Memory = m
+	vm.SetProgram(assemble(inst(InstructionType_CALL, cnst(0))))
+	vm.Registers[REGISTER_SP] = m.StackTop()
+	_, err := vm.Run()
+
+	var f *Fault
+	if !errors.As(err, &f) || f.Kind != FaultStackOverflow {
+		t.Fatalf("err = %v, want stack overflow", err)
+	}
+	if f.PC != 0 || f.CallDepth != PAGE_SIZE/8 || f.Address >= m.Stack.Start {
+		t.Fatalf("unexpected fault: %+v", f)
+	}
+	if vm.Registers[REGISTER_SP] != m.Stack.Start {
+		t.Fatalf("SP = %#x, want %#x", vm.Registers[REGISTER_SP], m.Stack.Start)
+	}
+
+	// RET and POP on an empty stack
+	for _, in := range []testInstruction{
+		inst(InstructionType_RET),
+		inst(InstructionType_POP, cnst(REGISTER_R1)),
+	} {
+		vm = newTestVM(in)
+		sp := vm.Registers[REGISTER_SP]
+		_, err = vm.Run()
+		if !errors.As(err, &f) || f.Kind != FaultStackUnderflow {
+			t.Fatalf("%v: err = %v, want stack underflow", in.Type, err)
+		}
+		if !errors.Is(err, ErrSegmentationFault) {
+			t.Fatalf("%v: fault does not match ErrSegmentationFault", in.Type)
+		}
+		if vm.Registers[REGISTER_SP] != sp {
+			t.Fatalf("%v: SP = %#x, want %#x", in.Type, vm.Registers[REGISTER_SP], sp)
+		}
+	}
+
+	// the heap never grows into the guard region
+	m = NewMemoryWithConfig(MemoryConfig{StackSize: PAGE_SIZE})
+	if _, err := m.Allocate(m.Stack.Start - STACK_GUARD_SIZE/2); err == nil {
+		t.Fatal("allocation overlapping the stack guard succeeded")
+	}
+}
+
+func words(values ...uint64) []byte {
+	b := make([]byte, len(values)*WORD_SIZE)
+	for i, v := range values {
+		binary.LittleEndian.PutUint64(b[i*WORD_SIZE:], v)
+	}
+	return b
+}
+
+func TestVM_JumpTable(t *testing.T) {
+	prog := []testInstruction{
+		inst(InstructionType_JTAB, cnst(7*InstructionBytecodeSize), reg(REGISTER_R1)),
+		inst(InstructionType_CALLT, cnst(7*InstructionBytecodeSize), reg(REGISTER_R1)),
+		inst(InstructionType_JMP, cnst(0)),
+	}
+	prog = append(prog, exitInst(10)...)
+	prog = append(prog, exitInst(11)...)
+	code := append(assemble(prog...), words(2, 3*InstructionBytecodeSize, 5*InstructionBytecodeSize)...)
+
+	for index, want := range []uint64{10, 11} {
+		vm := newTestVM()
+		vm.SetProgram(code)
+		vm.Registers[REGISTER_R1] = uint64(index)
+		ret, err := vm.Run()
+		if err != nil || ret != want {
+			t.Fatalf("index %d: Run() = %d, %v, want %d", index, ret, err, want)
+		}
+	}
+
+	vm := newTestVM()
+	vm.SetProgram(code)
+	vm.SetProgramCounter(InstructionBytecodeSize)
+	vm.Registers[REGISTER_R1] = 1
+	if _, err := vm.Step(); err != nil {
+		t.Fatal(err)
+	}
+	if vm.Registers[REGISTER_PC] != 5*InstructionBytecodeSize || vm.Registers[REGISTER_SP] != stackTop(vm.Memory)-8 {
+		t.Fatalf("PC = %d, SP = %#x", vm.Registers[REGISTER_PC], vm.Registers[REGISTER_SP])
+	}
+
+	vm = newTestVM()
+	vm.SetProgram(code)
+	vm.Registers[REGISTER_R1] = 2
+	_, err := vm.Run()
+	var f *Fault
+	if !errors.As(err, &f) || f.Kind != FaultTableIndex || f.Address != 2 {
+		t.Fatalf("err = %v, want table index fault", err)
+	}
+}
+
+func TestVM_MemoryProtection(t *testing.T) {
+	prog := []testInstruction{
+		inst(InstructionType_STORE, cnst(42), cnst(0), cnst(0)),
+	}
+	prog = append(prog, exitInst(0)...)
+
+	vm := newTestVM(prog...)
+	_, err := vm.Run()
+	var f *Fault
+	if !errors.As(err, &f) || f.Kind != FaultProtection || f.Access != PermWrite || f.Address != 0 {
+		t.Fatalf("err = %v, want write protection fault", err)
+	}
+
+	prog = append([]testInstruction{
+		inst(InstructionType_MOV, cnst(REGISTER_SYS32), cnst(0)),
+		inst(InstructionType_MOV, cnst(REGISTER_SYS33), cnst(uint64(PermRWX))),
+		inst(InstructionType_SYSCALL, cnst(REGISTER_R0), cnst(SYS_MPROTECT), cnst(0)),
+	}, prog...)
+	vm = newTestVM(prog...)
+	if _, err := vm.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Jump to the (non-executable) stack.
+	vm = newTestVM(inst(InstructionType_JMP, reg(REGISTER_SP)))
+	vm.Registers[REGISTER_SP] -= 64
+	_, err = vm.Run()
+	if !errors.As(err, &f) || f.Kind != FaultProtection || f.Access != PermExec {
+		t.Fatalf("err = %v, want exec protection fault", err)
+	}
+}
+
+// countingMemory exposes only the core VMMemory methods of the memory it
+// wraps and counts writes.
+type countingMemory struct {
+	VMMemory
+	Writes int
+}
+
+func (m *countingMemory) WriteAt(address uint64, p []byte) (int, error) {
+	m.Writes++
+	return m.VMMemory.WriteAt(address, p)
+}
+
+func TestVM_MemoryInterface(t *testing.T) {
+	prog := []testInstruction{
+		inst(InstructionType_PUSH, cnst(1)),
+		inst(InstructionType_MOV, cnst(REGISTER_SYS32), cnst(0)),
+		inst(InstructionType_MOV, cnst(REGISTER_SYS33), cnst(16)),
+		inst(InstructionType_SYSCALL, cnst(REGISTER_R1), cnst(SYS_REALLOC), cnst(0)),
+		inst(InstructionType_MOV, cnst(REGISTER_SYS32), reg(REGISTER_R1)),
+		inst(InstructionType_SYSCALL, cnst(REGISTER_R0), cnst(SYS_EXIT), cnst(0)),
+	}
+
+	m := NewMemory()
+	cm := &countingMemory{VMMemory: m}
+	vm := &VM{Memory: cm}
+	vm.SetProgram(assemble(prog...))
+	vm.Registers[REGISTER_SP] = m.StackTop()
+
+	code, err := vm.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != errs.ENOSYS.Errno() {
+		t.Fatalf("realloc without VMMemoryReallocator: errno = %d", code)
+	}
+	if cm.Writes != 1 {
+		t.Fatalf("writes = %d, want 1", cm.Writes)
+	}
+}
+
+func TestVM_ProgramData(t *testing.T) {
+	prog := append([]testInstruction{
+		inst(InstructionType_STORE, cnst(42), reg(REGISTER_R1), cnst(8)),
+		inst(InstructionType_LOAD, cnst(REGISTER_R2), reg(REGISTER_R1), cnst(0)),
+		inst(InstructionType_JMP, reg(REGISTER_R1)),
+	}, exitInst(0)...)
+	text := assemble(prog...)
+	data := []byte("0123456789ABCDEF")
+	address := DataAddress(uint64(len(text)))
+	for name, m := range map[string]VMMemory{"Blocks": NewMemory(), "Paged": NewPagedMemory()} {
+		vm := &VM{Memory: m}
+		vm.SetProgramData(text, data)
+		vm.Registers[REGISTER_R1] = address
+
+		// Data is writable but not executable.
+		_, err := vm.Run()
+		var f *Fault
+		if !errors.As(err, &f) || f.Kind != FaultProtection || f.Access != PermExec || f.Address != address {
+			t.Fatalf("%s: err = %v, want exec protection fault", name, err)
+		}
+		if vm.Registers[REGISTER_R2] != 0x3736353433323130 {
+			t.Fatalf("%s: R2 = %#x, want the data", name, vm.Registers[REGISTER_R2])
+		}
+		got := make([]byte, 16)
+		m.ReadAt(address, got)
+		if !bytes.Equal(got, append([]byte("01234567"), 42, 0, 0, 0, 0, 0, 0, 0)) {
+			t.Fatalf("%s: data = %q", name, got)
+		}
+		if string(data) != "0123456789ABCDEF" {
+			t.Fatalf("%s: SetProgramData wrote to its argument", name)
+		}
+
+		// Text stays read-only.
+		vm.Registers[REGISTER_R1] = 0
+		vm.SetProgramCounter(0)
+		_, err = vm.Run()
+		if !errors.As(err, &f) || f.Kind != FaultProtection || f.Access != PermWrite {
+			t.Fatalf("%s: err = %v, want write protection fault", name, err)
+		}
+
+		// The heap starts after the data.
+		if a, err := m.Allocate(8); err != nil || a < address+uint64(len(data)) {
+			t.Fatalf("%s: Allocate() = %#x, %v", name, a, err)
+		}
+	}
+}